@@ -0,0 +1,367 @@
+package main
+
+import (
+	"cmp"
+	"encoding/binary"
+	iofs "io/fs"
+	"slices"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/aerospike/aerospike-client-go/v8"
+)
+
+// POSIX ACLs are set and read as the system.posix_acl_access and system.posix_acl_default xattrs, in the kernel
+// xattr format, and stored as such in the "AclAccess" and "AclDefault" bins of the inode record, next to the Mode
+// the owner, group (or mask, if present) and other entries of an access ACL mirror the permission bits of Mode:
+// chmod rewrites them, setting an access ACL sets the Mode bits, and access ACLs equivalent to the Mode are not stored
+// new entries of a directory with a default ACL inherit it, restricted by their creation mode; new directories also
+// inherit it as their own default ACL
+// bazil.org/fuse does not negotiate kernel ACL support, so the kernel passes the xattrs through and leaves checking
+// permissions to the filesystem; the mount negotiates FUSE_DONT_MASK, so that the umask is applied here, and only to
+// entries not inheriting a default ACL
+const (
+	aclAccessXattr  = "system.posix_acl_access"
+	aclDefaultXattr = "system.posix_acl_default"
+)
+
+// xattr format: little endian version header, followed by tag, perm, id entries
+const (
+	aclVersion     = 2
+	aclHeaderSize  = 4
+	aclEntrySize   = 8
+	aclUndefinedId = 0xffffffff
+)
+
+// entry tags
+const (
+	aclUserObj  = 0x01
+	aclUser     = 0x02
+	aclGroupObj = 0x04
+	aclGroup    = 0x08
+	aclMask     = 0x10
+	aclOther    = 0x20
+)
+
+// permissions, also the access(2) mask bits
+const (
+	permRead    = 4
+	permWrite   = 2
+	permExecute = 1
+)
+
+type aclEntry struct {
+	tag  uint16
+	perm uint16
+	id   uint32
+}
+
+// parseACL decodes and validates an ACL xattr value
+func parseACL(b []byte) ([]aclEntry, error) {
+	if len(b) < aclHeaderSize || (len(b)-aclHeaderSize)%aclEntrySize != 0 || binary.LittleEndian.Uint32(b) != aclVersion {
+		return nil, syscall.EINVAL
+	}
+	entries := make([]aclEntry, 0, (len(b)-aclHeaderSize)/aclEntrySize)
+	for off := aclHeaderSize; off < len(b); off += aclEntrySize {
+		e := aclEntry{
+			tag:  binary.LittleEndian.Uint16(b[off:]),
+			perm: binary.LittleEndian.Uint16(b[off+2:]),
+			id:   binary.LittleEndian.Uint32(b[off+4:]),
+		}
+		if e.perm&^(permRead|permWrite|permExecute) != 0 {
+			return nil, syscall.EINVAL
+		}
+		switch e.tag {
+		case aclUser, aclGroup:
+		case aclUserObj, aclGroupObj, aclMask, aclOther:
+			e.id = aclUndefinedId
+		default:
+			return nil, syscall.EINVAL
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) == 0 {
+		return entries, nil
+	}
+	slices.SortFunc(entries, func(a, b aclEntry) int {
+		if a.tag != b.tag {
+			return cmp.Compare(a.tag, b.tag)
+		}
+		return cmp.Compare(a.id, b.id)
+	})
+	// each base entry exactly once, named entries once per id, and a mask if there are named entries
+	counts := make(map[uint16]int)
+	for i, e := range entries {
+		if i > 0 && entries[i-1].tag == e.tag && entries[i-1].id == e.id {
+			return nil, syscall.EINVAL
+		}
+		counts[e.tag]++
+	}
+	if counts[aclUserObj] != 1 || counts[aclGroupObj] != 1 || counts[aclOther] != 1 {
+		return nil, syscall.EINVAL
+	}
+	if counts[aclMask] == 0 && counts[aclUser]+counts[aclGroup] > 0 {
+		return nil, syscall.EINVAL
+	}
+	return entries, nil
+}
+
+func encodeACL(entries []aclEntry) []byte {
+	b := make([]byte, aclHeaderSize+len(entries)*aclEntrySize)
+	binary.LittleEndian.PutUint32(b, aclVersion)
+	for i, e := range entries {
+		off := aclHeaderSize + i*aclEntrySize
+		binary.LittleEndian.PutUint16(b[off:], e.tag)
+		binary.LittleEndian.PutUint16(b[off+2:], e.perm)
+		binary.LittleEndian.PutUint32(b[off+4:], e.id)
+	}
+	return b
+}
+
+// modeACL returns the minimal ACL equivalent to the permission bits of mode
+func modeACL(mode uint32) []aclEntry {
+	return []aclEntry{
+		{tag: aclUserObj, perm: uint16(mode>>6) & 7, id: aclUndefinedId},
+		{tag: aclGroupObj, perm: uint16(mode>>3) & 7, id: aclUndefinedId},
+		{tag: aclOther, perm: uint16(mode) & 7, id: aclUndefinedId},
+	}
+}
+
+// aclMode returns the permission bits mirrored by an access ACL
+func aclMode(entries []aclEntry) uint32 {
+	var mode, group, mask uint32
+	hasMask := false
+	for _, e := range entries {
+		switch e.tag {
+		case aclUserObj:
+			mode |= uint32(e.perm) << 6
+		case aclGroupObj:
+			group = uint32(e.perm)
+		case aclMask:
+			mask = uint32(e.perm)
+			hasMask = true
+		case aclOther:
+			mode |= uint32(e.perm)
+		}
+	}
+	if hasMask {
+		return mode | mask<<3
+	}
+	return mode | group<<3
+}
+
+// aclWithMode returns a copy of an access ACL, with the entries mirroring the permission bits set from mode
+func aclWithMode(entries []aclEntry, mode uint32) []aclEntry {
+	entries = slices.Clone(entries)
+	hasMask := slices.ContainsFunc(entries, func(e aclEntry) bool { return e.tag == aclMask })
+	for i, e := range entries {
+		switch {
+		case e.tag == aclUserObj:
+			entries[i].perm = uint16(mode>>6) & 7
+		case e.tag == aclMask, e.tag == aclGroupObj && !hasMask:
+			entries[i].perm = uint16(mode>>3) & 7
+		case e.tag == aclOther:
+			entries[i].perm = uint16(mode) & 7
+		}
+	}
+	return entries
+}
+
+// inheritACL returns the access ACL (nil if equivalent to the mode) and the mode of an entry created with mode in a
+// directory with the default ACL def
+func inheritACL(def []byte, mode uint32) ([]byte, uint32, error) {
+	entries, err := parseACL(def)
+	if err != nil || len(entries) == 0 {
+		return nil, mode, err
+	}
+	hasMask := slices.ContainsFunc(entries, func(e aclEntry) bool { return e.tag == aclMask })
+	for i, e := range entries {
+		switch {
+		case e.tag == aclUserObj:
+			entries[i].perm &= uint16(mode>>6) & 7
+		case e.tag == aclMask, e.tag == aclGroupObj && !hasMask:
+			entries[i].perm &= uint16(mode>>3) & 7
+		case e.tag == aclOther:
+			entries[i].perm &= uint16(mode) & 7
+		}
+	}
+	mode = mode&^0o777 | aclMode(entries)
+	if len(entries) == 3 {
+		return nil, mode, nil
+	}
+	return encodeACL(entries), mode, nil
+}
+
+// aclPermits checks the wanted permissions of a caller against an access ACL, like the kernel does
+func aclPermits(entries []aclEntry, uid uint32, gids []uint32, owner uint32, group uint32, want uint16) bool {
+	mask := uint16(7)
+	for _, e := range entries {
+		if e.tag == aclMask {
+			mask = e.perm
+		}
+	}
+	for _, e := range entries {
+		switch {
+		case e.tag == aclUserObj && uid == owner:
+			return e.perm&want == want
+		case e.tag == aclUser && uid == e.id:
+			return e.perm&mask&want == want
+		}
+	}
+	inGroup := false
+	for _, e := range entries {
+		var matches bool
+		switch e.tag {
+		case aclGroupObj:
+			matches = slices.Contains(gids, group)
+		case aclGroup:
+			matches = slices.Contains(gids, e.id)
+		}
+		if matches {
+			if e.perm&mask&want == want {
+				return true
+			}
+			inGroup = true
+		}
+	}
+	if inGroup {
+		return false
+	}
+	for _, e := range entries {
+		if e.tag == aclOther {
+			return e.perm&want == want
+		}
+	}
+	return false
+}
+
+// aclBin returns the bin storing an ACL xattr
+func aclBin(name string) string {
+	if name == aclAccessXattr {
+		return "AclAccess"
+	}
+	return "AclDefault"
+}
+
+// setACL sets (or with a nil value removes) one of the ACLs of an inode
+func (f *FS) setACL(inode uint64, hdr *fuse.Header, name string, value []byte, flags uint32, killSGID bool) error {
+	var entries []aclEntry
+	if value != nil {
+		var err error
+		entries, err = parseACL(value)
+		if err != nil {
+			return err
+		}
+	}
+	k, err := aerospike.NewKey(f.cfg.Aerospike.Namespace, f.cfg.setName("fs"), int(inode))
+	if err != nil {
+		log.Error("Set ACL %d: %s", inode, err)
+		return syscall.EFAULT
+	}
+	mrt := GetPolicies(f.asd, &f.cfg.Aerospike.Timeouts)
+	r, err := f.asd.Get(mrt.Read(), k, "Mode", "Uid", "Gid", aclBin(name))
+	if err != nil {
+		mrt.Abort()
+		return xattrErrno("Set ACL", inode, err)
+	}
+	mode := uint32(r.Bins["Mode"].(int))
+	switch {
+	case iofs.FileMode(mode)&iofs.ModeSymlink != 0:
+		mrt.Abort()
+		return syscall.ENOTSUP
+	case name == aclDefaultXattr && !iofs.FileMode(mode).IsDir():
+		mrt.Abort()
+		return syscall.EACCES
+	case hdr.Uid != 0 && hdr.Uid != uint32(r.Bins["Uid"].(int)):
+		mrt.Abort()
+		return syscall.EPERM
+	}
+	exists := r.Bins[aclBin(name)] != nil
+	if flags&xattrCreate != 0 && exists {
+		mrt.Abort()
+		return syscall.EEXIST
+	}
+	if (flags&xattrReplace != 0 || value == nil) && !exists {
+		mrt.Abort()
+		return fuse.ErrNoXattr
+	}
+	bins := []*aerospike.Bin{aerospike.NewBin("Ctime", TimeToDB(time.Now()))}
+	switch {
+	case name == aclAccessXattr && value != nil:
+		// the ACL sets the permission bits, and is only kept if they cannot express it
+		newMode := mode&^0o777 | aclMode(entries)
+		if killSGID && hdr.Uid != 0 && !slices.Contains(callerGroups(hdr), uint32(r.Bins["Gid"].(int))) {
+			newMode &^= uint32(iofs.ModeSetgid)
+		}
+		bins = append(bins, aerospike.NewBin("Mode", int(newMode)))
+		if len(entries) == 3 {
+			bins = append(bins, aerospike.NewBin("AclAccess", nil))
+		} else {
+			bins = append(bins, aerospike.NewBin("AclAccess", encodeACL(entries)))
+		}
+	case name == aclDefaultXattr && len(entries) > 0:
+		bins = append(bins, aerospike.NewBin("AclDefault", encodeACL(entries)))
+	default:
+		bins = append(bins, aerospike.NewBin(aclBin(name), nil))
+	}
+	log.Detail("ASD: setACL: PutBins(%v) %v", mrt.Id(), k)
+	err = f.asd.PutBins(mrt.Write(), k, bins...)
+	if err != nil {
+		mrt.Abort()
+		return xattrErrno("Set ACL", inode, err)
+	}
+	xerr := mrt.Commit()
+	if xerr != nil {
+		log.Error("Set ACL %d: %s", inode, xerr)
+		return syscall.EFAULT
+	}
+	return nil
+}
+
+// getACL returns one of the ACLs of an inode
+func (f *FS) getACL(inode uint64, name string) ([]byte, error) {
+	k, err := aerospike.NewKey(f.cfg.Aerospike.Namespace, f.cfg.setName("fs"), int(inode))
+	if err != nil {
+		log.Error("Get ACL %d: %s", inode, err)
+		return nil, syscall.EFAULT
+	}
+	r, err := f.asd.Get(GetReadPolicyNoMRT(f.asd, &f.cfg.Aerospike.Timeouts), k, aclBin(name))
+	if err != nil {
+		return nil, xattrErrno("Get ACL", inode, err)
+	}
+	v, ok := r.Bins[aclBin(name)].([]byte)
+	if !ok {
+		return nil, fuse.ErrNoXattr
+	}
+	return v, nil
+}
+
+// inheritedACL sets the bins of an inode created in directory parentKey with the given mode (a Mode bin value),
+// applying the default ACL of the directory, or without one the umask of the caller
+func (f *FS) inheritedACL(mrt *MRT, parentKey *aerospike.Key, bins aerospike.BinMap, dir bool, umask iofs.FileMode) aerospike.Error {
+	log.Detail("ASD: inheritedACL: GetOp(%v) %v", mrt.Id(), parentKey)
+	r, err := f.asd.Operate(mrt.Write(), parentKey, GetOp("AclDefault"))
+	if err != nil {
+		return err
+	}
+	def, ok := r.Bins["AclDefault"].([]byte)
+	if !ok {
+		bins["Mode"] = bins["Mode"].(int) &^ int(umask&iofs.ModePerm)
+		return nil
+	}
+	access, mode, xerr := inheritACL(def, uint32(bins["Mode"].(int)))
+	if xerr != nil {
+		log.Warn("Ignoring invalid default ACL of %v: %s", parentKey, xerr)
+		bins["Mode"] = bins["Mode"].(int) &^ int(umask&iofs.ModePerm)
+		return nil
+	}
+	bins["Mode"] = int(mode)
+	if access != nil {
+		bins["AclAccess"] = access
+	}
+	if dir {
+		bins["AclDefault"] = def
+	}
+	return nil
+}
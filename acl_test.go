@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// testCreateMode creates an entry of the given kind ("file", "dir" or "fifo") in d, as the kernel passes it with
+// DontMask: mode not masked yet, umask of the caller separate, and returns its mode
+func testCreateMode(t *testing.T, d *Dir, kind string, mode os.FileMode, umask os.FileMode) os.FileMode {
+	t.Helper()
+	ctx := context.Background()
+	var n fs.Node
+	var err error
+	switch kind {
+	case "file":
+		n, _, err = d.Create(ctx, &fuse.CreateRequest{Name: kind, Mode: mode, Umask: umask, Flags: fuse.OpenReadWrite}, &fuse.CreateResponse{})
+	case "dir":
+		n, err = d.Mkdir(ctx, &fuse.MkdirRequest{Name: kind, Mode: os.ModeDir | mode, Umask: umask})
+	case "fifo":
+		n, err = d.Mknod(ctx, &fuse.MknodRequest{Name: kind, Mode: os.ModeNamedPipe | mode, Umask: umask})
+	}
+	if err != nil {
+		t.Fatalf("create %s: %s", kind, err)
+	}
+	a := &fuse.Attr{}
+	if err := n.Attr(ctx, a); err != nil {
+		t.Fatalf("Attr %s: %s", kind, err)
+	}
+	return a.Mode & os.ModePerm
+}
+
+func TestInheritedUmask(t *testing.T) {
+	// user::rwx group::r-x other::r-x
+	def := encodeACL([]aclEntry{
+		{tag: aclUserObj, perm: 7, id: aclUndefinedId},
+		{tag: aclGroupObj, perm: 5, id: aclUndefinedId},
+		{tag: aclOther, perm: 5, id: aclUndefinedId},
+	})
+	tests := []struct {
+		name  string
+		kind  string
+		acl   []byte // default ACL of the directory
+		mode  os.FileMode
+		umask os.FileMode
+		want  os.FileMode
+	}{
+		// the kernel leaves the umask to asdfs
+		{"file", "file", nil, 0o666, 0o022, 0o644},
+		{"directory", "dir", nil, 0o777, 0o027, 0o750},
+		{"fifo", "fifo", nil, 0o666, 0o077, 0o600},
+		{"no umask", "file", nil, 0o666, 0, 0o666},
+		// the default ACL replaces the umask
+		{"file with default ACL", "file", def, 0o666, 0o077, 0o644},
+		{"directory with default ACL", "dir", def, 0o777, 0o077, 0o755},
+		{"fifo with default ACL", "fifo", def, 0o666, 0o077, 0o644},
+		{"mode within default ACL", "file", def, 0o600, 0o022, 0o600},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, root := newTestFS(t, 8)
+			d := testMkdir(t, root, "d")
+			if tt.acl != nil {
+				err := d.Setxattr(context.Background(), &fuse.SetxattrRequest{Name: aclDefaultXattr, Xattr: tt.acl})
+				if err != nil {
+					t.Fatalf("set default ACL: %s", err)
+				}
+			}
+			if got := testCreateMode(t, d, tt.kind, tt.mode, tt.umask); got != tt.want {
+				t.Fatalf("mode %o, want %o", got, tt.want)
+			}
+		})
+	}
+}
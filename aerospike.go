@@ -0,0 +1,170 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/aerospike/aerospike-client-go/v8"
+	"github.com/aerospike/aerospike-client-go/v8/types"
+)
+
+// asdBackend stores the filesystem in an Aerospike cluster; ops are translated to client operations and expressions
+type asdBackend struct {
+	*aerospike.Client
+}
+
+func (b *asdBackend) Operate(policy *aerospike.WritePolicy, key *aerospike.Key, ops ...*Op) (*aerospike.Record, aerospike.Error) {
+	aops := make([]*aerospike.Operation, 0, len(ops))
+	for _, op := range ops {
+		if op.Kind == opUnless {
+			wp := *policy
+			wp.FilterExpression = noneExistExp(op.Unless)
+			policy = &wp
+			continue
+		}
+		aops = append(aops, asdOp(op))
+	}
+	return b.Client.Operate(policy, key, aops...)
+}
+
+func (b *asdBackend) BatchOperate(policy *aerospike.BatchPolicy, keys []*aerospike.Key, ops [][]*Op) ([]*aerospike.Record, aerospike.Error) {
+	records := make([]aerospike.BatchRecordIfc, len(keys))
+	for i, k := range keys {
+		aops := make([]*aerospike.Operation, len(ops[i]))
+		for j, op := range ops[i] {
+			aops[j] = asdOp(op)
+		}
+		records[i] = aerospike.NewBatchReadOps(nil, k, aops...)
+	}
+	err := b.Client.BatchOperate(policy, records)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*aerospike.Record, len(keys))
+	for i, rec := range records {
+		r := rec.BatchRec()
+		switch r.ResultCode {
+		case types.OK:
+			ret[i] = r.Record
+		case types.KEY_NOT_FOUND_ERROR:
+		default:
+			return nil, r.Err
+		}
+	}
+	return ret, nil
+}
+
+func (b *asdBackend) Commit(txn *aerospike.Txn) aerospike.Error {
+	_, err := b.Client.Commit(txn)
+	return err
+}
+
+func (b *asdBackend) Abort(txn *aerospike.Txn) aerospike.Error {
+	_, err := b.Client.Abort(txn)
+	return err
+}
+
+// Space sums the namespace statistics of the nodes: server 7 reports the storage of any engine as data_*, older
+// servers device_* (or memory_* for data in memory), with their stop-writes limits in the namespace config
+func (b *asdBackend) Space(namespace string) (uint64, uint64, aerospike.Error) {
+	var total, free float64
+	replication := 1.0
+	for _, node := range b.Client.GetNodes() {
+		info, err := node.RequestInfo(aerospike.NewInfoPolicy(), "namespace/"+namespace)
+		if err != nil {
+			return 0, 0, err
+		}
+		stats := make(map[string]float64)
+		for _, stat := range strings.Split(info["namespace/"+namespace], ";") {
+			name, value, _ := strings.Cut(stat, "=")
+			if v, err := strconv.ParseFloat(value, 64); err == nil {
+				stats[name] = v
+			}
+		}
+		var size, used, availPct, maxUsedPct, minAvailPct float64
+		switch {
+		case stats["data_total_bytes"] > 0:
+			size, used, availPct = stats["data_total_bytes"], stats["data_used_bytes"], stats["data_avail_pct"]
+			maxUsedPct, minAvailPct = stats["stop-writes-used-pct"], stats["stop-writes-avail-pct"]
+		case stats["device_total_bytes"] > 0:
+			size, used, availPct = stats["device_total_bytes"], stats["device_used_bytes"], stats["device_available_pct"]
+			maxUsedPct, minAvailPct = stats["storage-engine.max-used-pct"], stats["storage-engine.min-avail-pct"]
+		default:
+			size, used, availPct = stats["memory-size"], stats["memory_used_bytes"], 100
+			maxUsedPct = stats["stop-writes-pct"]
+		}
+		if maxUsedPct == 0 {
+			maxUsedPct = 100
+		}
+		limit := size * maxUsedPct / 100
+		nodeFree := max(0, min(limit-used, size*(availPct-minAvailPct)/100))
+		total += limit
+		free += nodeFree
+		replication = max(replication, stats["effective_replication_factor"])
+	}
+	return uint64(total / replication), uint64(free / replication), nil
+}
+
+// expression matching records where none of the bins exist
+func noneExistExp(bins []string) *aerospike.Expression {
+	exps := make([]*aerospike.Expression, len(bins))
+	for i, bin := range bins {
+		exps[i] = aerospike.ExpNot(aerospike.ExpBinExists(bin))
+	}
+	if len(exps) == 1 {
+		return exps[0]
+	}
+	return aerospike.ExpAnd(exps...)
+}
+
+var keyOrderedMap = aerospike.NewMapPolicy(aerospike.MapOrder.KEY_ORDERED, aerospike.MapWriteMode.UPDATE)
+
+func asdOp(op *Op) *aerospike.Operation {
+	bp := aerospike.DefaultBitPolicy()
+	switch op.Kind {
+	case opGet:
+		return aerospike.GetBinOp(op.Bin)
+	case opPut:
+		return aerospike.PutOp(aerospike.NewBin(op.Bin, op.Value))
+	case opAdd:
+		return aerospike.AddOp(aerospike.NewBin(op.Bin, op.Value))
+	case opMapGet:
+		return aerospike.MapGetByKeyOp(op.Bin, op.Key, aerospike.MapReturnType.VALUE)
+	case opMapPut:
+		mp := keyOrderedMap
+		if op.CreateOnly {
+			mp = aerospike.NewMapPolicy(aerospike.MapOrder.KEY_ORDERED, aerospike.MapWriteMode.CREATE_ONLY)
+		}
+		return aerospike.MapPutOp(mp, op.Bin, op.Key, op.Value)
+	case opMapPutItems:
+		return aerospike.MapPutItemsOp(keyOrderedMap, op.Bin, op.Value.(map[interface{}]interface{}))
+	case opMapRemove:
+		return aerospike.MapRemoveByKeyOp(op.Bin, op.Key, aerospike.MapReturnType.NONE)
+	case opMapPage:
+		if op.After == nil {
+			return aerospike.MapGetByIndexRangeCountOp(op.Bin, 0, op.Count, aerospike.MapReturnType.KEY_VALUE)
+		}
+		return aerospike.MapGetByKeyRelativeIndexRangeCountOp(op.Bin, op.After, 1, op.Count, aerospike.MapReturnType.KEY_VALUE)
+	case opMapSize:
+		return aerospike.ExpReadOp(op.Name, aerospike.ExpCond(aerospike.ExpBinExists(op.Bin), aerospike.ExpMapSize(aerospike.ExpMapBin(op.Bin)), aerospike.ExpIntVal(0)), aerospike.ExpReadFlagDefault)
+	case opMapKeyOrder:
+		return aerospike.MapSetPolicyOp(keyOrderedMap, op.Bin)
+	case opBinExists:
+		return aerospike.ExpReadOp(op.Name, aerospike.ExpBinExists(op.Bin), aerospike.ExpReadFlagDefault)
+	case opBlobResize:
+		return aerospike.BitResizeOp(bp, op.Bin, op.Size, op.Resize)
+	case opBlobWrite:
+		data := op.Value.([]byte)
+		return aerospike.BitSetOp(bp, op.Bin, op.Offset*8, len(data)*8, data)
+	case opBlobRead:
+		// the result keeps the bin name, so that it reads like the bin itself
+		rangeExp := aerospike.ExpBitGet(aerospike.ExpIntVal(int64(op.Offset*8)), aerospike.ExpIntVal(int64(op.Size*8)), aerospike.ExpBlobBin(op.Bin))
+		if len(op.Unless) > 0 {
+			rangeExp = aerospike.ExpCond(noneExistExp(op.Unless), rangeExp, aerospike.ExpBlobBin(op.Bin))
+		}
+		return aerospike.ExpReadOp(op.Bin, rangeExp, aerospike.ExpReadFlagDefault)
+	case opTouch:
+		return aerospike.TouchOp()
+	}
+	panic("unknown op kind")
+}
@@ -5,21 +5,29 @@ import "github.com/aerospike/aerospike-client-go/v8"
 var MRTEnabled = true
 
 type MRT struct {
-	txn    *aerospike.Txn
-	read   *aerospike.BasePolicy
-	write  *aerospike.WritePolicy
-	client *aerospike.Client
+	txn     *aerospike.Txn
+	read    *aerospike.BasePolicy
+	write   *aerospike.WritePolicy
+	client  Backend
+	expires interface{} // expiry of the inode whose content records are written, see SetExpires
 }
 
-func GetReadPolicyNoMRT(client *aerospike.Client, t *cfgTimeout) *aerospike.BasePolicy {
+func GetReadPolicyNoMRT(client Backend, t *cfgTimeout) *aerospike.BasePolicy {
 	read := aerospike.NewPolicy()
 	read.TotalTimeout = t.Total
 	read.SocketTimeout = t.Socket
 	return read
 }
 
-func GetWritePolicyNoMRT(client *aerospike.Client, t *cfgTimeout) *aerospike.WritePolicy {
-	write := aerospike.NewWritePolicy(0, 0)
+func GetBatchPolicyNoMRT(client Backend, t *cfgTimeout) *aerospike.BatchPolicy {
+	batch := aerospike.NewBatchPolicy()
+	batch.TotalTimeout = t.Total
+	batch.SocketTimeout = t.Socket
+	return batch
+}
+
+func GetWritePolicyNoMRT(client Backend, t *cfgTimeout) *aerospike.WritePolicy {
+	write := aerospike.NewWritePolicy(0, aerospike.TTLDontUpdate)
 	write.DurableDelete = true
 	write.SendKey = true
 	write.TotalTimeout = t.Total
@@ -27,7 +35,7 @@ func GetWritePolicyNoMRT(client *aerospike.Client, t *cfgTimeout) *aerospike.Wri
 	return write
 }
 
-func GetReadPolicy(client *aerospike.Client, t *cfgTimeout) *MRT {
+func GetReadPolicy(client Backend, t *cfgTimeout) *MRT {
 	txn := aerospike.NewTxn()
 	txn.SetTimeout(t.MRT)
 	if !MRTEnabled {
@@ -44,7 +52,7 @@ func GetReadPolicy(client *aerospike.Client, t *cfgTimeout) *MRT {
 	return m
 }
 
-func GetPolicies(client *aerospike.Client, t *cfgTimeout) *MRT {
+func GetPolicies(client Backend, t *cfgTimeout) *MRT {
 	txn := aerospike.NewTxn()
 	txn.SetTimeout(t.MRT)
 	if !MRTEnabled {
@@ -53,7 +61,7 @@ func GetPolicies(client *aerospike.Client, t *cfgTimeout) *MRT {
 	m := &MRT{
 		txn:    txn,
 		read:   aerospike.NewPolicy(),
-		write:  aerospike.NewWritePolicy(0, 0),
+		write:  aerospike.NewWritePolicy(0, aerospike.TTLDontUpdate),
 		client: client,
 	}
 	m.read.Txn = txn
@@ -67,7 +75,7 @@ func GetPolicies(client *aerospike.Client, t *cfgTimeout) *MRT {
 	return m
 }
 
-func GetWritePolicy(client *aerospike.Client, t *cfgTimeout) *MRT {
+func GetWritePolicy(client Backend, t *cfgTimeout) *MRT {
 	txn := aerospike.NewTxn()
 	txn.SetTimeout(t.MRT)
 	if !MRTEnabled {
@@ -75,7 +83,7 @@ func GetWritePolicy(client *aerospike.Client, t *cfgTimeout) *MRT {
 	}
 	m := &MRT{
 		txn:    txn,
-		write:  aerospike.NewWritePolicy(0, 0),
+		write:  aerospike.NewWritePolicy(0, aerospike.TTLDontUpdate),
 		client: client,
 	}
 	m.write.Txn = txn
@@ -90,16 +98,22 @@ func (m *MRT) Commit() error {
 	if !MRTEnabled {
 		return nil
 	}
-	_, err := m.client.Commit(m.txn)
-	return err
+	err := m.client.Commit(m.txn)
+	if err != nil {
+		return err
+	}
+	return nil
 }
 
 func (m *MRT) Abort() error {
 	if !MRTEnabled {
 		return nil
 	}
-	_, err := m.client.Abort(m.txn)
-	return err
+	err := m.client.Abort(m.txn)
+	if err != nil {
+		return err
+	}
+	return nil
 }
 
 func (m *MRT) Read() *aerospike.BasePolicy {
@@ -110,6 +124,17 @@ func (m *MRT) Write() *aerospike.WritePolicy {
 	return m.write
 }
 
+// SetExpires sets the expiry (the "Expires" bin value) of the inode whose content records this transaction writes
+func (m *MRT) SetExpires(expires interface{}) {
+	m.expires = expires
+}
+
+// WriteExpiring returns the write policy for content records of the inode, which may be created by the write and
+// have to expire together with the inode
+func (m *MRT) WriteExpiring() *aerospike.WritePolicy {
+	return expiringPolicy(m.write, m.expires)
+}
+
 func (m *MRT) Id() int64 {
 	if m.txn == nil {
 		return -1
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"time"
+
+	"github.com/aerospike/aerospike-client-go/v8"
+)
+
+// access times are updated by reads (of files, directory listings and symlinks), as selected with mountParams.atime:
+// noatime - never
+// relatime - if the access time is not after the modification and change times, or older than relatimeInterval
+// strictatime - on every read
+// with mountParams.lazytime the updates are kept in memory, seen by this mount right away, and written every
+// lazytimeFlush, on fsync and on unmount; updates still pending when the mount process dies are lost
+const (
+	atimeNo     = "noatime"
+	atimeRel    = "relatime"
+	atimeStrict = "strictatime"
+)
+
+const (
+	relatimeInterval = 24 * time.Hour
+	lazytimeFlush    = time.Minute
+)
+
+// touchAtime updates the access time of an inode read, given its Atime, Mtime and Ctime bins (nil to fetch them)
+// failures are only logged, they do not fail the read
+func (f *FS) touchAtime(inode uint64, times aerospike.BinMap) {
+	if f.cfg.MountParams.Atime == atimeNo || f.cfg.MountParams.RO {
+		return
+	}
+	now := time.Now()
+	if f.cfg.MountParams.Atime == atimeRel {
+		if times == nil {
+			k, err := aerospike.NewKey(f.cfg.Aerospike.Namespace, f.cfg.setName("fs"), int(inode))
+			if err != nil {
+				log.Warn("Atime %d: %s", inode, err)
+				return
+			}
+			r, err := f.asd.Get(GetReadPolicyNoMRT(f.asd, &f.cfg.Aerospike.Timeouts), k, "Atime", "Mtime", "Ctime")
+			if err != nil {
+				if !err.Matches(aerospike.ErrKeyNotFound.ResultCode) {
+					log.Warn("Atime %d: %s", inode, err)
+				}
+				return
+			}
+			times = r.Bins
+		}
+		atime := DBToTime(times["Atime"])
+		if pending := f.pendingAtime(inode); !pending.IsZero() {
+			atime = pending
+		}
+		if atime.After(DBToTime(times["Mtime"])) && atime.After(DBToTime(times["Ctime"])) && now.Sub(atime) < relatimeInterval {
+			return
+		}
+	}
+	if f.cfg.MountParams.Lazytime {
+		f.atimes.Store(inode, TimeToDB(now))
+		return
+	}
+	f.writeAtime(inode, TimeToDB(now))
+}
+
+// writeAtime stores the access time of an inode, outside of any transaction, unless the inode is gone
+func (f *FS) writeAtime(inode uint64, atime interface{}) {
+	k, err := aerospike.NewKey(f.cfg.Aerospike.Namespace, f.cfg.setName("fs"), int(inode))
+	if err != nil {
+		log.Warn("Atime %d: %s", inode, err)
+		return
+	}
+	wp := GetWritePolicyNoMRT(f.asd, &f.cfg.Aerospike.Timeouts)
+	wp.RecordExistsAction = aerospike.UPDATE_ONLY
+	log.Detail("ASD: writeAtime: PutOp %v", k)
+	_, err = f.asd.Operate(wp, k, PutOp("Atime", atime))
+	if err != nil && !err.Matches(aerospike.ErrKeyNotFound.ResultCode) {
+		log.Warn("Atime %d: %s", inode, err)
+	}
+}
+
+// pendingAtime returns the access time of an inode not written yet (lazytime), zero for none
+func (f *FS) pendingAtime(inode uint64) time.Time {
+	if v, ok := f.atimes.Load(inode); ok {
+		return time.Unix(0, v.(int64))
+	}
+	return time.Time{}
+}
+
+// flushAtime writes the pending access time of an inode, if any
+func (f *FS) flushAtime(inode uint64) {
+	if v, ok := f.atimes.LoadAndDelete(inode); ok {
+		f.writeAtime(inode, v)
+	}
+}
+
+// flushAtimes writes all pending access times
+func (f *FS) flushAtimes() {
+	f.atimes.Range(func(k, v interface{}) bool {
+		// a newer access time stored meanwhile stays pending
+		if f.atimes.CompareAndDelete(k, v) {
+			f.writeAtime(k.(uint64), v)
+		}
+		return true
+	})
+}
+
+// startAtimeFlush writes the pending access times every lazytimeFlush
+func (f *FS) startAtimeFlush() {
+	go func() {
+		for {
+			time.Sleep(lazytimeFlush)
+			f.flushAtimes()
+		}
+	}()
+}
@@ -0,0 +1,133 @@
+package main
+
+import "github.com/aerospike/aerospike-client-go/v8"
+
+// Backend is the record store the filesystem lives in
+// records are addressed by aerospike keys and hold named bins; single record calls are atomic, and calls made with a
+// policy carrying a transaction are committed or aborted together, like Aerospike multi-record transactions
+// errors are returned as aerospike errors with Aerospike result codes (e.g. KEY_NOT_FOUND_ERROR, KEY_EXISTS_ERROR,
+// FILTERED_OUT, MRT_BLOCKED), whatever the backend
+// writes set the record expiration given by the Expiration of the write policy, with the Aerospike meaning of
+// TTLServerDefault, TTLDontExpire and TTLDontUpdate; expired records read as missing
+type Backend interface {
+	Get(policy *aerospike.BasePolicy, key *aerospike.Key, binNames ...string) (*aerospike.Record, aerospike.Error)
+	Exists(policy *aerospike.BasePolicy, key *aerospike.Key) (bool, aerospike.Error)
+	Put(policy *aerospike.WritePolicy, key *aerospike.Key, bins aerospike.BinMap) aerospike.Error
+	PutBins(policy *aerospike.WritePolicy, key *aerospike.Key, bins ...*aerospike.Bin) aerospike.Error
+	Delete(policy *aerospike.WritePolicy, key *aerospike.Key) (existed bool, err aerospike.Error)
+	// Operate applies ops to a single record atomically, returning the results of the read ops as bins
+	Operate(policy *aerospike.WritePolicy, key *aerospike.Key, ops ...*Op) (*aerospike.Record, aerospike.Error)
+	// BatchGet and BatchOperate return a record per key, nil for missing records
+	BatchGet(policy *aerospike.BatchPolicy, keys []*aerospike.Key, binNames ...string) ([]*aerospike.Record, aerospike.Error)
+	BatchOperate(policy *aerospike.BatchPolicy, keys []*aerospike.Key, ops [][]*Op) ([]*aerospike.Record, aerospike.Error)
+	Commit(txn *aerospike.Txn) aerospike.Error
+	Abort(txn *aerospike.Txn) aerospike.Error
+	// Space returns the bytes the namespace can store (up to its stop-writes limits) and of those the bytes still free,
+	// counting each record once, whatever the replication factor
+	Space(namespace string) (total uint64, free uint64, err aerospike.Error)
+	Close()
+}
+
+// kinds of Op
+const (
+	opGet         = iota // read bin
+	opPut                // write bin, nil deletes it
+	opAdd                // add to integer bin
+	opMapGet             // read value of map key, nil if missing
+	opMapPut             // put map key, returning the map size; maps are created key-ordered
+	opMapPutItems        // put map items, returning the map size
+	opMapRemove          // remove map key
+	opMapPage            // read up to Count key-ordered entries after map key After (from the start if nil) as []MapPair
+	opMapSize            // read the size of a map bin as result Name, 0 if the bin does not exist
+	opMapKeyOrder        // convert a map bin to key-ordered
+	opBinExists          // read whether a bin exists as result Name
+	opBlobResize         // resize blob bin, zero-filling; creates the bin if missing
+	opBlobWrite          // overwrite bytes of blob bin
+	opBlobRead           // read Size bytes at Offset of blob bin, or the whole bin if any of the Unless bins exists
+	opUnless             // filter out (FILTERED_OUT) the whole Operate if any of the Unless bins exists
+	opTouch              // rewrite the record unchanged, applying the expiration of the policy
+)
+
+// Op is a record operation of Backend.Operate, built by the constructors below
+type Op struct {
+	Kind   int
+	Bin    string
+	Name   string // result bin of computed reads
+	Key    interface{}
+	Value  interface{}
+	Offset int
+	Size   int
+	// opMapPut: only create the key, failing with FAIL_ELEMENT_EXISTS if it exists
+	CreateOnly bool
+	// opMapPage
+	After interface{}
+	Count int
+	// opBlobResize
+	Resize aerospike.BitResizeFlags
+	// opBlobRead, opUnless
+	Unless []string
+}
+
+func GetOp(bin string) *Op {
+	return &Op{Kind: opGet, Bin: bin}
+}
+
+func PutOp(bin string, value interface{}) *Op {
+	return &Op{Kind: opPut, Bin: bin, Value: value}
+}
+
+func AddOp(bin string, value int) *Op {
+	return &Op{Kind: opAdd, Bin: bin, Value: value}
+}
+
+func MapGetOp(bin string, key interface{}) *Op {
+	return &Op{Kind: opMapGet, Bin: bin, Key: key}
+}
+
+func MapPutOp(bin string, key interface{}, value interface{}, createOnly bool) *Op {
+	return &Op{Kind: opMapPut, Bin: bin, Key: key, Value: value, CreateOnly: createOnly}
+}
+
+func MapPutItemsOp(bin string, items map[interface{}]interface{}) *Op {
+	return &Op{Kind: opMapPutItems, Bin: bin, Value: items}
+}
+
+func MapRemoveOp(bin string, key interface{}) *Op {
+	return &Op{Kind: opMapRemove, Bin: bin, Key: key}
+}
+
+func MapPageOp(bin string, after interface{}, count int) *Op {
+	return &Op{Kind: opMapPage, Bin: bin, After: after, Count: count}
+}
+
+func MapSizeOp(name string, bin string) *Op {
+	return &Op{Kind: opMapSize, Bin: bin, Name: name}
+}
+
+func MapKeyOrderOp(bin string) *Op {
+	return &Op{Kind: opMapKeyOrder, Bin: bin}
+}
+
+func BinExistsOp(name string, bin string) *Op {
+	return &Op{Kind: opBinExists, Bin: bin, Name: name}
+}
+
+func BlobResizeOp(bin string, size int, flags aerospike.BitResizeFlags) *Op {
+	return &Op{Kind: opBlobResize, Bin: bin, Size: size, Resize: flags}
+}
+
+func BlobWriteOp(bin string, offset int, data []byte) *Op {
+	return &Op{Kind: opBlobWrite, Bin: bin, Offset: offset, Value: data}
+}
+
+func BlobReadOp(bin string, offset int, size int, unless ...string) *Op {
+	return &Op{Kind: opBlobRead, Bin: bin, Offset: offset, Size: size, Unless: unless}
+}
+
+func UnlessOp(bins ...string) *Op {
+	return &Op{Kind: opUnless, Unless: bins}
+}
+
+func TouchOp() *Op {
+	return &Op{Kind: opTouch}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/aerospike/aerospike-client-go/v8"
+	"github.com/aerospike/aerospike-client-go/v8/types"
+)
+
+// file content is stored in fixed-size block records in the "data" set, keyed "inode_blockNo"
+// the inode record holds the content Size, the BlockSize the file was created with and the number of allocated Blocks
+// a block record stores min(BlockSize, Size-blockStart) bytes in its "data" bin, so ranged reads never go past its end
+// files are sparse: a missing block record is a hole, which reads as zeros and costs no storage
+// blocks may be encoded (compressed and/or encrypted), as recorded in their "Comp" and "Key" bins; only raw blocks can be
+// partially read or updated server-side
+
+// no more than 7MiB per block, leaving 1MiB for other bins, metadata, overheads, expansion, etc
+const maxBlockSize = 7 * 1024 * 1024
+
+func (f *FS) blockKey(inode uint64, blockNo int) (*aerospike.Key, error) {
+	return aerospike.NewKey(f.cfg.Aerospike.Namespace, f.cfg.setName("data"), fmt.Sprintf("%d_%d", inode, blockNo))
+}
+
+// number of blocks required to store size bytes
+func blockCount(size int, blockSize int) int {
+	return (size + blockSize - 1) / blockSize
+}
+
+// number of bytes stored in block blockNo of a file of the given size
+func blockLen(size int, blockSize int, blockNo int) int {
+	return min(blockSize, size-blockNo*blockSize)
+}
+
+// read op returning whether the block existed before the write ops following it in the same Operate
+func blockExistedOp() *Op {
+	return BinExistsOp("Existed", "data")
+}
+
+func blockExisted(r *aerospike.Record) bool {
+	existed, _ := r.Bins["Existed"].(bool)
+	return existed
+}
+
+// bins present on encoded blocks only
+var encodedBlockBins = []string{"Comp", "Key"}
+
+// whether newly written blocks get encoded, in which case all block updates are done client-side
+func (f *FS) encodeBlocks() bool {
+	comp, _ := compressionFromName(f.cfg.FS.Compression)
+	return comp != compNone || f.keys != nil
+}
+
+// decodeBlock returns the raw contents of block record r stored under key k
+func (f *FS) decodeBlock(k *aerospike.Key, r *aerospike.Record) ([]byte, error) {
+	data, _ := r.Bins["data"].([]byte)
+	if keyId, ok := r.Bins["Key"].(string); ok {
+		if f.keys == nil {
+			return nil, fmt.Errorf("block %v is encrypted, but no key file is configured", k.Value())
+		}
+		var err error
+		data, err = f.keys.open(data, keyId, blockAAD(k))
+		if err != nil {
+			return nil, err
+		}
+	}
+	comp, _ := r.Bins["Comp"].(int)
+	return decompressBlock(data, comp)
+}
+
+// loadBlock reads and decodes a whole block within the transaction; existed is false for a hole
+func (f *FS) loadBlock(mrt *MRT, k *aerospike.Key) (data []byte, existed bool, err error) {
+	log.Detail("ASD: loadBlock: Get(%v) %v", mrt.Id(), k)
+	r, xerr := f.asd.Get(mrt.Read(), k, "data", "Comp", "Key")
+	if xerr != nil {
+		if xerr.Matches(aerospike.ErrKeyNotFound.ResultCode) {
+			return nil, false, nil
+		}
+		return nil, false, xerr
+	}
+	data, err = f.decodeBlock(k, r)
+	return data, true, err
+}
+
+// storeBlock encodes and writes a whole block within the transaction, returning whether the block existed before
+func (f *FS) storeBlock(mrt *MRT, k *aerospike.Key, data []byte) (existed bool, err error) {
+	encoded, comp := f.compressBlock(data)
+	var compBin, keyBin interface{}
+	if comp != compNone {
+		compBin = comp
+	}
+	if f.keys != nil {
+		var keyId string
+		encoded, keyId, err = f.keys.seal(encoded, blockAAD(k))
+		if err != nil {
+			return false, err
+		}
+		keyBin = keyId
+	}
+	log.Detail("ASD: storeBlock: PutOp(%v) %v size=%d stored=%d", mrt.Id(), k, len(data), len(encoded))
+	r, xerr := f.asd.Operate(mrt.WriteExpiring(), k, blockExistedOp(), PutOp("data", encoded), PutOp("Comp", compBin), PutOp("Key", keyBin))
+	if xerr != nil {
+		return false, xerr
+	}
+	return blockExisted(r), nil
+}
+
+// updateBlock partially updates a block, returning whether the block existed before
+// raw blocks are updated server-side with ops, encoded blocks (or all blocks, when encoding is enabled) by
+// reading, modifying and re-encoding the whole block; with mustExist, holes are left untouched
+func (f *FS) updateBlock(mrt *MRT, k *aerospike.Key, ops []*Op, modify func([]byte) []byte, mustExist bool) (existed bool, err error) {
+	if !f.encodeBlocks() {
+		wp := *mrt.WriteExpiring()
+		if mustExist {
+			wp.RecordExistsAction = aerospike.UPDATE_ONLY
+		}
+		log.Detail("ASD: updateBlock: Operate(%v) %v", mrt.Id(), k)
+		r, xerr := f.asd.Operate(&wp, k, append([]*Op{UnlessOp(encodedBlockBins...), blockExistedOp()}, ops...)...)
+		if xerr == nil {
+			return blockExisted(r), nil
+		}
+		if mustExist && xerr.Matches(aerospike.ErrKeyNotFound.ResultCode) {
+			return false, nil
+		}
+		if !xerr.Matches(types.FILTERED_OUT) {
+			return false, xerr
+		}
+		// the block is encoded, fall back to read-modify-write
+	}
+	data, existed, err := f.loadBlock(mrt, k)
+	if err != nil || (!existed && mustExist) {
+		return existed, err
+	}
+	_, err = f.storeBlock(mrt, k, modify(data))
+	return existed, err
+}
+
+// resized returns data trimmed or zero-extended to n bytes
+func resized(data []byte, n int) []byte {
+	if len(data) >= n {
+		return data[:n]
+	}
+	extended := make([]byte, n)
+	copy(extended, data)
+	return extended
+}
+
+// readAt returns n bytes of the file content starting at offset off; the range must lie within the file size
+// only the requested bytes are fetched from each raw block, using server-side bit operations
+func (f *FS) readAt(policy *aerospike.BatchPolicy, inode uint64, blockSize int, off int, n int) ([]byte, error) {
+	ret := make([]byte, n)
+	if n == 0 {
+		return ret, nil
+	}
+	keys := []*aerospike.Key{}
+	ops := [][]*Op{}
+	// for each block read: where it lands in ret, where it starts within the block and its size
+	type span struct{ pos, inBlock, size int }
+	spans := []span{}
+	for pos := off; pos < off+n; {
+		inBlock := pos % blockSize
+		size := min(blockSize-inBlock, off+n-pos)
+		k, err := f.blockKey(inode, pos/blockSize)
+		if err != nil {
+			return nil, err
+		}
+		// raw blocks return just the requested bytes, encoded blocks have to be returned whole
+		keys = append(keys, k)
+		ops = append(ops, []*Op{BlobReadOp("data", inBlock, size, encodedBlockBins...), GetOp("Comp"), GetOp("Key")})
+		spans = append(spans, span{pos - off, inBlock, size})
+		pos += size
+	}
+	log.Detail("ASD: readAt: BatchOperate %d offset=%d size=%d blocks=%d", inode, off, n, len(keys))
+	records, err := f.asd.BatchOperate(policy, keys, ops)
+	if err != nil {
+		return nil, err
+	}
+	for i, r := range records {
+		if r == nil {
+			// missing blocks read as zeros
+			continue
+		}
+		data, _ := r.Bins["data"].([]byte)
+		if r.Bins["Comp"] != nil || r.Bins["Key"] != nil {
+			decoded, xerr := f.decodeBlock(keys[i], r)
+			if xerr != nil {
+				return nil, xerr
+			}
+			data = resized(decoded, spans[i].inBlock+spans[i].size)[spans[i].inBlock:]
+		}
+		copy(ret[spans[i].pos:], data)
+	}
+	return ret, nil
+}
+
+// writeAt stores data at offset off of the file content, size being the file size after the write
+// partial writes of raw blocks are done server-side with bit operations, so that the block is never read back to the client
+// returns the number of blocks allocated by filling holes
+func (f *FS) writeAt(mrt *MRT, inode uint64, blockSize int, size int, off int, data []byte) (allocated int, err error) {
+	for len(data) > 0 {
+		blockNo := off / blockSize
+		inBlock := off % blockSize
+		n := min(blockSize-inBlock, len(data))
+		bl := blockLen(size, blockSize, blockNo)
+		k, err := f.blockKey(inode, blockNo)
+		if err != nil {
+			return allocated, err
+		}
+		chunk := data[:n]
+		var existed bool
+		if inBlock == 0 && n == bl {
+			// a full block overwrite does not need the old contents
+			existed, err = f.storeBlock(mrt, k, chunk)
+		} else {
+			// grow the block (zero-filled) to its length for this file size if needed, then overwrite the bytes in place
+			existed, err = f.updateBlock(mrt, k, []*Op{
+				BlobResizeOp("data", bl, aerospike.BitResizeFlagsGrowOnly),
+				BlobWriteOp("data", inBlock, chunk),
+			}, func(block []byte) []byte {
+				block = resized(block, max(len(block), bl))
+				copy(block[inBlock:], chunk)
+				return block
+			}, false)
+		}
+		if err != nil {
+			return allocated, err
+		}
+		if !existed {
+			allocated++
+		}
+		data = data[n:]
+		off += n
+	}
+	return allocated, nil
+}
+
+// truncateBlocks resizes the stored content from oldSize to newSize
+// shrinking deletes blocks past the end, growing only extends the existing last block - the rest of the extension is a hole
+// returns the change in the number of allocated blocks
+func (f *FS) truncateBlocks(mrt *MRT, inode uint64, blockSize int, oldSize int, newSize int) (allocated int, err error) {
+	if newSize > oldSize {
+		if oldSize%blockSize == 0 {
+			return 0, nil
+		}
+		blockNo := oldSize / blockSize
+		bl := blockLen(newSize, blockSize, blockNo)
+		k, err := f.blockKey(inode, blockNo)
+		if err != nil {
+			return 0, err
+		}
+		log.Detail("Inode %d truncateBlocks: grow block %d to %d", inode, blockNo, bl)
+		_, err = f.updateBlock(mrt, k, []*Op{BlobResizeOp("data", bl, aerospike.BitResizeFlagsGrowOnly)}, func(block []byte) []byte {
+			return resized(block, max(len(block), bl))
+		}, true)
+		return 0, err
+	}
+	// delete blocks no longer in use
+	for blockNo := blockCount(newSize, blockSize); blockNo < blockCount(oldSize, blockSize); blockNo++ {
+		k, err := f.blockKey(inode, blockNo)
+		if err != nil {
+			return allocated, err
+		}
+		log.Detail("ASD: truncateBlocks: Delete(%v) %v", mrt.Id(), k)
+		existed, err := f.asd.Delete(mrt.Write(), k)
+		if err != nil {
+			return allocated, err
+		}
+		if existed {
+			allocated--
+		}
+	}
+	// trim the last block, if it exists
+	if newSize%blockSize == 0 {
+		return allocated, nil
+	}
+	k, err := f.blockKey(inode, newSize/blockSize)
+	if err != nil {
+		return allocated, err
+	}
+	bl := newSize % blockSize
+	log.Detail("Inode %d truncateBlocks: trim block %d to %d", inode, newSize/blockSize, bl)
+	_, err = f.updateBlock(mrt, k, []*Op{BlobResizeOp("data", bl, aerospike.BitResizeFlagsShrinkOnly)}, func(block []byte) []byte {
+		return resized(block, min(len(block), bl))
+	}, true)
+	return allocated, err
+}
+
+// modes of fillRange
+const (
+	fillAllocate = iota // allocate holes as zero-filled blocks, existing data is kept
+	fillZero            // zero the range, allocating holes
+	fillPunch           // zero the range, whole blocks become holes
+)
+
+// fillRange allocates, zeroes or punches a hole in bytes off..end of the file content, size being the file size after the operation
+// returns the change in the number of allocated blocks
+func (f *FS) fillRange(mrt *MRT, inode uint64, blockSize int, size int, off int, end int, mode int) (allocated int, err error) {
+	end = min(end, size)
+	for off < end {
+		blockNo := off / blockSize
+		inBlock := off % blockSize
+		bl := blockLen(size, blockSize, blockNo)
+		n := min(bl-inBlock, end-off)
+		k, err := f.blockKey(inode, blockNo)
+		if err != nil {
+			return allocated, err
+		}
+		full := inBlock == 0 && n == bl
+		switch {
+		case mode == fillPunch && full:
+			log.Detail("ASD: fillRange: Delete(%v) %v", mrt.Id(), k)
+			existed, err := f.asd.Delete(mrt.Write(), k)
+			if err != nil {
+				return allocated, err
+			}
+			if existed {
+				allocated--
+			}
+		case mode == fillZero && full && !f.encodeBlocks():
+			// recreate the block zero-filled server-side
+			log.Detail("ASD: fillRange: Operate(%v) %v zero", mrt.Id(), k)
+			r, err := f.asd.Operate(mrt.WriteExpiring(), k, blockExistedOp(), PutOp("data", []byte{}), PutOp("Comp", nil), PutOp("Key", nil), BlobResizeOp("data", bl, aerospike.BitResizeFlagsDefault))
+			if err != nil {
+				return allocated, err
+			}
+			if !blockExisted(r) {
+				allocated++
+			}
+		case mode == fillZero && full:
+			existed, err := f.storeBlock(mrt, k, make([]byte, bl))
+			if err != nil {
+				return allocated, err
+			}
+			if !existed {
+				allocated++
+			}
+		default:
+			// grow holes into zero-filled blocks, except when punching; zero the range unless allocating
+			ops := []*Op{}
+			if mode != fillPunch {
+				ops = append(ops, BlobResizeOp("data", bl, aerospike.BitResizeFlagsGrowOnly))
+			}
+			if mode != fillAllocate {
+				ops = append(ops, BlobWriteOp("data", inBlock, make([]byte, n)))
+			}
+			log.Detail("Inode %d fillRange: block %d offset=%d size=%d mode=%d", inode, blockNo, inBlock, n, mode)
+			existed, err := f.updateBlock(mrt, k, ops, func(block []byte) []byte {
+				block = resized(block, max(len(block), bl))
+				if mode != fillAllocate {
+					clear(block[inBlock : inBlock+n])
+				}
+				return block
+			}, mode == fillPunch)
+			if err != nil {
+				return allocated, err
+			}
+			if !existed && mode != fillPunch {
+				allocated++
+			}
+		}
+		off += n
+	}
+	return allocated, nil
+}
+
+// upgradeInline moves file content stored by older versions in the "data" bin of the inode record into block records
+func (f *FS) upgradeInline(mrt *MRT, inode uint64) error {
+	k, err := aerospike.NewKey(f.cfg.Aerospike.Namespace, f.cfg.setName("fs"), int(inode))
+	if err != nil {
+		return err
+	}
+	r, err := f.asd.Get(mrt.Read(), k, "data", "Expires")
+	if err != nil {
+		return err
+	}
+	data, ok := r.Bins["data"].([]byte)
+	if !ok {
+		return nil
+	}
+	mrt.SetExpires(r.Bins["Expires"])
+	log.Detail("Inode %d: moving inline data to block records", inode)
+	blockSize := f.cfg.FS.BlockSize
+	allocated, xerr := f.writeAt(mrt, inode, blockSize, len(data), 0, data)
+	if xerr != nil {
+		return xerr
+	}
+	return f.asd.PutBins(mrt.Write(), k, aerospike.NewBin("data", nil), aerospike.NewBin("BlockSize", blockSize), aerospike.NewBin("Blocks", allocated))
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+)
+
+// block compression algorithms, recorded per block record in the "Comp" bin; raw blocks have no "Comp" bin
+const (
+	compNone  = 0
+	compFlate = 1
+)
+
+func compressionFromName(name string) (int, error) {
+	switch name {
+	case "none", "":
+		return compNone, nil
+	case "flate":
+		return compFlate, nil
+	default:
+		return compNone, fmt.Errorf("compression %s not supported", name)
+	}
+}
+
+// compressBlock compresses data with the configured algorithm
+// data that does not get smaller is returned as-is with compNone
+func (f *FS) compressBlock(data []byte) ([]byte, int) {
+	comp, _ := compressionFromName(f.cfg.FS.Compression)
+	switch comp {
+	case compFlate:
+		buf := new(bytes.Buffer)
+		w, err := flate.NewWriter(buf, f.cfg.FS.CompressionLevel)
+		if err != nil {
+			log.Warn("flate: %s", err)
+			return data, compNone
+		}
+		_, err = w.Write(data)
+		if err == nil {
+			err = w.Close()
+		}
+		if err != nil {
+			log.Warn("flate: %s", err)
+			return data, compNone
+		}
+		if buf.Len() >= len(data) {
+			return data, compNone
+		}
+		return buf.Bytes(), compFlate
+	}
+	return data, compNone
+}
+
+func decompressBlock(data []byte, comp int) ([]byte, error) {
+	switch comp {
+	case compNone:
+		return data, nil
+	case compFlate:
+		r := flate.NewReader(bytes.NewReader(data))
+		defer r.Close()
+		return io.ReadAll(r)
+	default:
+		return nil, fmt.Errorf("unknown block compression %d", comp)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aerospike/aerospike-client-go/v8"
+)
+
+// keyring holds the AES-256-GCM keys used for encryption at rest
+// data is always encrypted with the current key; every encrypted record stores the id of its key, so older keys
+// remain usable for reading after a rotation until all records written with them are gone
+type keyring struct {
+	current string
+	aead    map[string]cipher.AEAD
+	nonce   map[string][]byte // per key HMAC secret for the deterministic nonces of names
+}
+
+// loadKeyring reads the key file: one key per line as `<id> <64 hex characters>`, the last key being the current one
+// empty lines and lines starting with # are ignored
+func loadKeyring(file string) (*keyring, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not open key file: %s", err)
+	}
+	defer f.Close()
+	k := &keyring{
+		aead:  make(map[string]cipher.AEAD),
+		nonce: make(map[string][]byte),
+	}
+	s := bufio.NewScanner(f)
+	line := 0
+	for s.Scan() {
+		line++
+		l := strings.TrimSpace(s.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		fields := strings.Fields(l)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("key file line %d: expected `<id> <hex key>`", line)
+		}
+		secret, err := hex.DecodeString(fields[1])
+		if err != nil || len(secret) != 32 {
+			return nil, fmt.Errorf("key file line %d: key must be 32 bytes hex-encoded", line)
+		}
+		block, err := aes.NewCipher(secret)
+		if err != nil {
+			return nil, fmt.Errorf("key file line %d: %s", line, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("key file line %d: %s", line, err)
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte("asdfs name nonce"))
+		k.aead[fields[0]] = aead
+		k.nonce[fields[0]] = mac.Sum(nil)
+		k.current = fields[0]
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("could not read key file: %s", err)
+	}
+	if k.current == "" {
+		return nil, errors.New("key file contains no keys")
+	}
+	return k, nil
+}
+
+// seal encrypts data with the current key, returning the nonce-prefixed ciphertext and the key id
+// aad binds the ciphertext to the record it is stored in
+func (k *keyring) seal(data []byte, aad []byte) ([]byte, string, error) {
+	aead := k.aead[k.current]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, "", err
+	}
+	return aead.Seal(nonce, nonce, data, aad), k.current, nil
+}
+
+func (k *keyring) open(data []byte, keyId string, aad []byte) ([]byte, error) {
+	aead, ok := k.aead[keyId]
+	if !ok {
+		return nil, fmt.Errorf("key %s not found in key file", keyId)
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("encrypted data too short")
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], aad)
+}
+
+// sealName deterministically encrypts a name, so that the same name always maps to the same directory entry key
+// the nonce is derived from the name itself, which only reveals whether two names in the same directory are equal
+func (k *keyring) sealName(name string, keyId string, aad []byte) (string, error) {
+	aead, ok := k.aead[keyId]
+	if !ok {
+		return "", fmt.Errorf("key %s not found in key file", keyId)
+	}
+	mac := hmac.New(sha256.New, k.nonce[keyId])
+	mac.Write(aad)
+	mac.Write([]byte(name))
+	nonce := mac.Sum(nil)[:aead.NonceSize()]
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(name), aad)), nil
+}
+
+func (k *keyring) openName(stored string, keyId string, aad []byte) (string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(stored)
+	if err != nil {
+		return "", err
+	}
+	name, err := k.open(data, keyId, aad)
+	if err != nil {
+		return "", err
+	}
+	return string(name), nil
+}
+
+// blocks are bound to their record key, so that encrypted blocks cannot be swapped around
+func blockAAD(k *aerospike.Key) []byte {
+	return []byte(k.Value().String())
+}
+
+// inode records (names, symlink targets) are bound to their inode number
+func inodeAAD(inode uint64) []byte {
+	return []byte(strconv.FormatUint(inode, 10))
+}
+
+// nameKey returns the id of the key encrypting the entry names of directory dir, "" if names are stored in plain text
+// the key of a directory is chosen at creation and never changes, so it is cached
+func (f *FS) nameKey(dir uint64) (string, error) {
+	if v, ok := f.nameKeys.Load(dir); ok {
+		return v.(string), nil
+	}
+	k, err := aerospike.NewKey(f.cfg.Aerospike.Namespace, f.cfg.setName("fs"), int(dir))
+	if err != nil {
+		return "", err
+	}
+	r, err := f.asd.Get(GetReadPolicyNoMRT(f.asd, &f.cfg.Aerospike.Timeouts), k, "NameKey")
+	if err != nil {
+		return "", err
+	}
+	keyId, _ := r.Bins["NameKey"].(string)
+	if keyId != "" && f.keys == nil {
+		return "", fmt.Errorf("directory %d has encrypted names, but no key file is configured", dir)
+	}
+	f.nameKeys.Store(dir, keyId)
+	return keyId, nil
+}
+
+// storedName returns the directory entry key under which name is stored in directory dir
+func (f *FS) storedName(dir uint64, name string) (string, error) {
+	keyId, err := f.nameKey(dir)
+	if err != nil || keyId == "" {
+		return name, err
+	}
+	return f.keys.sealName(name, keyId, inodeAAD(dir))
+}
+
+// plainName returns the name of a directory entry stored under key stored in directory dir
+func (f *FS) plainName(dir uint64, stored string) (string, error) {
+	keyId, err := f.nameKey(dir)
+	if err != nil || keyId == "" {
+		return stored, err
+	}
+	return f.keys.openName(stored, keyId, inodeAAD(dir))
+}
+
+// newNameKey returns the NameKey bin value for a new directory
+func newNameKey(c *Cfg, keys *keyring) interface{} {
+	if keys == nil || !c.FS.Encryption.Names {
+		return nil
+	}
+	return keys.current
+}
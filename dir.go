@@ -37,25 +37,31 @@ func (d *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error
 		return nil, syscall.EROFS
 	}
 	log.Debug("Executing Mkdir")
+	if err := d.fs.checkDirWrite(d.inode, &req.Header); err != nil {
+		return nil, err
+	}
 	// check `Ls` to ensure the new entry doesn't already exist
 	if err := d.fs.fuse.InvalidateNodeData(d); err != nil && err != fuse.ErrNotCached {
 		log.Warn("invalidate error: %v", err)
 	}
 	// check if the file already exists
-	parentKey, err := aerospike.NewKey(d.fs.cfg.Aerospike.Namespace, "fs", int(d.inode))
+	parentKey, err := aerospike.NewKey(d.fs.cfg.Aerospike.Namespace, d.fs.cfg.setName("fs"), int(d.inode))
 	if err != nil {
 		log.Error("Parent %d Mkdir '%s': %s", d.inode, req.Name, err)
 		return nil, syscall.EFAULT
 	}
+	name, xerr := d.fs.storedName(d.inode, req.Name)
+	if xerr != nil {
+		log.Error("Parent %d Mkdir '%s': %s", d.inode, req.Name, xerr)
+		return nil, syscall.EFAULT
+	}
 	mrt := GetWritePolicy(d.fs.asd, &d.fs.cfg.Aerospike.Timeouts)
-	log.Detail("ASD: Mkdir: MapGetByKeyOp(%v) %v", mrt.Id(), parentKey)
-	r, err := d.fs.asd.Operate(mrt.Write(), parentKey, aerospike.MapGetByKeyOp("Ls", req.Name, aerospike.MapReturnType.VALUE))
+	res, err := d.fs.getEntry(mrt.Write(), mrt.Id(), d.inode, parentKey, name)
 	if err != nil {
 		mrt.Abort()
 		log.Error("Parent %d Mkdir '%s': %s", d.inode, req.Name, err)
 		return nil, syscall.EFAULT
 	}
-	res := r.Bins["Ls"]
 	if res != nil {
 		// already exists
 		log.Error("Parent %d Mkdir '%s': exists", d.inode, req.Name)
@@ -63,31 +69,48 @@ func (d *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error
 		return nil, syscall.EEXIST
 	}
 	// obtain new inode, advancing lastInode meta entry
-	newNode, xerr := d.fs.newInode(mrt.txn)
+	newNode, xerr := d.fs.newInode()
 	if xerr != nil {
 		mrt.Abort()
 		log.Error("Parent %d Mkdir '%s': %s", d.inode, req.Name, xerr)
 		return nil, syscall.EFAULT
 	}
 	// store the new inode entry - new directory
-	files := make(Ls)
+	// the `Ls` map is created (key-ordered) by the first entry added
 	bins := make(aerospike.BinMap)
-	bins["Ls"] = files.ToAerospikeMap()
 	bins["Atime"] = TimeToDB(time.Now())
 	bins["Ctime"] = bins["Atime"]
 	bins["Mtime"] = bins["Ctime"]
-	bins["BlockSize"] = 8 * 1024 * 1024
-	bins["Blocks"] = 1
+	bins["Crtime"] = bins["Ctime"]
+	bins["BlockSize"] = d.fs.cfg.FS.BlockSize
+	bins["Blocks"] = 0 // entries are kept in the inode and shard records, there is no content
 	bins["Gid"] = int(req.Gid)
 	bins["Uid"] = int(req.Uid)
-	bins["Size"] = 8 * 1024 * 1024 // blocks * blocksize
+	bins["Size"] = 0
 	bins["Rdev"] = 0
-	bins["Nlink"] = 1
+	bins["Nlink"] = 2
 	bins["Flags"] = 0
 	bins["Mode"] = int(req.Mode)
-	wp := mrt.Write()
+	bins["NameKey"] = newNameKey(d.fs.cfg, d.fs.keys)
+	bins["Parents"] = newParents(d.inode, name)
+	err = d.fs.inheritedACL(mrt, parentKey, bins, true, req.Umask)
+	if err == nil {
+		err = d.fs.newInodeOwner(mrt, parentKey, bins, &req.Header)
+	}
+	if err == nil {
+		err = d.fs.newInodeTTL(mrt, parentKey, bins)
+	}
+	if err == nil {
+		err = d.fs.countNewInode(mrt, uint64(newNode), bins)
+	}
+	if err != nil {
+		mrt.Abort()
+		log.Error("Parent %d Mkdir '%s': %s", d.inode, req.Name, err)
+		return nil, syscall.EFAULT
+	}
+	wp := expiringPolicy(mrt.Write(), bins["Expires"])
 	wp.RecordExistsAction = aerospike.CREATE_ONLY
-	kk, err := aerospike.NewKey(d.fs.cfg.Aerospike.Namespace, "fs", newNode)
+	kk, err := aerospike.NewKey(d.fs.cfg.Aerospike.Namespace, d.fs.cfg.setName("fs"), newNode)
 	if err != nil {
 		log.Error("Parent %d Mkdir '%s': %s", d.inode, req.Name, err)
 		return nil, syscall.EFAULT
@@ -101,13 +124,17 @@ func (d *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error
 	}
 	// update the `Ls` of current dir, adding the new entry to the list
 	wp.RecordExistsAction = aerospike.UPDATE
-	mp := aerospike.NewMapPolicy(aerospike.MapOrder.KEY_ORDERED, aerospike.MapWriteMode.CREATE_ONLY)
 	lsVal := &LsItem{
 		Inode: uint64(newNode),
 		Type:  fuse.DT_Dir,
 	}
-	log.Detail("ASD: Mkdir: MapPutOp(%v) %v", mrt.Id(), parentKey)
-	_, err = d.fs.asd.Operate(mrt.Write(), parentKey, aerospike.MapPutOp(mp, "Ls", req.Name, lsVal.ToAerospikeMap()), aerospike.PutOp(aerospike.NewBin("Mtime", TimeToDB(time.Now()))), aerospike.PutOp(aerospike.NewBin("Atime", TimeToDB(time.Now()))))
+	err = d.fs.putEntry(mrt, d.inode, parentKey, name, lsVal)
+	if err != nil {
+		mrt.Abort()
+		log.Error("Parent %d Mkdir '%s': %s", d.inode, req.Name, err)
+		return nil, syscall.EFAULT
+	}
+	err = d.fs.addSubdirs(mrt, parentKey, 1)
 	if err != nil {
 		mrt.Abort()
 		log.Error("Parent %d Mkdir '%s': %s", d.inode, req.Name, err)
@@ -132,9 +159,12 @@ func (d *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
 	if d.fs.cfg.MountParams.RO {
 		return syscall.EROFS
 	}
-	var err error
+	err := d.fs.checkDirWrite(d.inode, &req.Header)
+	if err != nil {
+		return err
+	}
 	mrt := GetPolicies(d.fs.asd, &d.fs.cfg.Aerospike.Timeouts)
-	parentKey, err := aerospike.NewKey(d.fs.cfg.Aerospike.Namespace, "fs", int(d.inode))
+	parentKey, err := aerospike.NewKey(d.fs.cfg.Aerospike.Namespace, d.fs.cfg.setName("fs"), int(d.inode))
 	if err != nil {
 		log.Error("Parent %d Remove '%s': %s", d.inode, req.Name, err)
 		return syscall.EFAULT
@@ -166,49 +196,73 @@ func (d *Dir) remove(ctx context.Context, req *fuse.RemoveRequest, mrt *MRT, par
 		mrt.Abort()
 		return syscall.EFAULT
 	}
+	if err := d.fs.checkSticky(d.inode, inode, &req.Header); err != nil {
+		mrt.Abort()
+		return err
+	}
 	// key of the file itself
-	kk, err := aerospike.NewKey(d.fs.cfg.Aerospike.Namespace, "fs", int(inode))
+	kk, err := aerospike.NewKey(d.fs.cfg.Aerospike.Namespace, d.fs.cfg.setName("fs"), int(inode))
 	if err != nil {
 		log.Error("Remove %s from %d: %s", req.Name, d.inode, err)
 		mrt.Abort()
 		return syscall.EFAULT
 	}
 	if nType == fuse.DT_Dir {
-		dd := &Dir{
-			fs:    d.fs,
-			inode: inode,
-		}
-		res, err := dd.readDirAll(ctx, mrt.Write(), mrt.Id(), kk)
+		empty, err := d.fs.dirEmpty(mrt.Write(), mrt.Id(), inode, kk)
 		if err != nil {
 			log.Error("Remove %s from %d: %s", req.Name, d.inode, err)
 			mrt.Abort()
 			return syscall.EFAULT
 		}
-		if len(res) > 0 {
+		if !empty {
 			log.Detail("Failing to remove %s from %d: not empty", req.Name, d.inode)
 			mrt.Abort()
 			return syscall.ENOTEMPTY
 		}
 	}
 	// update the `Ls` entry, removing the requested file/dir
-	log.Detail("ASD: Remove: MapRemoveByKeyOp(%v) %v", mrt.Id(), parentKey)
-	_, err = d.fs.asd.Operate(mrt.Write(), parentKey, aerospike.MapRemoveByKeyOp("Ls", req.Name, aerospike.MapReturnType.NONE), aerospike.PutOp(aerospike.NewBin("Mtime", TimeToDB(time.Now()))), aerospike.PutOp(aerospike.NewBin("Atime", TimeToDB(time.Now()))))
+	name, xerr := d.fs.storedName(d.inode, req.Name)
+	if xerr != nil {
+		mrt.Abort()
+		log.Error("Parent %d Remove '%s': %s", d.inode, req.Name, xerr)
+		return syscall.EFAULT
+	}
+	err = d.fs.removeEntry(mrt, d.inode, parentKey, name)
 	if err != nil {
 		mrt.Abort()
 		log.Error("Parent %d Remove '%s': %s", d.inode, req.Name, err)
 		return syscall.EFAULT
 	}
 
-	// decrease the Nlink
+	// decrease the Nlink, changing the inode
 	log.Detail("ASD: Remove: AddOp(%v) %v", mrt.Id(), kk)
-	r, err := d.fs.asd.Operate(mrt.Write(), kk, aerospike.AddOp(aerospike.NewBin("Nlink", -1)), aerospike.GetBinOp("Nlink"))
+	r, err := d.fs.asd.Operate(mrt.Write(), kk, AddOp("Nlink", -1), removeParentOp(d.inode, name), PutOp("Ctime", TimeToDB(time.Now())), GetOp("Nlink"), GetOp("Size"), GetOp("BlockSize"), GetOp("Shards"), GetOp("XattrRecord"), GetOp("Mode"), GetOp("Blocks"), GetOp("Counted"), openCountOp())
 	if err != nil {
 		mrt.Abort()
 		log.Error("Remove %s from %d: %s", req.Name, d.inode, err)
 		return syscall.EFAULT
 	}
-	// delete the record in question only if Nlink is 0
-	if r.Bins["Nlink"].(int) == 0 {
+	if nType == fuse.DT_Dir {
+		err = d.fs.addSubdirs(mrt, parentKey, -1)
+		if err != nil {
+			mrt.Abort()
+			log.Error("Remove %s from %d: %s", req.Name, d.inode, err)
+			return syscall.EFAULT
+		}
+	}
+	// files still open somewhere are kept as orphans, deleted on their last release
+	if r.Bins["Nlink"].(int) == 0 && nType == fuse.DT_File && r.Bins["OpenCount"].(int) > 0 {
+		log.Detail("Remove %s from %d: inode %d still open, orphaning", req.Name, d.inode, inode)
+		xerr = d.fs.addOrphan(mrt, inode)
+		if xerr != nil {
+			log.Error("Remove %s from %d: %s", req.Name, d.inode, xerr)
+			mrt.Abort()
+			return syscall.EFAULT
+		}
+		return nil
+	}
+	// delete the record in question only if Nlink is 0; directories cannot be hard linked, their Nlink counts subdirectories
+	if r.Bins["Nlink"].(int) == 0 || nType == fuse.DT_Dir {
 		log.Detail("ASD: Remove: Delete(%v) %v", mrt.Id(), kk)
 		_, err = d.fs.asd.Delete(mrt.Write(), kk)
 		if err != nil {
@@ -216,18 +270,53 @@ func (d *Dir) remove(ctx context.Context, req *fuse.RemoveRequest, mrt *MRT, par
 			mrt.Abort()
 			return syscall.EFAULT
 		}
+		xerr = d.fs.addUsage(mrt, inode, r.Bins["Counted"], -contentBytes(r.Bins), -1)
+		if xerr != nil {
+			log.Error("Remove %s from %d: %s", req.Name, d.inode, xerr)
+			mrt.Abort()
+			return syscall.EFAULT
+		}
+		// files also have their content blocks
+		if nType == fuse.DT_File {
+			_, xerr = d.fs.truncateBlocks(mrt, inode, r.Bins["BlockSize"].(int), r.Bins["Size"].(int), 0)
+			if xerr != nil {
+				log.Error("Remove %s from %d: %s", req.Name, d.inode, xerr)
+				mrt.Abort()
+				return syscall.EFAULT
+			}
+		}
+		// and sharded dirs their shard records
+		if shards, _ := r.Bins["Shards"].(int); nType == fuse.DT_Dir && shards > 0 {
+			err = d.fs.deleteShards(mrt, inode, shards)
+			if err != nil {
+				log.Error("Remove %s from %d: %s", req.Name, d.inode, err)
+				mrt.Abort()
+				return syscall.EFAULT
+			}
+		}
+		if r.Bins["XattrRecord"] != nil {
+			err = d.fs.deleteXattrs(mrt, inode)
+			if err != nil {
+				log.Error("Remove %s from %d: %s", req.Name, d.inode, err)
+				mrt.Abort()
+				return syscall.EFAULT
+			}
+		}
 	}
 	return nil
 }
 
-// if d.inode->req.OldName is a dir, if req.NewDir(Ls)->req.NewName exists, error
-// if d.inode->req.OldName is a file, if req.NewDir(Ls)->req.NewName exists:
+// if req.NewDir(Ls)->req.NewName exists, it is getting replaced:
 //
-//	if req.NewDir(Ls)->req.NewName is a dir: error
-//	if req.NewDir(Ls)->req.NewName is a file: delete the file, it is getting overwritten
+//	if it is the same inode as d.inode->req.OldName: nothing to do
+//	if d.inode->req.OldName is a dir: req.NewName must be an empty dir (ENOTDIR, ENOTEMPTY), which is removed
+//	if d.inode->req.OldName is not a dir: req.NewName must not be a dir (EISDIR), its link is removed
 //
+// a dir cannot be moved into itself or its own subtree (EINVAL)
 // from d.inode(Ls) remove req.OldName
 // add req.NewName to req.NewDir(Ls)
+// RENAME_NOREPLACE and RENAME_EXCHANGE are not supported, bazil.org/fuse does not dispatch FUSE_RENAME2 and the
+// kernel refuses the flags
 func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
 	OpStart()
 	defer OpEnd()
@@ -245,9 +334,17 @@ func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Nod
 	}
 	req.NewDir = fuse.NodeID(attr.Inode)
 	log.Debug("Executing Rename %s->%s on %d->%d", req.OldName, req.NewName, d.inode, req.NewDir)
+	if err := d.fs.checkDirWrite(d.inode, &req.Header); err != nil {
+		return err
+	}
+	if uint64(req.NewDir) != d.inode {
+		if err := d.fs.checkDirWrite(uint64(req.NewDir), &req.Header); err != nil {
+			return err
+		}
+	}
 	mrt := GetPolicies(d.fs.asd, &d.fs.cfg.Aerospike.Timeouts)
 	// lookup Old
-	oldKey, err := aerospike.NewKey(d.fs.cfg.Aerospike.Namespace, "fs", int(d.inode))
+	oldKey, err := aerospike.NewKey(d.fs.cfg.Aerospike.Namespace, d.fs.cfg.setName("fs"), int(d.inode))
 	if err != nil {
 		mrt.Abort()
 		log.Detail("Rename %s->%s on %d->%d: NewKey(old): %s", req.OldName, req.NewName, d.inode, req.NewDir, err)
@@ -259,6 +356,17 @@ func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Nod
 		log.Error("Rename %s->%s on %d->%d: lookup old: %s", req.OldName, req.NewName, d.inode, req.NewDir, err)
 		return err
 	}
+	if err := d.fs.checkSticky(d.inode, oinode, &req.Header); err != nil {
+		mrt.Abort()
+		return err
+	}
+	// a directory moving to another parent has its ".." entry changed
+	if otype == fuse.DT_Dir && uint64(req.NewDir) != d.inode {
+		if err := d.fs.checkAccess(oinode, &req.Header, permWrite); err != nil {
+			mrt.Abort()
+			return err
+		}
+	}
 	// lookup New
 	nd := &Dir{
 		fs:    d.fs,
@@ -269,7 +377,7 @@ func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Nod
 	if d.inode == nd.inode {
 		parentKey = oldKey
 	} else {
-		parentKey, err = aerospike.NewKey(d.fs.cfg.Aerospike.Namespace, "fs", int(nd.inode))
+		parentKey, err = aerospike.NewKey(d.fs.cfg.Aerospike.Namespace, d.fs.cfg.setName("fs"), int(nd.inode))
 		if err != nil {
 			mrt.Abort()
 			log.Detail("Rename %s->%s on %d->%d: NewKey(new): %s", req.OldName, req.NewName, d.inode, req.NewDir, err)
@@ -282,52 +390,130 @@ func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Nod
 		log.Error("Rename %s->%s on %d->%d: lookup new: %s", req.OldName, req.NewName, d.inode, req.NewDir, err)
 		return err
 	}
-	// if it's a dir, and destination exists, just error
-	if otype == fuse.DT_Dir && ninode != 0 {
+	// both names link to the same inode, nothing to do
+	if ninode == oinode {
 		mrt.Abort()
-		log.Detail("Rename %s->%s on %d->%d: src=dir dst=EEXXIST", req.OldName, req.NewName, d.inode, req.NewDir)
-		return syscall.EEXIST
+		log.Detail("Rename %s->%s on %d->%d: same inode", req.OldName, req.NewName, d.inode, req.NewDir)
+		return nil
 	}
-	// if it's a file and new(exists and dir), error
-	if (otype == fuse.DT_File || otype == fuse.DT_Link) && ninode != 0 && ntype == fuse.DT_Dir {
+	// a dir can only replace a dir, and a non-dir only a non-dir
+	if otype == fuse.DT_Dir && ninode != 0 && ntype != fuse.DT_Dir {
 		mrt.Abort()
-		log.Detail("Rename %s->%s on %d->%d: src=file dst=EEXXIST+DT_DIR", req.OldName, req.NewName, d.inode, req.NewDir)
-		return syscall.EEXIST
+		log.Detail("Rename %s->%s on %d->%d: src=dir dst=ENOTDIR", req.OldName, req.NewName, d.inode, req.NewDir)
+		return syscall.ENOTDIR
 	}
-	// if it's a file and new(exists, file), delete the new - it is getting overwritten
-	if (otype == fuse.DT_File || otype == fuse.DT_Link) && ninode != 0 && (ntype == fuse.DT_File || ntype == fuse.DT_Link) {
+	if otype != fuse.DT_Dir && ninode != 0 && ntype == fuse.DT_Dir {
+		mrt.Abort()
+		log.Detail("Rename %s->%s on %d->%d: src=file dst=EISDIR", req.OldName, req.NewName, d.inode, req.NewDir)
+		return syscall.EISDIR
+	}
+	// a dir moving to another parent must not end up in its own subtree
+	if otype == fuse.DT_Dir && d.inode != nd.inode {
+		loop, xerr := d.fs.isAncestor(mrt, oinode, nd.inode)
+		if xerr != nil {
+			mrt.Abort()
+			log.Error("Rename %s->%s on %d->%d: %s", req.OldName, req.NewName, d.inode, req.NewDir, xerr)
+			return syscall.EFAULT
+		}
+		if loop {
+			mrt.Abort()
+			log.Detail("Rename %s->%s on %d->%d: EINVAL, into own subtree", req.OldName, req.NewName, d.inode, req.NewDir)
+			return syscall.EINVAL
+		}
+	}
+	// if new exists, remove it - it is getting replaced; dirs must be empty
+	if ninode != 0 {
 		err = nd.remove(ctx, &fuse.RemoveRequest{
-			Name: req.NewName,
+			Header: req.Header,
+			Name:   req.NewName,
+			Dir:    ntype == fuse.DT_Dir,
 		}, mrt, parentKey)
 		if err != nil {
 			mrt.Abort()
-			log.Detail("Rename %s->%s on %d->%d: delete dest file: %s", req.OldName, req.NewName, d.inode, req.NewDir, err)
+			log.Detail("Rename %s->%s on %d->%d: delete dest: %s", req.OldName, req.NewName, d.inode, req.NewDir, err)
 			return err
 		}
 	}
 	// from d.inode(Ls) remove req.OldName
-	log.Detail("ASD: Rename: MapRemoveByKeyOp(%v) %v", mrt.Id(), oldKey)
-	_, err = d.fs.asd.Operate(mrt.Write(), oldKey, aerospike.MapRemoveByKeyOp("Ls", req.OldName, aerospike.MapReturnType.NONE), aerospike.PutOp(aerospike.NewBin("Mtime", TimeToDB(time.Now()))), aerospike.PutOp(aerospike.NewBin("Atime", TimeToDB(time.Now()))))
+	oldName, xerr := d.fs.storedName(d.inode, req.OldName)
+	if xerr != nil {
+		mrt.Abort()
+		log.Error("Rename %s->%s on %d->%d: %s", req.OldName, req.NewName, d.inode, req.NewDir, xerr)
+		return syscall.EFAULT
+	}
+	newName, xerr := d.fs.storedName(nd.inode, req.NewName)
+	if xerr != nil {
+		mrt.Abort()
+		log.Error("Rename %s->%s on %d->%d: %s", req.OldName, req.NewName, d.inode, req.NewDir, xerr)
+		return syscall.EFAULT
+	}
+	err = d.fs.removeEntry(mrt, d.inode, oldKey, oldName)
 	if err != nil {
 		mrt.Abort()
 		log.Detail("Rename %s->%s on %d->%d: Remove old entry: %s", req.OldName, req.NewName, d.inode, req.NewDir, err)
 		return syscall.EFAULT
 	}
 	// add req.NewName to req.NewDir(Ls)
-	mp := aerospike.NewMapPolicy(aerospike.MapOrder.KEY_ORDERED, aerospike.MapWriteMode.CREATE_ONLY)
 	lsVal := &LsItem{
 		Inode: uint64(oinode),
 		Type:  otype,
 	}
-	log.Detail("ASD: Rename: MapPutOp(%v) %v", mrt.Id(), parentKey)
-	_, err = d.fs.asd.Operate(mrt.Write(), parentKey, aerospike.MapPutOp(mp, "Ls", req.NewName, lsVal.ToAerospikeMap()), aerospike.PutOp(aerospike.NewBin("Mtime", TimeToDB(time.Now()))), aerospike.PutOp(aerospike.NewBin("Atime", TimeToDB(time.Now()))))
+	err = d.fs.putEntry(mrt, nd.inode, parentKey, newName, lsVal)
 	if err != nil {
 		mrt.Abort()
 		log.Detail("Rename %s->%s on %d->%d: Add new entry: %s", req.OldName, req.NewName, d.inode, req.NewDir, err)
 		return syscall.EFAULT
 	}
+	// the renamed inode changed
+	kk, err := aerospike.NewKey(d.fs.cfg.Aerospike.Namespace, d.fs.cfg.setName("fs"), int(oinode))
+	if err != nil {
+		mrt.Abort()
+		log.Detail("Rename %s->%s on %d->%d: NewKey(inode): %s", req.OldName, req.NewName, d.inode, req.NewDir, err)
+		return syscall.EFAULT
+	}
+	log.Detail("ASD: Rename: PutOp(%v) %v", mrt.Id(), kk)
+	r, err := d.fs.asd.Operate(mrt.Write(), kk, PutOp("Ctime", TimeToDB(time.Now())), removeParentOp(d.inode, oldName), addParentOp(nd.inode, newName), GetOp("Expires"))
+	if err != nil {
+		mrt.Abort()
+		log.Detail("Rename %s->%s on %d->%d: Ctime: %s", req.OldName, req.NewName, d.inode, req.NewDir, err)
+		return syscall.EFAULT
+	}
+	if r.Bins["Expires"] != nil && d.inode != nd.inode {
+		err = d.fs.markExpiring(mrt, parentKey)
+		if err != nil {
+			mrt.Abort()
+			log.Detail("Rename %s->%s on %d->%d: Expiring: %s", req.OldName, req.NewName, d.inode, req.NewDir, err)
+			return syscall.EFAULT
+		}
+	}
+	// permanent inodes cannot move into expiring directories, `mv` copies them instead
+	if r.Bins["Expires"] == nil && d.inode != nd.inode {
+		expiring, xerr := d.fs.inodeExpires(mrt.Read(), parentKey)
+		if xerr != nil {
+			mrt.Abort()
+			log.Error("Rename %s->%s on %d->%d: %s", req.OldName, req.NewName, d.inode, req.NewDir, xerr)
+			return syscall.EFAULT
+		}
+		if expiring {
+			mrt.Abort()
+			log.Detail("Rename %s->%s on %d->%d: EXDEV, permanent inode into expiring directory", req.OldName, req.NewName, d.inode, req.NewDir)
+			return syscall.EXDEV
+		}
+	}
+	// a directory moved to another directory changes the subdirectory counts
+	if otype == fuse.DT_Dir && d.inode != nd.inode {
+		err = d.fs.addSubdirs(mrt, oldKey, -1)
+		if err == nil {
+			err = d.fs.addSubdirs(mrt, parentKey, 1)
+		}
+		if err != nil {
+			mrt.Abort()
+			log.Detail("Rename %s->%s on %d->%d: Nlink: %s", req.OldName, req.NewName, d.inode, req.NewDir, err)
+			return syscall.EFAULT
+		}
+	}
 	// done
-	xerr := mrt.Commit()
+	xerr = mrt.Commit()
 	if xerr != nil {
 		mrt.Abort()
 		log.Detail("Rename %s->%s on %d->%d: Commit: %s", req.OldName, req.NewName, d.inode, req.NewDir, xerr)
@@ -336,52 +522,83 @@ func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Nod
 	return nil
 }
 
-func (d *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	name := req.Name
 	log.Debug("Executing Lookup inode %d name %s", d.inode, name)
-	var err error
-	k, err := aerospike.NewKey(d.fs.cfg.Aerospike.Namespace, "fs", int(d.inode))
-	if err != nil {
-		log.Error("Lookup (%d,%s) NewKey: %s", d.inode, name, err)
-		return nil, syscall.EFAULT
-	}
-	nType, inode, err := d.lookup(ctx, name, GetWritePolicyNoMRT(d.fs.asd, &d.fs.cfg.Aerospike.Timeouts), -1, k)
+	err := d.fs.checkAccess(d.inode, &req.Header, permExecute)
 	if err != nil {
 		return nil, err
 	}
-	switch nType {
-	case fuse.DT_Dir:
-		log.Detail("Lookup: Inode %d name %s: Dir inode %d", d.inode, name, inode)
+	if name == ".." {
+		parent, err := d.fs.parentOf(d.inode)
+		if err != nil {
+			log.Warn("Lookup (%d,%s): %s", d.inode, name, err)
+			return nil, syscall.ENOENT
+		}
 		return &Dir{
 			fs:    d.fs,
-			inode: inode,
-		}, nil
-	case fuse.DT_File:
-		log.Detail("Lookup: Inode %d name %s: File inode %d", d.inode, name, inode)
-		return &File{
-			fs:    d.fs,
-			inode: inode,
+			inode: parent,
 		}, nil
-	case fuse.DT_Link:
-		log.Detail("Lookup: Inode %d name %s: Symlink inode %d", d.inode, name, inode)
-		return &Symlink{
-			fs:    d.fs,
-			inode: inode,
-		}, nil
-	default:
+	}
+	k, err := aerospike.NewKey(d.fs.cfg.Aerospike.Namespace, d.fs.cfg.setName("fs"), int(d.inode))
+	if err != nil {
+		log.Error("Lookup (%d,%s) NewKey: %s", d.inode, name, err)
+		return nil, syscall.EFAULT
+	}
+	stored, xerr := d.fs.storedName(d.inode, name)
+	if xerr != nil {
+		log.Error("Lookup (%d,%s) storedName: %s", d.inode, name, xerr)
+		return nil, syscall.EFAULT
+	}
+	v, expiring, err := d.fs.lookupEntry(GetWritePolicyNoMRT(d.fs.asd, &d.fs.cfg.Aerospike.Timeouts), -1, d.inode, k, stored)
+	if err != nil {
+		log.Error("Lookup (%d,%s) Operate: %s", d.inode, name, err)
+		return nil, syscall.EFAULT
+	}
+	if v == nil {
+		log.Detail("Lookup: Inode %d name %s: ENOENT", d.inode, name)
+		return nil, syscall.ENOENT
+	}
+	nType := fuse.DirentType(v.(map[interface{}]interface{})["Type"].(int))
+	inode := uint64(v.(map[interface{}]interface{})["Inode"].(int))
+	// only directories marked as holding entries of expiring inodes need checking the inode
+	alive := true
+	if expiring {
+		alive, xerr = d.fs.entryAlive(inode)
+		if xerr != nil {
+			log.Error("Lookup (%d,%s) Exists: %s", d.inode, name, xerr)
+			return nil, syscall.EFAULT
+		}
+	}
+	if !alive {
+		log.Detail("Lookup: Inode %d name %s: inode %d expired", d.inode, name, inode)
+		xerr = d.fs.dropExpired(d.inode, k, stored, inode)
+		if xerr != nil {
+			log.Warn("Lookup (%d,%s): dropping expired entry: %s", d.inode, name, xerr)
+		}
+		return nil, syscall.ENOENT
+	}
+	node := d.fs.node(nType, inode)
+	if node == nil {
 		return nil, syscall.ENOTSUP
 	}
+	log.Detail("Lookup: Inode %d name %s: %T inode %d", d.inode, name, node, inode)
+	return node, nil
 }
 
 func (d *Dir) lookup(ctx context.Context, name string, wp *aerospike.WritePolicy, id int64, k *aerospike.Key) (nType fuse.DirentType, inode uint64, err error) {
 	// read the `Ls` entries, but do not return them, instead check if the entry with a given name exists
 	log.Debug("Executing lookup inode %d name %s", d.inode, name)
-	log.Detail("ASD: lookup: MapGetByKeyOp(%v) %v", id, k)
-	r, err := d.fs.asd.Operate(wp, k, aerospike.MapGetByKeyOp("Ls", name, aerospike.MapReturnType.VALUE))
-	if err != nil {
-		log.Error("Lookup (%d,%s) Operate: %s", d.inode, name, err)
+	stored, xerr := d.fs.storedName(d.inode, name)
+	if xerr != nil {
+		log.Error("Lookup (%d,%s) storedName: %s", d.inode, name, xerr)
+		return 0, 0, syscall.EFAULT
+	}
+	v, xerr := d.fs.getEntry(wp, id, d.inode, k, stored)
+	if xerr != nil {
+		log.Error("Lookup (%d,%s) Operate: %s", d.inode, name, xerr)
 		return 0, 0, syscall.EFAULT
 	}
-	v := r.Bins["Ls"]
 	if v == nil {
 		log.Detail("Lookup: Inode %d name %s: ENOENT", d.inode, name)
 		return 0, 0, syscall.ENOENT
@@ -389,40 +606,90 @@ func (d *Dir) lookup(ctx context.Context, name string, wp *aerospike.WritePolicy
 	return fuse.DirentType(v.(map[interface{}]interface{})["Type"].(int)), uint64(v.(map[interface{}]interface{})["Inode"].(int)), nil
 }
 
+// Open checks that the caller may list the directory, which serves as its own handle
+func (d *Dir) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	log.Debug("Executing Opendir inode %d", d.inode)
+	if err := d.fs.checkAccess(d.inode, &req.Header, permRead); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// number of entries fetched per database call when listing a directory
+const readDirPage = 1000
+
+// ReadDirAll returns the entries in key order (shard by shard for sharded directories), paging through the `Ls` maps
+// with range operations; each page continues after the last key returned, so concurrent changes do not shift the listing
 func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
-	k, err := aerospike.NewKey(d.fs.cfg.Aerospike.Namespace, "fs", int(d.inode))
+	log.Debug("Executing ReadDirAll inode %d", d.inode)
+	k, err := aerospike.NewKey(d.fs.cfg.Aerospike.Namespace, d.fs.cfg.setName("fs"), int(d.inode))
 	if err != nil {
 		log.Error("ReadDirAll %d NewKey: %s", d.inode, err)
 		return nil, syscall.EFAULT
 	}
-	return d.readDirAll(ctx, GetWritePolicyNoMRT(d.fs.asd, &d.fs.cfg.Aerospike.Timeouts), -1, k)
-}
-
-func (d *Dir) readDirAll(ctx context.Context, wp *aerospike.WritePolicy, id int64, k *aerospike.Key) ([]fuse.Dirent, error) {
-	// read the `Ls` map entries and return them as a list of Dirent
-	log.Debug("Executing ReadDirAll inode %d", d.inode)
-	ret := []fuse.Dirent{}
-	log.Detail("ASD: readDirAll: Get(%v) %v", id, k)
-	r, xerr := d.fs.asd.Operate(wp, k, aerospike.GetBinOp("Ls"))
-	//r, xerr := d.fs.asd.Get(rp, k, "Ls")
-	if xerr != nil {
-		if xerr.Matches(aerospike.ErrKeyNotFound.ResultCode) {
+	wp := GetWritePolicyNoMRT(d.fs.asd, &d.fs.cfg.Aerospike.Timeouts)
+	shards, err := d.fs.dirShards(wp, -1, d.inode, k)
+	if err != nil {
+		if err.Matches(aerospike.ErrKeyNotFound.ResultCode) {
 			return nil, syscall.ENOENT
 		}
-		log.Error("ReadDirAll %d Get(Ls): %s", d.inode, xerr)
+		log.Error("ReadDirAll %d: %s", d.inode, err)
 		return nil, syscall.EFAULT
 	}
-	log.Detail("ReadDirAll %d: Ls:%v", d.inode, r.Bins["Ls"])
-	for n, v := range r.Bins["Ls"].(map[interface{}]interface{}) {
-		ret = append(ret, fuse.Dirent{
-			Inode: uint64(v.(map[interface{}]interface{})["Inode"].(int)),
-			Name:  n.(string),
-			Type:  fuse.DirentType(v.(map[interface{}]interface{})["Type"].(int)),
-		})
+	expiring, err := d.fs.mayExpire(GetReadPolicyNoMRT(d.fs.asd, &d.fs.cfg.Aerospike.Timeouts), k)
+	if err != nil {
+		log.Error("ReadDirAll %d: %s", d.inode, err)
+		return nil, syscall.EFAULT
+	}
+	ret := []fuse.Dirent{}
+	for shard := 0; shard == 0 || shard < shards; shard++ {
+		after := ""
+		for {
+			entries, err := d.fs.pageEntries(wp, -1, d.inode, k, shards, shard, after, readDirPage)
+			if err != nil {
+				log.Error("ReadDirAll %d: %s", d.inode, err)
+				return nil, syscall.EFAULT
+			}
+			live, expired := entries, []aerospike.MapPair(nil)
+			var xerr error
+			if expiring {
+				live, expired, xerr = d.fs.liveEntries(GetBatchPolicyNoMRT(d.fs.asd, &d.fs.cfg.Aerospike.Timeouts), entries)
+				if xerr != nil {
+					log.Error("ReadDirAll %d: %s", d.inode, xerr)
+					return nil, syscall.EFAULT
+				}
+			}
+			for _, e := range expired {
+				xerr = d.fs.dropExpired(d.inode, k, e.Key.(string), uint64(e.Value.(map[interface{}]interface{})["Inode"].(int)))
+				if xerr != nil {
+					log.Warn("ReadDirAll %d: dropping expired entry: %s", d.inode, xerr)
+				}
+			}
+			for _, e := range live {
+				de, xerr := d.fs.dirent(d.inode, e)
+				if xerr != nil {
+					log.Error("ReadDirAll %d name %s: %s", d.inode, e.Key, xerr)
+					return nil, syscall.EFAULT
+				}
+				ret = append(ret, de)
+			}
+			if len(entries) < readDirPage {
+				break
+			}
+			after = entries[len(entries)-1].Key.(string)
+		}
 	}
+	d.fs.touchAtime(d.inode, nil)
 	return ret, nil
 }
 
+// Fsync writes the pending access time of the directory, the only state not written right away
+func (d *Dir) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	log.Debug("Fsync called on %d", d.inode)
+	d.fs.flushAtime(d.inode)
+	return nil
+}
+
 func (d *Dir) Link(ctx context.Context, req *fuse.LinkRequest, old fs.Node) (fs.Node, error) {
 	OpStart()
 	defer OpEnd()
@@ -435,34 +702,61 @@ func (d *Dir) Link(ctx context.Context, req *fuse.LinkRequest, old fs.Node) (fs.
 	}
 	sourceFile := attr.Inode
 	log.Detail("Executing Link %d -> %d/%s", sourceFile, destDirInode, newName)
+	if err := d.fs.checkDirWrite(destDirInode, &req.Header); err != nil {
+		return nil, err
+	}
 	// aerospike key
-	kSrc, err := aerospike.NewKey(d.fs.cfg.Aerospike.Namespace, "fs", int(sourceFile))
+	kSrc, err := aerospike.NewKey(d.fs.cfg.Aerospike.Namespace, d.fs.cfg.setName("fs"), int(sourceFile))
 	if err != nil {
 		log.Error("Link %d NewKey: %s", d.inode, err)
 		return nil, syscall.EFAULT
 	}
-	kDst, err := aerospike.NewKey(d.fs.cfg.Aerospike.Namespace, "fs", int(destDirInode))
+	kDst, err := aerospike.NewKey(d.fs.cfg.Aerospike.Namespace, d.fs.cfg.setName("fs"), int(destDirInode))
 	if err != nil {
 		log.Error("Link %d NewKey: %s", d.inode, err)
 		return nil, syscall.EFAULT
 	}
+	name, xerr := d.fs.storedName(destDirInode, newName)
+	if xerr != nil {
+		log.Error("Link %d Ls: %s", d.inode, xerr)
+		return nil, syscall.EFAULT
+	}
 	// update link count Nlink
 	mrt := GetPolicies(d.fs.asd, &d.fs.cfg.Aerospike.Timeouts)
 	log.Detail("ASD: Link: AddOp(%v) %v", mrt.Id(), kSrc)
-	_, err = d.fs.asd.Operate(mrt.Write(), kSrc, aerospike.AddOp(aerospike.NewBin("Nlink", 1)))
+	r, err := d.fs.asd.Operate(mrt.Write(), kSrc, AddOp("Nlink", 1), addParentOp(destDirInode, name), PutOp("Ctime", TimeToDB(time.Now())), GetOp("Expires"))
 	if err != nil {
 		mrt.Abort()
 		log.Error("Link %d Incr(Nlink): %s", d.inode, err)
 		return nil, syscall.EFAULT
 	}
+	if r.Bins["Expires"] != nil {
+		err = d.fs.markExpiring(mrt, kDst)
+		if err != nil {
+			mrt.Abort()
+			log.Error("Link %d Expiring: %s", d.inode, err)
+			return nil, syscall.EFAULT
+		}
+	} else {
+		// permanent inodes cannot be linked into expiring directories
+		expiring, xerr := d.fs.inodeExpires(mrt.Read(), kDst)
+		if xerr != nil {
+			mrt.Abort()
+			log.Error("Link %d Expires: %s", d.inode, xerr)
+			return nil, syscall.EFAULT
+		}
+		if expiring {
+			mrt.Abort()
+			log.Detail("Link %d -> %d/%s: EXDEV, permanent inode into expiring directory", sourceFile, destDirInode, newName)
+			return nil, syscall.EXDEV
+		}
+	}
 	// update dir entry
-	mp := aerospike.NewMapPolicy(aerospike.MapOrder.KEY_ORDERED, aerospike.MapWriteMode.CREATE_ONLY)
 	lsVal := &LsItem{
 		Inode: uint64(sourceFile),
-		Type:  fuse.DT_File,
+		Type:  direntType(attr.Mode),
 	}
-	log.Detail("ASD: Link: MapPutOp(%v) %v", mrt.Id(), kDst)
-	_, err = d.fs.asd.Operate(mrt.Write(), kDst, aerospike.MapPutOp(mp, "Ls", newName, lsVal.ToAerospikeMap()), aerospike.PutOp(aerospike.NewBin("Mtime", TimeToDB(time.Now()))), aerospike.PutOp(aerospike.NewBin("Atime", TimeToDB(time.Now()))))
+	err = d.fs.putEntry(mrt, destDirInode, kDst, name, lsVal)
 	if err != nil {
 		mrt.Abort()
 		log.Error("Link %d Ls: %s", d.inode, err)
@@ -470,14 +764,11 @@ func (d *Dir) Link(ctx context.Context, req *fuse.LinkRequest, old fs.Node) (fs.
 	}
 	// done
 	log.Detail("ASD: Link: Commit(%v)", mrt.Id())
-	xerr := mrt.Commit()
+	xerr = mrt.Commit()
 	if xerr != nil {
 		mrt.Abort()
 		log.Error("Link %d Ls: %s", d.inode, xerr)
 		return nil, syscall.EFAULT
 	}
-	return &File{
-		fs:    d.fs,
-		inode: sourceFile,
-	}, nil
+	return d.fs.node(direntType(attr.Mode), sourceFile), nil
 }
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+)
+
+func TestRmdirEmpty(t *testing.T) {
+	tests := []struct {
+		name    string
+		sharded bool
+		create  int // entries created in the directory
+		remove  int // of which removed again
+		want    error
+	}{
+		{"empty", false, 0, 0, nil},
+		{"not empty", false, 3, 0, syscall.ENOTEMPTY},
+		{"emptied", false, 3, 3, nil},
+		{"sharded, not empty", true, 10, 0, syscall.ENOTEMPTY},
+		{"sharded, last entry left", true, 10, 9, syscall.ENOTEMPTY},
+		{"sharded, emptied", true, 10, 10, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := "fs:\n  dirShardThreshold: -1\n"
+			if tt.sharded {
+				config = "fs:\n  dirShardThreshold: 2\n  dirShards: 4\n"
+			}
+			_, root := newTestFSConfig(t, config)
+			d := testMkdir(t, root, "d")
+			for i := 0; i < tt.create; i++ {
+				testCreate(t, d, fmt.Sprintf("f%d", i), "")
+			}
+			for i := 0; i < tt.remove; i++ {
+				if err := d.Remove(context.Background(), &fuse.RemoveRequest{Name: fmt.Sprintf("f%d", i)}); err != nil {
+					t.Fatalf("Remove f%d: %s", i, err)
+				}
+			}
+			err := root.Remove(context.Background(), &fuse.RemoveRequest{Name: "d", Dir: true})
+			if err != tt.want {
+				t.Fatalf("Rmdir: %v, want %v", err, tt.want)
+			}
+			if exists := lookupInode(t, root, "d") != 0; exists != (err != nil) {
+				t.Fatalf("directory exists %v after Rmdir: %v", exists, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"strings"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/aerospike/aerospike-client-go/v8"
+)
+
+// directory entries are stored in the `Ls` map bin of the directory inode record, keyed by (stored) name
+// once a directory grows past fs.dirShardThreshold entries, its entries are moved to fs.dirShards shard records in the
+// "dir" set, keyed "inode_shard", and the inode record gets a "Shards" bin with the shard count
+// an entry lives in the shard picked by the hash of its name, so single entry operations touch only one shard
+// directories are never merged back, so the shard count of a sharded directory can be cached
+
+func (f *FS) shardKey(dir uint64, shard int) (*aerospike.Key, aerospike.Error) {
+	return aerospike.NewKey(f.cfg.Aerospike.Namespace, f.cfg.setName("dir"), fmt.Sprintf("%d_%d", dir, shard))
+}
+
+func shardOf(name string, shards int) int {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return int(h.Sum32() % uint32(shards))
+}
+
+// entryKey returns the key of the record holding entry name of a directory with the given number of shards
+func (f *FS) entryKey(dir uint64, dirKey *aerospike.Key, shards int, name string) (*aerospike.Key, aerospike.Error) {
+	if shards == 0 {
+		return dirKey, nil
+	}
+	return f.shardKey(dir, shardOf(name, shards))
+}
+
+// dirShards returns the number of shards of a directory, 0 if its entries are stored in the inode record
+func (f *FS) dirShards(wp *aerospike.WritePolicy, id int64, dir uint64, dirKey *aerospike.Key) (int, aerospike.Error) {
+	if v, ok := f.shards.Load(dir); ok {
+		return v.(int), nil
+	}
+	log.Detail("ASD: dirShards: GetBinOp(%v) %v", id, dirKey)
+	r, err := f.asd.Operate(wp, dirKey, GetOp("Shards"))
+	if err != nil {
+		return 0, err
+	}
+	shards, _ := r.Bins["Shards"].(int)
+	if shards > 0 {
+		f.shards.Store(dir, shards)
+	}
+	return shards, nil
+}
+
+// getEntry returns the `Ls` entry of name in a directory, nil if it does not exist
+func (f *FS) getEntry(wp *aerospike.WritePolicy, id int64, dir uint64, dirKey *aerospike.Key, name string) (interface{}, aerospike.Error) {
+	v, _, err := f.readEntry(wp, id, dir, dirKey, name, false)
+	return v, err
+}
+
+// lookupEntry returns the `Ls` entry of name in a directory like getEntry, and whether the directory may hold entries
+// of expired inodes (its "Expiring" bin), read in the same round trip
+func (f *FS) lookupEntry(wp *aerospike.WritePolicy, id int64, dir uint64, dirKey *aerospike.Key, name string) (interface{}, bool, aerospike.Error) {
+	return f.readEntry(wp, id, dir, dirKey, name, true)
+}
+
+func (f *FS) readEntry(wp *aerospike.WritePolicy, id int64, dir uint64, dirKey *aerospike.Key, name string, expiring bool) (interface{}, bool, aerospike.Error) {
+	if _, ok := f.shards.Load(dir); !ok {
+		// unsharded directories are answered by a single read of the inode record
+		log.Detail("ASD: getEntry: MapGetByKeyOp(%v) %v", id, dirKey)
+		ops := []*Op{GetOp("Shards"), MapGetOp("Ls", name)}
+		if expiring {
+			ops = append(ops, GetOp("Expiring"))
+		}
+		r, err := f.asd.Operate(wp, dirKey, ops...)
+		if err != nil {
+			return nil, false, err
+		}
+		shards, _ := r.Bins["Shards"].(int)
+		if shards == 0 {
+			return r.Bins["Ls"], r.Bins["Expiring"] != nil, nil
+		}
+		f.shards.Store(dir, shards)
+	}
+	shards, err := f.dirShards(wp, id, dir, dirKey)
+	if err != nil {
+		return nil, false, err
+	}
+	k, err := f.entryKey(dir, dirKey, shards, name)
+	if err != nil {
+		return nil, false, err
+	}
+	if expiring {
+		// the shard record and the inode record holding the mark, in one batch
+		bp := GetBatchPolicyNoMRT(f.asd, &f.cfg.Aerospike.Timeouts)
+		bp.Txn = wp.Txn
+		log.Detail("ASD: getEntry: BatchOperate(%v) %v %v", id, k, dirKey)
+		records, err := f.asd.BatchOperate(bp, []*aerospike.Key{k, dirKey}, [][]*Op{{MapGetOp("Ls", name)}, {GetOp("Expiring")}})
+		if err != nil {
+			return nil, false, err
+		}
+		var v interface{}
+		if records[0] != nil {
+			v = records[0].Bins["Ls"]
+		}
+		return v, records[1] != nil && records[1].Bins["Expiring"] != nil, nil
+	}
+	log.Detail("ASD: getEntry: MapGetByKeyOp(%v) %v", id, k)
+	r, err := f.asd.Operate(wp, k, MapGetOp("Ls", name))
+	if err != nil {
+		if err.Matches(aerospike.ErrKeyNotFound.ResultCode) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	return r.Bins["Ls"], false, nil
+}
+
+// ops updating the times of a directory whose entries changed
+func dirChangedOps() []*Op {
+	now := TimeToDB(time.Now())
+	return []*Op{PutOp("Mtime", now), PutOp("Ctime", now)}
+}
+
+// putEntry adds a new entry to a directory and updates the directory times, splitting the directory if it grew too large
+func (f *FS) putEntry(mrt *MRT, dir uint64, dirKey *aerospike.Key, name string, item *LsItem) aerospike.Error {
+	put := MapPutOp("Ls", name, item.ToAerospikeMap(), true)
+	shards, err := f.dirShards(mrt.Write(), mrt.Id(), dir, dirKey)
+	if err != nil {
+		return err
+	}
+	if shards == 0 {
+		log.Detail("ASD: putEntry: MapPutOp(%v) %v", mrt.Id(), dirKey)
+		r, err := f.asd.Operate(mrt.Write(), dirKey, append([]*Op{put}, dirChangedOps()...)...)
+		if err != nil {
+			return err
+		}
+		if size, _ := r.Bins["Ls"].(int); f.cfg.FS.DirShardThreshold > 0 && size > f.cfg.FS.DirShardThreshold {
+			return f.splitDir(mrt, dir, dirKey)
+		}
+		return nil
+	}
+	k, err := f.entryKey(dir, dirKey, shards, name)
+	if err != nil {
+		return err
+	}
+	// shard records may be created here, and expire with the directory
+	r, err := f.asd.Operate(mrt.Write(), dirKey, append(dirChangedOps(), GetOp("Expires"))...)
+	if err != nil {
+		return err
+	}
+	log.Detail("ASD: putEntry: MapPutOp(%v) %v", mrt.Id(), k)
+	_, err = f.asd.Operate(expiringPolicy(mrt.Write(), r.Bins["Expires"]), k, put)
+	return err
+}
+
+// removeEntry removes an entry from a directory and updates the directory times
+func (f *FS) removeEntry(mrt *MRT, dir uint64, dirKey *aerospike.Key, name string) aerospike.Error {
+	shards, err := f.dirShards(mrt.Write(), mrt.Id(), dir, dirKey)
+	if err != nil {
+		return err
+	}
+	remove := MapRemoveOp("Ls", name)
+	if shards == 0 {
+		log.Detail("ASD: removeEntry: MapRemoveByKeyOp(%v) %v", mrt.Id(), dirKey)
+		_, err = f.asd.Operate(mrt.Write(), dirKey, append([]*Op{remove}, dirChangedOps()...)...)
+		return err
+	}
+	k, err := f.entryKey(dir, dirKey, shards, name)
+	if err != nil {
+		return err
+	}
+	log.Detail("ASD: removeEntry: MapRemoveByKeyOp(%v) %v", mrt.Id(), k)
+	_, err = f.asd.Operate(mrt.Write(), k, remove)
+	if err != nil && !err.Matches(aerospike.ErrKeyNotFound.ResultCode) {
+		return err
+	}
+	_, err = f.asd.Operate(mrt.Write(), dirKey, dirChangedOps()...)
+	return err
+}
+
+// lsPairs returns the entries of a map bin value (e.g. `Ls`) in key order
+// key-ordered maps are returned by the client as []MapPair, unordered ones (created by older versions) as a map
+func lsPairs(v interface{}) []aerospike.MapPair {
+	switch ls := v.(type) {
+	case []aerospike.MapPair:
+		return ls
+	case map[interface{}]interface{}:
+		pairs := make([]aerospike.MapPair, 0, len(ls))
+		for n, v := range ls {
+			pairs = append(pairs, aerospike.MapPair{Key: n, Value: v})
+		}
+		slices.SortFunc(pairs, func(a, b aerospike.MapPair) int {
+			return strings.Compare(a.Key.(string), b.Key.(string))
+		})
+		return pairs
+	}
+	return nil
+}
+
+// splitDir moves the entries of an unsharded directory to shard records
+func (f *FS) splitDir(mrt *MRT, dir uint64, dirKey *aerospike.Key) aerospike.Error {
+	shards := f.cfg.FS.DirShards
+	log.Detail("ASD: splitDir: GetBinOp(%v) %v", mrt.Id(), dirKey)
+	r, err := f.asd.Operate(mrt.Write(), dirKey, GetOp("Ls"), GetOp("Expires"))
+	if err != nil {
+		return err
+	}
+	wp := expiringPolicy(mrt.Write(), r.Bins["Expires"])
+	split := make([]map[interface{}]interface{}, shards)
+	for _, e := range lsPairs(r.Bins["Ls"]) {
+		shard := shardOf(e.Key.(string), shards)
+		if split[shard] == nil {
+			split[shard] = make(map[interface{}]interface{})
+		}
+		split[shard][e.Key] = e.Value
+	}
+	log.Debug("Splitting directory %d into %d shards", dir, shards)
+	for shard, items := range split {
+		if items == nil {
+			// missing shard records read as empty
+			continue
+		}
+		k, err := f.shardKey(dir, shard)
+		if err != nil {
+			return err
+		}
+		log.Detail("ASD: splitDir: MapPutItemsOp(%v) %v", mrt.Id(), k)
+		_, err = f.asd.Operate(wp, k, MapPutItemsOp("Ls", items))
+		if err != nil {
+			return err
+		}
+	}
+	log.Detail("ASD: splitDir: PutBins(%v) %v", mrt.Id(), dirKey)
+	return f.asd.PutBins(mrt.Write(), dirKey, aerospike.NewBin("Shards", shards), aerospike.NewBin("Ls", nil))
+}
+
+// deleteShards deletes the shard records of a removed directory
+func (f *FS) deleteShards(mrt *MRT, dir uint64, shards int) aerospike.Error {
+	for shard := 0; shard < shards; shard++ {
+		k, err := f.shardKey(dir, shard)
+		if err != nil {
+			return err
+		}
+		log.Detail("ASD: deleteShards: Delete(%v) %v", mrt.Id(), k)
+		_, err = f.asd.Delete(mrt.Write(), k)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pageEntries returns up to count entries of an unsharded directory or of one shard of a sharded directory, in key order
+// the page starts after entry key after, or at the first entry if after is ""; after does not need to exist anymore
+func (f *FS) pageEntries(wp *aerospike.WritePolicy, id int64, dir uint64, dirKey *aerospike.Key, shards int, shard int, after string, count int) ([]aerospike.MapPair, aerospike.Error) {
+	k := dirKey
+	if shards > 0 {
+		var err aerospike.Error
+		k, err = f.shardKey(dir, shard)
+		if err != nil {
+			return nil, err
+		}
+	}
+	op := MapPageOp("Ls", nil, count)
+	if after != "" {
+		op = MapPageOp("Ls", after, count)
+	}
+	log.Detail("ASD: pageEntries: Operate(%v) %v after=%q count=%d", id, k, after, count)
+	r, err := f.asd.Operate(wp, k, op)
+	if err != nil {
+		if shards > 0 && err.Matches(aerospike.ErrKeyNotFound.ResultCode) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return lsPairs(r.Bins["Ls"]), nil
+}
+
+// dirEmpty returns whether a directory has no entries, not counting entries of expired inodes
+// it stops at the first entry found, paging one entry at a time through each shard
+func (f *FS) dirEmpty(wp *aerospike.WritePolicy, id int64, dir uint64, dirKey *aerospike.Key) (bool, error) {
+	shards, err := f.dirShards(wp, id, dir, dirKey)
+	if err != nil {
+		return false, err
+	}
+	expiring, err := f.mayExpire(&wp.BasePolicy, dirKey)
+	if err != nil {
+		return false, err
+	}
+	bp := GetBatchPolicyNoMRT(f.asd, &f.cfg.Aerospike.Timeouts)
+	bp.Txn = wp.Txn
+	for shard := 0; shard == 0 || shard < shards; shard++ {
+		after := ""
+		for {
+			entries, err := f.pageEntries(wp, id, dir, dirKey, shards, shard, after, 1)
+			if err != nil {
+				return false, err
+			}
+			if len(entries) == 0 {
+				break
+			}
+			if !expiring {
+				return false, nil
+			}
+			live, _, xerr := f.liveEntries(bp, entries)
+			if xerr != nil {
+				return false, xerr
+			}
+			if len(live) > 0 {
+				return false, nil
+			}
+			after = entries[0].Key.(string)
+		}
+	}
+	return true, nil
+}
+
+// dirent converts an `Ls` entry of directory dir to a fuse.Dirent
+func (f *FS) dirent(dir uint64, e aerospike.MapPair) (fuse.Dirent, error) {
+	name, err := f.plainName(dir, e.Key.(string))
+	if err != nil {
+		return fuse.Dirent{}, err
+	}
+	v := e.Value.(map[interface{}]interface{})
+	return fuse.Dirent{
+		Inode: uint64(v["Inode"].(int)),
+		Name:  name,
+		Type:  fuse.DirentType(v["Type"].(int)),
+	}, nil
+}
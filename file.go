@@ -16,11 +16,28 @@ func (f *File) truncate(mrt *MRT) error {
 		return syscall.EROFS
 	}
 	log.Detail("Truncating %d on request from flags", f.inode)
-	k, err := aerospike.NewKey(f.fs.cfg.Aerospike.Namespace, "fs", int(f.inode))
+	k, err := aerospike.NewKey(f.fs.cfg.Aerospike.Namespace, f.fs.cfg.setName("fs"), int(f.inode))
 	if err != nil {
 		return err
 	}
-	err = f.fs.asd.PutBins(mrt.Write(), k, aerospike.NewBin("data", []byte{}), aerospike.NewBin("Size", 0), aerospike.NewBin("Mtime", TimeToDB(time.Now())), aerospike.NewBin("Atime", TimeToDB(time.Now())))
+	xerr := f.fs.upgradeInline(mrt, f.inode)
+	if xerr != nil {
+		return xerr
+	}
+	r, err := f.fs.asd.Get(mrt.Read(), k, "Size", "BlockSize", "Blocks", "Counted")
+	if err != nil {
+		return err
+	}
+	_, xerr = f.fs.truncateBlocks(mrt, f.inode, r.Bins["BlockSize"].(int), r.Bins["Size"].(int), 0)
+	if xerr != nil {
+		return xerr
+	}
+	err = f.fs.addUsage(mrt, f.inode, r.Bins["Counted"], -r.Bins["Blocks"].(int)*r.Bins["BlockSize"].(int), 0)
+	if err != nil {
+		return err
+	}
+	now := TimeToDB(time.Now())
+	err = f.fs.asd.PutBins(mrt.Write(), k, aerospike.NewBin("Size", 0), aerospike.NewBin("Blocks", 0), aerospike.NewBin("Mtime", now), aerospike.NewBin("Ctime", now))
 	if err != nil {
 		return err
 	}
@@ -49,6 +66,9 @@ func (f *File) Attr(ctx context.Context, a *fuse.Attr) error {
 
 func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
 	log.Debug("Executing Open %d Flags:%v OpenFlags:%v", f.inode, req.Flags, req.OpenFlags)
+	if err := f.fs.checkAccess(f.inode, &req.Header, openPermissions(req.Flags)); err != nil {
+		return nil, err
+	}
 	resp.Flags = fuse.OpenDirectIO
 	if err := f.fs.fuse.InvalidateNodeData(f); err != nil && err != fuse.ErrNotCached {
 		log.Warn("invalidate error: %v", err)
@@ -59,7 +79,7 @@ func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenR
 		flags: req.Flags,
 	}
 	if req.Flags&fuse.OpenTruncate != 0 {
-		mrt := GetWritePolicy(f.fs.asd, &f.fs.cfg.Aerospike.Timeouts)
+		mrt := GetPolicies(f.fs.asd, &f.fs.cfg.Aerospike.Timeouts)
 		err := nHandle.truncate(mrt)
 		if err != nil {
 			mrt.Abort()
@@ -67,22 +87,57 @@ func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenR
 			return nil, syscall.EFAULT
 		}
 		mrt.Commit()
+	} else if !req.Flags.IsReadOnly() && !f.fs.cfg.MountParams.RO {
+		// files written by older versions keep their contents in the inode record, move those to blocks before writing
+		mrt := GetPolicies(f.fs.asd, &f.fs.cfg.Aerospike.Timeouts)
+		err := f.fs.upgradeInline(mrt, f.inode)
+		if err != nil {
+			mrt.Abort()
+			log.Error("Open: Failed to upgrade %d: %s", f.inode, err)
+			return nil, syscall.EFAULT
+		}
+		mrt.Commit()
+	}
+	err := f.fs.openInode(f.inode)
+	if err == syscall.ENOENT {
+		log.Detail("Open %d: not found", f.inode)
+		return nil, err
+	}
+	if err != nil {
+		log.Error("Open %d: %s", f.inode, err)
+		return nil, syscall.EFAULT
 	}
 	return nHandle, nil
 }
 
+func (f *File) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	log.Debug("Executing Release %d", f.inode)
+	if req.ReleaseFlags&fuse.ReleaseFlockUnlock != 0 {
+		err := f.fs.releaseLocks(f.inode, req.LockOwner, true)
+		if err != nil {
+			log.Error("Release %d: releasing locks: %s", f.inode, err)
+		}
+	}
+	err := f.fs.releaseInode(f.inode)
+	if err != nil {
+		log.Error("Release %d: %s", f.inode, err)
+		return syscall.EFAULT
+	}
+	return nil
+}
+
 func (f *File) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
 	log.Debug("Executing Read %d", f.inode)
 	if f.flags&fuse.OpenWriteOnly != 0 {
 		log.Debug("Read %d: opened write only", f.inode)
 		return syscall.EACCES
 	}
-	k, err := aerospike.NewKey(f.fs.cfg.Aerospike.Namespace, "fs", int(f.inode))
+	k, err := aerospike.NewKey(f.fs.cfg.Aerospike.Namespace, f.fs.cfg.setName("fs"), int(f.inode))
 	if err != nil {
 		log.Error("Inode %d Read: %s", f.inode, err)
 		return syscall.EFAULT
 	}
-	r, err := f.fs.asd.Get(GetReadPolicyNoMRT(f.fs.asd, &f.fs.cfg.Aerospike.Timeouts), k, "data")
+	r, err := f.fs.asd.Get(GetReadPolicyNoMRT(f.fs.asd, &f.fs.cfg.Aerospike.Timeouts), k, "Size", "BlockSize", "data", "Atime", "Mtime", "Ctime")
 	if err != nil {
 		if err.Matches(aerospike.ErrKeyNotFound.ResultCode) {
 			log.Detail("Inode %d Read: not found", f.inode)
@@ -91,7 +146,31 @@ func (f *File) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadR
 		log.Error("Inode %d Read: %s", f.inode, err)
 		return syscall.EFAULT
 	}
-	fuseutil.HandleRead(req, resp, r.Bins["data"].([]byte))
+	f.fs.touchAtime(f.inode, r.Bins)
+	// file not yet moved to blocks, data is in the inode record
+	if data, ok := r.Bins["data"].([]byte); ok {
+		fuseutil.HandleRead(req, resp, data)
+		return nil
+	}
+	size, ok := r.Bins["Size"].(int)
+	blockSize, ok2 := r.Bins["BlockSize"].(int)
+	if !ok || !ok2 {
+		log.Detail("Inode %d Read: not a complete inode", f.inode)
+		return syscall.ENOENT
+	}
+	// short read at EOF
+	offset := int(req.Offset)
+	if offset >= size {
+		resp.Data = resp.Data[:0]
+		return nil
+	}
+	n := min(req.Size, size-offset)
+	data, xerr := f.fs.readAt(GetBatchPolicyNoMRT(f.fs.asd, &f.fs.cfg.Aerospike.Timeouts), f.inode, blockSize, offset, n)
+	if xerr != nil {
+		log.Error("Inode %d Read: %s", f.inode, xerr)
+		return syscall.EFAULT
+	}
+	resp.Data = data
 	return nil
 }
 
@@ -110,17 +189,13 @@ func (f *File) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.Wri
 		log.Debug("Write %d: opened read only", f.inode)
 		return syscall.EACCES
 	}
-	k, err := aerospike.NewKey(f.fs.cfg.Aerospike.Namespace, "fs", int(f.inode))
+	k, err := aerospike.NewKey(f.fs.cfg.Aerospike.Namespace, f.fs.cfg.setName("fs"), int(f.inode))
 	if err != nil {
 		log.Error("Inode %d Write: %s", f.inode, err)
 		return syscall.EFAULT
 	}
 	mrt := GetPolicies(f.fs.asd, &f.fs.cfg.Aerospike.Timeouts)
-	binNames := []string{"Size"}
-	if f.flags&fuse.OpenAppend != 0 {
-		binNames = append(binNames, "data")
-	}
-	d, err := f.fs.asd.Get(mrt.Read(), k, binNames...)
+	d, err := f.fs.asd.Get(mrt.Read(), k, "Size", "BlockSize", "Blocks", "Expires", "Counted", "Mode")
 	if err != nil {
 		mrt.Abort()
 		if err.Matches(aerospike.ErrKeyNotFound.ResultCode) {
@@ -130,21 +205,57 @@ func (f *File) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.Wri
 		log.Error("Inode %d Write: %s", f.inode, err)
 		return syscall.EFAULT
 	}
-	data := req.Data
-	dataSize := len(req.Data)
-	// if flag OpenAppend
+	mrt.SetExpires(d.Bins["Expires"])
+	size, ok := d.Bins["Size"].(int)
+	blockSize, ok2 := d.Bins["BlockSize"].(int)
+	if !ok || !ok2 {
+		mrt.Abort()
+		log.Detail("Inode %d Write: not a complete inode", f.inode)
+		return syscall.ENOENT
+	}
+	blocks, _ := d.Bins["Blocks"].(int)
+	offset := int(req.Offset)
+	// if flag OpenAppend, write at the end as known to the cluster, the kernel offset may be stale
 	if f.flags&fuse.OpenAppend != 0 {
-		dataSize = d.Bins["Size"].(int) + dataSize
-		data = append(d.Bins["data"].([]byte), data...)
+		offset = size
+	}
+	newSize := max(size, offset+len(req.Data))
+	// extending the file grows the current last block, any gap before the written data stays a hole
+	if newSize > size {
+		_, xerr := f.fs.truncateBlocks(mrt, f.inode, blockSize, size, newSize)
+		if xerr != nil {
+			mrt.Abort()
+			log.Error("Inode %d Write: %s", f.inode, xerr)
+			return syscall.EFAULT
+		}
 	}
 	// store
-	err = f.fs.asd.PutBins(mrt.Write(), k, aerospike.NewBin("data", data), aerospike.NewBin("Size", dataSize), aerospike.NewBin("Mtime", TimeToDB(time.Now())), aerospike.NewBin("Atime", TimeToDB(time.Now())))
+	log.Detail("Inode %d Write: offset=%d size=%d", f.inode, offset, len(req.Data))
+	allocated, xerr := f.fs.writeAt(mrt, f.inode, blockSize, newSize, offset, req.Data)
+	if xerr != nil {
+		mrt.Abort()
+		log.Error("Inode %d Write: %s", f.inode, xerr)
+		return syscall.EFAULT
+	}
+	err = f.fs.addUsage(mrt, f.inode, d.Bins["Counted"], allocated*blockSize, 0)
 	if err != nil {
 		mrt.Abort()
 		log.Error("Inode %d Write: %s", f.inode, err)
 		return syscall.EFAULT
 	}
-	xerr := mrt.Commit()
+	now := TimeToDB(time.Now())
+	bins := []*aerospike.Bin{aerospike.NewBin("Size", newSize), aerospike.NewBin("Blocks", blocks+allocated), aerospike.NewBin("Mtime", now), aerospike.NewBin("Ctime", now)}
+	// writes by others than root drop setuid/setgid
+	if mode, _ := d.Bins["Mode"].(int); req.Header.Uid != 0 && killPrivMode(mode) != mode {
+		bins = append(bins, aerospike.NewBin("Mode", killPrivMode(mode)))
+	}
+	err = f.fs.asd.PutBins(mrt.Write(), k, bins...)
+	if err != nil {
+		mrt.Abort()
+		log.Error("Inode %d Write: %s", f.inode, err)
+		return syscall.EFAULT
+	}
+	xerr = mrt.Commit()
 	if xerr != nil {
 		log.Error("Inode %d Write: %s", f.inode, xerr)
 		return syscall.EFAULT
@@ -166,19 +277,23 @@ func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.Cr
 		log.Warn("invalidate error: %v", err)
 	}
 	// check if the file already exists
-	parentKey, err := aerospike.NewKey(d.fs.cfg.Aerospike.Namespace, "fs", int(d.inode))
+	parentKey, err := aerospike.NewKey(d.fs.cfg.Aerospike.Namespace, d.fs.cfg.setName("fs"), int(d.inode))
 	if err != nil {
 		log.Error("Parent %d Create '%s': %s", d.inode, req.Name, err)
 		return nil, nil, syscall.EFAULT
 	}
-	mrt := GetWritePolicy(d.fs.asd, &d.fs.cfg.Aerospike.Timeouts)
-	r, err := d.fs.asd.Operate(mrt.Write(), parentKey, aerospike.MapGetByKeyOp("Ls", req.Name, aerospike.MapReturnType.VALUE))
+	name, xerr := d.fs.storedName(d.inode, req.Name)
+	if xerr != nil {
+		log.Error("Parent %d Create '%s': %s", d.inode, req.Name, xerr)
+		return nil, nil, syscall.EFAULT
+	}
+	mrt := GetPolicies(d.fs.asd, &d.fs.cfg.Aerospike.Timeouts)
+	res, err := d.fs.getEntry(mrt.Write(), mrt.Id(), d.inode, parentKey, name)
 	if err != nil {
 		mrt.Abort()
 		log.Error("Parent %d Create '%s': %s", d.inode, req.Name, err)
 		return nil, nil, syscall.EFAULT
 	}
-	res := r.Bins["Ls"]
 	if res != nil {
 		// already exists
 		// if it's a dir, error
@@ -195,6 +310,10 @@ func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.Cr
 				inode: uint64(res.(map[interface{}]interface{})["Inode"].(int)),
 				flags: req.Flags,
 			}
+			if err := d.fs.checkAccess(nHandle.inode, &req.Header, openPermissions(req.Flags)); err != nil {
+				mrt.Abort()
+				return nil, nil, err
+			}
 			if req.Flags&fuse.OpenTruncate != 0 {
 				err := nHandle.truncate(mrt)
 				if err != nil {
@@ -203,34 +322,45 @@ func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.Cr
 				}
 			}
 			mrt.Commit()
+			xerr := d.fs.openInode(nHandle.inode)
+			if xerr == syscall.ENOENT {
+				return nil, nil, xerr
+			}
+			if xerr != nil {
+				log.Error("Parent %d Create '%s': %s", d.inode, req.Name, xerr)
+				return nil, nil, syscall.EFAULT
+			}
 			return nHandle, nHandle, nil
 		}
 		// file already exists: error
 		mrt.Abort()
 		return nil, nil, syscall.EEXIST
 	}
+	if err := d.fs.checkDirWrite(d.inode, &req.Header); err != nil {
+		mrt.Abort()
+		return nil, nil, err
+	}
 	// obtain new inode, advancing lastInode metadata record
-	newNode, xerr := d.fs.newInode(mrt.txn)
+	newNode, xerr := d.fs.newInode()
 	if xerr != nil {
 		mrt.Abort()
 		log.Error("Parent %d Create '%s': %s", d.inode, req.Name, xerr)
 		return nil, nil, syscall.EFAULT
 	}
 	// create new fs entry with new inode - our new file
-	kk, err := aerospike.NewKey(d.fs.cfg.Aerospike.Namespace, "fs", int(newNode))
+	kk, err := aerospike.NewKey(d.fs.cfg.Aerospike.Namespace, d.fs.cfg.setName("fs"), int(newNode))
 	if err != nil {
 		mrt.Abort()
 		log.Error("Parent %d Create '%s': %s", d.inode, req.Name, err)
 		return nil, nil, syscall.EFAULT
 	}
-	data := []byte{}
 	bins := make(aerospike.BinMap)
-	bins["data"] = data
 	bins["Atime"] = TimeToDB(time.Now())
 	bins["Ctime"] = bins["Atime"]
 	bins["Mtime"] = bins["Ctime"]
-	bins["BlockSize"] = 8 * 1024 * 1024
-	bins["Blocks"] = 1
+	bins["Crtime"] = bins["Ctime"]
+	bins["BlockSize"] = d.fs.cfg.FS.BlockSize
+	bins["Blocks"] = 0
 	bins["Gid"] = int(req.Gid)
 	bins["Uid"] = int(req.Uid)
 	bins["Size"] = 0
@@ -238,20 +368,35 @@ func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.Cr
 	bins["Nlink"] = 1
 	bins["Flags"] = 0
 	bins["Mode"] = int(req.Mode)
+	bins["Parents"] = newParents(d.inode, name)
+	err = d.fs.inheritedACL(mrt, parentKey, bins, false, req.Umask)
+	if err == nil {
+		err = d.fs.newInodeOwner(mrt, parentKey, bins, &req.Header)
+	}
+	if err == nil {
+		err = d.fs.newInodeTTL(mrt, parentKey, bins)
+	}
+	if err == nil {
+		err = d.fs.countNewInode(mrt, uint64(newNode), bins)
+	}
+	if err != nil {
+		mrt.Abort()
+		log.Error("Parent %d Create '%s': %s", d.inode, req.Name, err)
+		return nil, nil, syscall.EFAULT
+	}
 	log.Detail("Parent %d Create '%s': %v req.Umask:%d req.Flags:%v", d.inode, req.Name, bins, req.Umask, req.Flags)
-	err = d.fs.asd.Put(mrt.Write(), kk, bins)
+	err = d.fs.asd.Put(expiringPolicy(mrt.Write(), bins["Expires"]), kk, bins)
 	if err != nil {
 		mrt.Abort()
 		log.Error("Parent %d Create '%s': %s", d.inode, req.Name, err)
 		return nil, nil, syscall.EFAULT
 	}
 	// update `ls` of directory entry, indicating we have a new file there
-	mp := aerospike.NewMapPolicy(aerospike.MapOrder.KEY_ORDERED, aerospike.MapWriteMode.CREATE_ONLY)
 	lsVal := &LsItem{
 		Inode: uint64(newNode),
 		Type:  fuse.DT_File,
 	}
-	_, err = d.fs.asd.Operate(mrt.Write(), parentKey, aerospike.MapPutOp(mp, "Ls", req.Name, lsVal.ToAerospikeMap()), aerospike.PutOp(aerospike.NewBin("Mtime", TimeToDB(time.Now()))), aerospike.PutOp(aerospike.NewBin("Atime", TimeToDB(time.Now()))))
+	err = d.fs.putEntry(mrt, d.inode, parentKey, name, lsVal)
 	if err != nil {
 		mrt.Abort()
 		log.Error("Parent %d Create '%s': %s", d.inode, req.Name, err)
@@ -269,13 +414,113 @@ func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.Cr
 		inode: uint64(newNode),
 		flags: req.Flags,
 	}
+	xerr = d.fs.openInode(nHandle.inode)
+	if xerr != nil {
+		log.Error("Parent %d Create '%s': %s", d.inode, req.Name, xerr)
+		return nil, nil, syscall.EFAULT
+	}
 	return nHandle, nHandle, nil
 }
 
 func (f *File) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
 	log.Debug("Fsync called on %d, invalidating cache", f.inode)
+	f.fs.flushAtime(f.inode)
 	if err := f.fs.fuse.InvalidateNodeData(f); err != nil && err != fuse.ErrNotCached {
 		log.Warn("invalidate error: %v", err)
 	}
 	return nil
 }
+
+// FALLOC_FL_ZERO_RANGE, not exposed by the fuse package
+const fallocZeroRange fuse.FAllocateFlags = 0x10
+
+func (f *File) FAllocate(ctx context.Context, req *fuse.FAllocateRequest) error {
+	OpStart()
+	defer OpEnd()
+	if f.fs.cfg.MountParams.RO {
+		return syscall.EROFS
+	}
+	log.Debug("Executing FAllocate %d offset=%d length=%d mode=%v", f.inode, req.Offset, req.Length, req.Mode)
+	if f.flags == 0 {
+		log.Error("FAllocate %d: not a handle", f.inode)
+		return syscall.EBADF
+	}
+	keepSize := req.Mode&fuse.FAllocateKeepSize != 0
+	mode := req.Mode &^ fuse.FAllocateKeepSize
+	fill := fillAllocate
+	switch mode {
+	case 0:
+	case fuse.FAllocatePunchHole:
+		// the kernel only allows punching holes together with keep size
+		if !keepSize {
+			return syscall.EOPNOTSUPP
+		}
+		fill = fillPunch
+	case fallocZeroRange:
+		fill = fillZero
+	default:
+		return syscall.EOPNOTSUPP
+	}
+	k, err := aerospike.NewKey(f.fs.cfg.Aerospike.Namespace, f.fs.cfg.setName("fs"), int(f.inode))
+	if err != nil {
+		log.Error("Inode %d FAllocate: %s", f.inode, err)
+		return syscall.EFAULT
+	}
+	mrt := GetPolicies(f.fs.asd, &f.fs.cfg.Aerospike.Timeouts)
+	d, err := f.fs.asd.Get(mrt.Read(), k, "Size", "BlockSize", "Blocks", "Expires", "Counted")
+	if err != nil {
+		mrt.Abort()
+		if err.Matches(aerospike.ErrKeyNotFound.ResultCode) {
+			return syscall.ENOENT
+		}
+		log.Error("Inode %d FAllocate: %s", f.inode, err)
+		return syscall.EFAULT
+	}
+	mrt.SetExpires(d.Bins["Expires"])
+	size := d.Bins["Size"].(int)
+	blockSize := d.Bins["BlockSize"].(int)
+	blocks := d.Bins["Blocks"].(int)
+	offset := int(req.Offset)
+	end := offset + int(req.Length)
+	// with keep size, space past the end of file is not allocated, as blocks only ever hold data up to the file size
+	newSize := size
+	if !keepSize && end > size {
+		newSize = end
+		_, xerr := f.fs.truncateBlocks(mrt, f.inode, blockSize, size, newSize)
+		if xerr != nil {
+			mrt.Abort()
+			log.Error("Inode %d FAllocate: %s", f.inode, xerr)
+			return syscall.EFAULT
+		}
+	}
+	allocated, xerr := f.fs.fillRange(mrt, f.inode, blockSize, newSize, offset, end, fill)
+	if xerr != nil {
+		mrt.Abort()
+		log.Error("Inode %d FAllocate: %s", f.inode, xerr)
+		return syscall.EFAULT
+	}
+	err = f.fs.addUsage(mrt, f.inode, d.Bins["Counted"], allocated*blockSize, 0)
+	if err != nil {
+		mrt.Abort()
+		log.Error("Inode %d FAllocate: %s", f.inode, err)
+		return syscall.EFAULT
+	}
+	now := TimeToDB(time.Now())
+	bins := []*aerospike.Bin{aerospike.NewBin("Size", newSize), aerospike.NewBin("Blocks", blocks+allocated), aerospike.NewBin("Ctime", now)}
+	if fill != fillAllocate || newSize != size {
+		bins = append(bins, aerospike.NewBin("Mtime", now))
+	}
+	err = f.fs.asd.PutBins(mrt.Write(), k, bins...)
+	if err != nil {
+		mrt.Abort()
+		log.Error("Inode %d FAllocate: %s", f.inode, err)
+		return syscall.EFAULT
+	}
+	xerr = mrt.Commit()
+	if xerr != nil {
+		mrt.Abort()
+		log.Error("Inode %d FAllocate: %s", f.inode, xerr)
+		return syscall.EFAULT
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/aerospike/aerospike-client-go/v8"
+	"github.com/aerospike/aerospike-client-go/v8/types"
+)
+
+// the on-disk format is described by the meta/format record:
+//   - Version: the layout version of the records, upgraded by `asdfs migrate`; clients read all older layouts on the fly
+//   - Features: map of on-disk features in use, name -> featureIncompat / featureROCompat
+//
+// a client refuses to mount a filesystem using incompatible features it does not know, and mounts it read-only if
+// unknown features are only read-only compatible; filesystems without a format record were created before versioning
+// and are treated as version 1
+//
+// version 1: string times, inline file content in the inode record, unordered `Ls` maps
+// version 2: nanosecond integer times, content in block records, key-ordered `Ls` maps
+// version 3: parent links in `Parents` maps, directory link counts of 2 + subdirectories
+// version 4: usage counters in meta usage-* records, counted inodes marked with `Counted`, directories without blocks,
+// directories holding entries of expiring inodes marked with `Expiring`
+const formatVersion = 4
+
+const (
+	featureIncompat = "incompat" // clients not knowing the feature cannot read the filesystem
+	featureROCompat = "rocompat" // clients not knowing the feature can read, but not write the filesystem
+)
+
+// features known by this client
+var formatFeatures = map[string]string{
+	"blocks":      featureIncompat, // file content in block records, sparse files
+	"compression": featureIncompat, // encoded block records
+	"encryption":  featureIncompat, // encrypted block records, names and symlink targets
+	"dirshards":   featureIncompat, // directory entries in shard records
+	"nstimes":     featureIncompat, // integer nanosecond times
+	"parents":     featureROCompat, // parent links, kept up to date by writing clients
+	"xattrs":      featureROCompat, // xattr records, deleted with their inode by writing clients
+	"acls":        featureROCompat, // POSIX ACLs, kept in sync with the mode by writing clients
+	"usage":       featureROCompat, // usage counters, kept up to date by writing clients
+}
+
+func formatKey(c *Cfg) (*aerospike.Key, aerospike.Error) {
+	return aerospike.NewKey(c.Aerospike.Namespace, c.setName("meta"), "format")
+}
+
+// usedFeatures returns the features written by a client with this configuration
+func usedFeatures(c *Cfg, keys *keyring) map[interface{}]interface{} {
+	used := []string{"blocks", "dirshards", "nstimes", "parents", "xattrs", "acls", "usage"}
+	if comp, _ := compressionFromName(c.FS.Compression); comp != compNone {
+		used = append(used, "compression")
+	}
+	if keys != nil {
+		used = append(used, "encryption")
+	}
+	features := make(map[interface{}]interface{})
+	for _, name := range used {
+		features[name] = formatFeatures[name]
+	}
+	return features
+}
+
+// checkFormat verifies that this client understands the on-disk format, switching the mount to read-only if it can
+// only read it, records the features this client is going to write and registers the filesystem in the namespace
+func checkFormat(asd Backend, c *Cfg, keys *keyring) (version int, err error) {
+	k, err := formatKey(c)
+	if err != nil {
+		return 0, err
+	}
+	r, xerr := asd.Get(GetReadPolicyNoMRT(asd, &c.Aerospike.Timeouts), k)
+	if xerr != nil && !xerr.Matches(aerospike.ErrKeyNotFound.ResultCode) {
+		return 0, xerr
+	}
+	version = 1
+	if r != nil {
+		version = r.Bins["Version"].(int)
+		for _, e := range lsPairs(r.Bins["Features"]) {
+			name := e.Key.(string)
+			if _, ok := formatFeatures[name]; ok {
+				continue
+			}
+			if e.Value != featureROCompat {
+				return version, fmt.Errorf("filesystem uses feature %s, which is not supported by this version of asdfs", name)
+			}
+			if !c.MountParams.RO {
+				log.Warn("Filesystem uses feature %s, which is not supported by this version of asdfs, mounting read-only", name)
+				c.MountParams.RO = true
+				c.MountParams.RW = false
+			}
+		}
+	}
+	if version < formatVersion {
+		log.Warn("Filesystem format version %d is older than the current version %d, run `asdfs migrate` to upgrade it", version, formatVersion)
+	}
+	if c.MountParams.RO {
+		return version, nil
+	}
+	wp := GetWritePolicyNoMRT(asd, &c.Aerospike.Timeouts)
+	if r == nil {
+		wp.RecordExistsAction = aerospike.CREATE_ONLY
+		xerr = asd.PutBins(wp, k, aerospike.NewBin("Version", version))
+		if xerr != nil && !xerr.Matches(types.KEY_EXISTS_ERROR) {
+			return version, xerr
+		}
+		wp.RecordExistsAction = aerospike.UPDATE
+	}
+	_, xerr = asd.Operate(wp, k, MapPutItemsOp("Features", usedFeatures(c, keys)))
+	if xerr != nil {
+		return version, xerr
+	}
+	return version, registerFS(asd, c)
+}
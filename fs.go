@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	iofs "io/fs"
+	"sync"
 	"syscall"
 	"time"
 
@@ -12,9 +13,23 @@ import (
 )
 
 type FS struct {
-	fuse *fs.Server
-	asd  *aerospike.Client
-	cfg  *Cfg
+	fuse     *fs.Server
+	asd      Backend
+	cfg      *Cfg
+	keys     *keyring // nil if encryption is not configured
+	nameKeys sync.Map // directory inode -> id of the key encrypting its entry names
+	shards   sync.Map // directory inode -> shard count, for sharded directories only
+
+	mountId  string // id of the mount record of this mount
+	openLock sync.Mutex
+	open     map[uint64]*openCount // inode -> open handles of this mount
+	locked   sync.Map              // inode -> true, for inodes this mount holds file locks on
+	atimes   sync.Map              // inode -> access time (TimeToDB) not written yet, with lazytime
+	teardown sync.Once             // of unmounted
+
+	inodeLock sync.Mutex
+	nextInode int // next inode number to hand out, from the leased range
+	leaseEnd  int // last inode number of the leased range
 }
 
 type Dir struct {
@@ -28,8 +43,6 @@ type File struct {
 	flags fuse.OpenFlags
 }
 
-type Ls map[string]LsItem
-
 type LsItem struct {
 	Inode uint64
 	Type  fuse.DirentType
@@ -41,14 +54,6 @@ type Symlink struct {
 	flags fuse.OpenFlags
 }
 
-func (l *Ls) ToAerospikeMap() map[string]map[string]int {
-	ret := make(map[string]map[string]int)
-	for k, v := range *l {
-		ret[k] = v.ToAerospikeMap()
-	}
-	return ret
-}
-
 func (l *LsItem) ToAerospikeMap() map[string]int {
 	ret := make(map[string]int)
 	ret["Inode"] = int(l.Inode)
@@ -56,13 +61,21 @@ func (l *LsItem) ToAerospikeMap() map[string]int {
 	return ret
 }
 
-func TimeToDB(t time.Time) string {
-	return t.Format(time.RFC3339)
+// times are stored as nanoseconds since the epoch
+func TimeToDB(t time.Time) int64 {
+	return t.UnixNano()
 }
 
-func DBToTime(s string) time.Time {
-	t, _ := time.Parse(time.RFC3339, s)
-	return t
+// DBToTime also accepts the RFC3339 strings stored by older versions; missing times (e.g. Crtime of old inodes) are zero
+func DBToTime(v interface{}) time.Time {
+	switch t := v.(type) {
+	case int:
+		return time.Unix(0, int64(t))
+	case string:
+		parsed, _ := time.Parse(time.RFC3339, t)
+		return parsed
+	}
+	return time.Time{}
 }
 
 func (f *FS) Root() (fs.Node, error) {
@@ -77,7 +90,7 @@ func (f *FS) attr(ctx context.Context, a *fuse.Attr, inode uint64) error {
 		return nil
 	}
 	log.Debug("Getting attr for inode %d", inode)
-	k, err := aerospike.NewKey(f.cfg.Aerospike.Namespace, "fs", int64(inode))
+	k, err := aerospike.NewKey(f.cfg.Aerospike.Namespace, f.cfg.setName("fs"), int64(inode))
 	if err != nil {
 		log.Error("attr for %d: %s", inode, err)
 		return syscall.EFAULT
@@ -92,16 +105,24 @@ func (f *FS) attr(ctx context.Context, a *fuse.Attr, inode uint64) error {
 		return syscall.EFAULT
 	}
 	a.Inode = inode
-	a.Atime = DBToTime(r.Bins["Atime"].(string))
-	a.BlockSize = uint32(r.Bins["BlockSize"].(int))
-	a.Blocks = uint64(r.Bins["Blocks"].(int))
-	a.Ctime = DBToTime(r.Bins["Ctime"].(string))
+	a.Atime = DBToTime(r.Bins["Atime"])
+	if pending := f.pendingAtime(inode); pending.After(a.Atime) {
+		a.Atime = pending
+	}
+	// symlinks have no content blocks, nor a device
+	blockSize, _ := r.Bins["BlockSize"].(int)
+	blocks, _ := r.Bins["Blocks"].(int)
+	rdev, _ := r.Bins["Rdev"].(int)
+	a.BlockSize = uint32(blockSize)
+	// Blocks counts allocated blocks of BlockSize, the kernel expects 512-byte units
+	a.Blocks = uint64(blocks) * uint64(a.BlockSize) / 512
+	a.Ctime = DBToTime(r.Bins["Ctime"])
 	a.Flags = fuse.AttrFlags(uint32(r.Bins["Flags"].(int)))
 	a.Gid = uint32(r.Bins["Gid"].(int))
 	a.Mode = iofs.FileMode(uint32(r.Bins["Mode"].(int)))
-	a.Mtime = DBToTime(r.Bins["Mtime"].(string))
+	a.Mtime = DBToTime(r.Bins["Mtime"])
 	a.Nlink = uint32(r.Bins["Nlink"].(int))
-	a.Rdev = uint32(r.Bins["Rdev"].(int))
+	a.Rdev = uint32(rdev)
 	a.Size = uint64(r.Bins["Size"].(int))
 	a.Uid = uint32(r.Bins["Uid"].(int))
 	a.Valid = 1
@@ -114,39 +135,81 @@ func (f *FS) setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.S
 	}
 	log.Debug("Setattr on %d", inode)
 	bins := make(aerospike.BinMap)
+	now := time.Now()
 
-	key, err := aerospike.NewKey(f.cfg.Aerospike.Namespace, "fs", int(inode))
+	key, err := aerospike.NewKey(f.cfg.Aerospike.Namespace, f.cfg.setName("fs"), int(inode))
 	if err != nil {
 		log.Error("Setattr %d: %s", inode, err)
 		return syscall.EFAULT
 	}
-	mrt := GetWritePolicy(f.asd, &f.cfg.Aerospike.Timeouts)
+	mrt := GetPolicies(f.asd, &f.cfg.Aerospike.Timeouts)
+	if f.cfg.MountParams.Permissions == permsFilesystem {
+		r, err := f.asd.Get(mrt.Read(), key, "Mode", "Uid", "Gid", "AclAccess")
+		if err != nil {
+			mrt.Abort()
+			if err.Matches(aerospike.ErrKeyNotFound.ResultCode) {
+				return syscall.ENOENT
+			}
+			log.Error("Setattr %d: %s", inode, err)
+			return syscall.EFAULT
+		}
+		if err := setattrPermitted(r.Bins, req); err != nil {
+			mrt.Abort()
+			return err
+		}
+	}
 
-	// here a heavy op: truncate data
+	// here a heavy op: truncate data blocks
 	if req.Valid.Size() {
-		r, err := f.asd.Get(mrt.Read(), key, "data", "Size")
+		xerr := f.upgradeInline(mrt, inode)
+		if xerr != nil {
+			mrt.Abort()
+			log.Error("Setattr %d: %s", inode, xerr)
+			return syscall.EFAULT
+		}
+		r, err := f.asd.Get(mrt.Read(), key, "Size", "BlockSize", "Blocks", "Counted")
 		if err != nil {
 			mrt.Abort()
 			log.Error("Setattr %d: %s", inode, err)
 			return syscall.EFAULT
 		}
 		size := r.Bins["Size"].(int)
-		data := r.Bins["data"].([]byte)
-		if size > int(req.Size) {
-			data = data[:req.Size]
+		blockSize := r.Bins["BlockSize"].(int)
+		allocated, xerr := f.truncateBlocks(mrt, inode, blockSize, size, int(req.Size))
+		if xerr != nil {
+			mrt.Abort()
+			log.Error("Setattr %d: %s", inode, xerr)
+			return syscall.EFAULT
 		}
-		if size < int(req.Size) {
-			extended := make([]byte, req.Size)
-			copy(extended, data)
-			data = extended
+		err = f.addUsage(mrt, inode, r.Bins["Counted"], allocated*blockSize, 0)
+		if err != nil {
+			mrt.Abort()
+			log.Error("Setattr %d: %s", inode, err)
+			return syscall.EFAULT
 		}
 		bins["Size"] = int(req.Size)
-		bins["data"] = data
+		bins["Blocks"] = r.Bins["Blocks"].(int) + allocated
+		bins["Mtime"] = TimeToDB(now)
 	}
 
 	// normal ops
 	if req.Valid.Mode() {
 		bins["Mode"] = int(req.Mode)
+		// keep the access ACL mirroring the permission bits, chmod sets its mask
+		r, err := f.asd.Get(mrt.Read(), key, "AclAccess")
+		if err != nil {
+			mrt.Abort()
+			log.Error("Setattr %d: %s", inode, err)
+			return syscall.EFAULT
+		}
+		if v, ok := r.Bins["AclAccess"].([]byte); ok {
+			entries, xerr := parseACL(v)
+			if xerr != nil {
+				log.Warn("Setattr %d: invalid stored ACL: %s", inode, xerr)
+			} else {
+				bins["AclAccess"] = encodeACL(aclWithMode(entries, uint32(req.Mode)))
+			}
+		}
 	}
 	if req.Valid.Uid() {
 		bins["Uid"] = int(req.Uid)
@@ -154,11 +217,31 @@ func (f *FS) setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.S
 	if req.Valid.Gid() {
 		bins["Gid"] = int(req.Gid)
 	}
-	bins["Ctime"] = TimeToDB(time.Now())
+	// a change of owner drops setuid/setgid, unless the mode is set at the same time
+	if (req.Valid.Uid() || req.Valid.Gid()) && !req.Valid.Mode() {
+		r, err := f.asd.Get(mrt.Read(), key, "Mode")
+		if err != nil {
+			mrt.Abort()
+			log.Error("Setattr %d: %s", inode, err)
+			return syscall.EFAULT
+		}
+		if mode := r.Bins["Mode"].(int); killPrivMode(mode) != mode {
+			bins["Mode"] = killPrivMode(mode)
+		}
+	}
+	bins["Ctime"] = TimeToDB(now)
 	if req.Valid.Atime() {
+		// an access time set explicitly replaces any pending one
+		f.atimes.Delete(inode)
+	}
+	if req.Valid.AtimeNow() {
+		bins["Atime"] = TimeToDB(now)
+	} else if req.Valid.Atime() {
 		bins["Atime"] = TimeToDB(req.Atime)
 	}
-	if req.Valid.Mtime() {
+	if req.Valid.MtimeNow() {
+		bins["Mtime"] = TimeToDB(now)
+	} else if req.Valid.Mtime() {
 		bins["Mtime"] = TimeToDB(req.Mtime)
 	}
 	err = f.asd.Put(mrt.Write(), key, bins)
@@ -178,28 +261,28 @@ func (f *FS) setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.S
 	return nil
 }
 
-func (f *FS) newInode(txn *aerospike.Txn) (newNode int, err error) {
-	log.Detail("Getting new inode allocation")
-	k, err := aerospike.NewKey(f.cfg.Aerospike.Namespace, "meta", "lastInode")
-	if err != nil {
-		return -1, err
-	}
-	rp := aerospike.NewPolicy()
-	rp.Txn = txn
-
-	lastInode, err := f.asd.Get(rp, k)
-	if err != nil {
-		return -1, err
-	}
-	newNode = lastInode.Bins["lastInode"].(int)
-	newNode++
-
-	wp := aerospike.NewWritePolicy(0, 0)
-	wp.Txn = txn
-	err = f.asd.PutBins(wp, k, aerospike.NewBin("lastInode", newNode))
-	if err != nil {
-		return -1, err
+// newInode hands out the next inode number from the range leased by this mount, leasing a new range when it runs out
+// ranges are leased by an atomic increment of meta/lastInode outside of any transaction, so that concurrent creates
+// on different mounts do not conflict; numbers left unused when unmounting or aborting a transaction are never reused
+func (f *FS) newInode() (newNode int, err error) {
+	f.inodeLock.Lock()
+	defer f.inodeLock.Unlock()
+	if f.nextInode == 0 || f.nextInode > f.leaseEnd {
+		log.Detail("Leasing %d inodes", f.cfg.FS.InodeLease)
+		k, err := aerospike.NewKey(f.cfg.Aerospike.Namespace, f.cfg.setName("meta"), "lastInode")
+		if err != nil {
+			return -1, err
+		}
+		r, err := f.asd.Operate(GetWritePolicyNoMRT(f.asd, &f.cfg.Aerospike.Timeouts), k, AddOp("lastInode", f.cfg.FS.InodeLease), GetOp("lastInode"))
+		if err != nil {
+			return -1, err
+		}
+		f.leaseEnd = r.Bins["lastInode"].(int)
+		f.nextInode = f.leaseEnd - f.cfg.FS.InodeLease + 1
+		log.Detail("Leased inodes %d-%d", f.nextInode, f.leaseEnd)
 	}
+	newNode = f.nextInode
+	f.nextInode++
 	log.Detail("New inode: %d", newNode)
 	return newNode, nil
 }
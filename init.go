@@ -1,6 +1,7 @@
 package main
 
 import (
+	"compress/flate"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
@@ -8,6 +9,7 @@ import (
 	"io"
 	iofs "io/fs"
 	"os"
+	"regexp"
 	"strings"
 	"time"
 
@@ -16,6 +18,7 @@ import (
 )
 
 type Cfg struct {
+	Backend   string `yaml:"backend"`
 	Aerospike struct {
 		Host      string `yaml:"host"`
 		Port      int    `yaml:"port"`
@@ -34,7 +37,19 @@ type Cfg struct {
 		Timeouts cfgTimeout `yaml:"timeouts"`
 	} `yaml:"aerospike"`
 	FS struct {
-		RootMode uint32 `yaml:"rootMode"`
+		Name              string        `yaml:"name"`
+		RootMode          uint32        `yaml:"rootMode"`
+		BlockSize         int           `yaml:"blockSize"`
+		Compression       string        `yaml:"compression"`
+		CompressionLevel  int           `yaml:"compressionLevel"`
+		DirShardThreshold int           `yaml:"dirShardThreshold"`
+		DirShards         int           `yaml:"dirShards"`
+		InodeLease        int           `yaml:"inodeLease"`
+		TTL               time.Duration `yaml:"ttl"`
+		Encryption        struct {
+			KeyFile string `yaml:"keyFile"`
+			Names   bool   `yaml:"names"`
+		} `yaml:"encryption"`
 	} `yaml:"fs"`
 	MountDir string `yaml:"mountDir"`
 	Log      struct {
@@ -44,9 +59,15 @@ type Cfg struct {
 		File   string `yaml:"file"`
 	} `yaml:"log"`
 	MountParams struct {
-		RW    bool `yaml:"rw"`
-		RO    bool `yaml:"ro"`
-		Debug bool `yaml:"debug"`
+		RW          bool   `yaml:"rw"`
+		RO          bool   `yaml:"ro"`
+		Debug       bool   `yaml:"debug"`
+		Permissions string `yaml:"permissions"`
+		AllowOther  bool   `yaml:"allowOther"`
+		AllowDev    bool   `yaml:"allowDev"`
+		LocalLocks  bool   `yaml:"localLocks"`
+		Atime       string `yaml:"atime"`
+		Lazytime    bool   `yaml:"lazytime"`
 	} `yaml:"mountParams"`
 }
 
@@ -77,6 +98,13 @@ func NewConfig(conf io.Reader) (*Cfg, error) {
 	if err != nil {
 		return nil, err
 	}
+	switch config.Backend {
+	case "":
+		config.Backend = "aerospike"
+	case "aerospike", "memory":
+	default:
+		return nil, fmt.Errorf("backend %s not supported", config.Backend)
+	}
 	if config.Aerospike.Timeouts.Socket == 0 {
 		config.Aerospike.Timeouts.Socket = 30 * time.Second
 	}
@@ -92,20 +120,88 @@ func NewConfig(conf io.Reader) (*Cfg, error) {
 	if config.Aerospike.Timeouts.Login == 0 {
 		config.Aerospike.Timeouts.Login = 60 * time.Second
 	}
+	if err := checkFSName(config.FS.Name); err != nil {
+		return nil, err
+	}
+	switch config.MountParams.Permissions {
+	case "":
+		config.MountParams.Permissions = permsFilesystem
+	case permsFilesystem, permsKernel, permsNone:
+	default:
+		return nil, fmt.Errorf("mountParams.permissions %s not supported", config.MountParams.Permissions)
+	}
+	switch config.MountParams.Atime {
+	case "":
+		config.MountParams.Atime = atimeRel
+	case atimeNo, atimeRel, atimeStrict:
+	default:
+		return nil, fmt.Errorf("mountParams.atime %s not supported", config.MountParams.Atime)
+	}
 	if config.FS.RootMode == 0 {
 		config.FS.RootMode = 0o755
 	}
+	if config.FS.BlockSize == 0 {
+		config.FS.BlockSize = 1024 * 1024
+	} else if config.FS.BlockSize < 0 || config.FS.BlockSize > maxBlockSize {
+		return nil, fmt.Errorf("fs.blockSize must be between 1 and %d bytes", maxBlockSize)
+	}
+	if config.FS.Compression == "" {
+		config.FS.Compression = "none"
+	}
+	if _, err := compressionFromName(config.FS.Compression); err != nil {
+		return nil, err
+	}
+	if config.FS.CompressionLevel == 0 {
+		config.FS.CompressionLevel = flate.DefaultCompression
+	} else if config.FS.CompressionLevel < flate.HuffmanOnly || config.FS.CompressionLevel > flate.BestCompression {
+		return nil, fmt.Errorf("fs.compressionLevel must be between %d and %d", flate.HuffmanOnly, flate.BestCompression)
+	}
+	if config.FS.DirShardThreshold == 0 {
+		config.FS.DirShardThreshold = 10000
+	}
+	if config.FS.DirShards == 0 {
+		config.FS.DirShards = 256
+	} else if config.FS.DirShards < 0 {
+		return nil, errors.New("fs.dirShards must be positive")
+	}
+	if config.FS.InodeLease == 0 {
+		config.FS.InodeLease = 1000
+	} else if config.FS.InodeLease < 0 {
+		return nil, errors.New("fs.inodeLease must be positive")
+	}
+	if config.FS.TTL < 0 {
+		return nil, errors.New("fs.ttl must not be negative")
+	}
 	if config.Log.Level == 0 {
 		config.Log.Level = 3
 	} else if config.Log.Level == -1 {
 		config.Log.Level = 0
 	}
-	if !config.Log.Kmesg && !config.Log.Stderr && !config.Log.Stderr {
+	if !config.Log.Kmesg && !config.Log.Stderr {
 		config.Log.Kmesg = true
 	}
 	return config, nil
 }
 
+// filesystem names prefix set names, so they are kept short and free of separators
+var fsNameRegexp = regexp.MustCompile(`^[A-Za-z0-9-]{0,32}$`)
+
+func checkFSName(name string) error {
+	if !fsNameRegexp.MatchString(name) {
+		return fmt.Errorf("fs.name %q must be up to 32 letters, digits or dashes", name)
+	}
+	return nil
+}
+
+// setName returns the name of set set of the configured filesystem; the default (unnamed) filesystem uses the bare
+// set names, named filesystems prefix them with "name_"
+func (c *Cfg) setName(set string) string {
+	if c.FS.Name == "" {
+		return set
+	}
+	return c.FS.Name + "_" + set
+}
+
 // build TLS configuration
 func buildTLSConfig(tlsName string, caFile string, certFile string, keyFile string) (*tls.Config, error) {
 	nTLS := new(tls.Config)
@@ -128,7 +224,12 @@ func buildTLSConfig(tlsName string, caFile string, certFile string, keyFile stri
 	return nTLS, nil
 }
 
-func Connect(c *Cfg) (*aerospike.Client, error) {
+// openBackend opens the configured storage backend
+func openBackend(c *Cfg) (Backend, error) {
+	if c.Backend == "memory" {
+		log.Warn("Using the in-memory backend, the filesystem is lost on unmount")
+		return newMemBackend(), nil
+	}
 	// we can add policy items for timeout, retries, creation of sindexes, etc, everything init goes here
 	cp := aerospike.NewClientPolicy()
 	cp.Timeout = c.Aerospike.Timeouts.Connect
@@ -154,13 +255,21 @@ func Connect(c *Cfg) (*aerospike.Client, error) {
 		}
 		cp.TlsConfig = tlsConfig
 	}
-	asd, err := aerospike.NewClientWithPolicy(cp, c.Aerospike.Host, c.Aerospike.Port)
+	client, err := aerospike.NewClientWithPolicy(cp, c.Aerospike.Host, c.Aerospike.Port)
+	if err != nil {
+		return nil, err
+	}
+	return &asdBackend{client}, nil
+}
+
+func Connect(c *Cfg, keys *keyring) (Backend, error) {
+	asd, err := openBackend(c)
 	if err != nil {
 		return nil, err
 	}
 	log.Debug("Connected, checking whether filesystem is initialized")
 	// get root entry, and if it doesn't exist, create it to initialize the filesystem
-	kk, err := aerospike.NewKey(c.Aerospike.Namespace, "fs", 1)
+	kk, err := aerospike.NewKey(c.Aerospike.Namespace, c.setName("fs"), 1)
 	if err != nil {
 		return nil, err
 	}
@@ -176,21 +285,23 @@ func Connect(c *Cfg) (*aerospike.Client, error) {
 		return asd, nil
 	}
 	log.Debug("Initializing filesystem")
-	files := make(Ls)
+	// the `Ls` map is created (key-ordered) by the first entry added
 	bins := make(aerospike.BinMap)
-	bins["Ls"] = files.ToAerospikeMap()
 	bins["Atime"] = TimeToDB(time.Now())
 	bins["Ctime"] = bins["Atime"]
 	bins["Mtime"] = bins["Ctime"]
-	bins["BlockSize"] = 8 * 1024 * 1024
-	bins["Blocks"] = 1
+	bins["Crtime"] = bins["Ctime"]
+	bins["BlockSize"] = c.FS.BlockSize
+	bins["Blocks"] = 0 // entries are kept in the inode and shard records, there is no content
 	bins["Gid"] = 0
 	bins["Uid"] = 0
-	bins["Size"] = 8 * 1024 * 1024 // blocks * blocksize
+	bins["Size"] = 0
 	bins["Rdev"] = 0
-	bins["Nlink"] = 1                                          // always 1 for root entry
+	bins["Nlink"] = 2                                          // 2 + subdirectories, like any directory
 	bins["Flags"] = 0                                          // no flags for root entry
 	bins["Mode"] = iofs.ModeDir | iofs.FileMode(c.FS.RootMode) // default mode for root entry 0o755 ?
+	bins["NameKey"] = newNameKey(c, keys)
+	bins["Counted"] = 1
 	wp := mrt.Write()
 	wp.RecordExistsAction = aerospike.CREATE_ONLY
 	err = asd.Put(wp, kk, bins)
@@ -198,7 +309,7 @@ func Connect(c *Cfg) (*aerospike.Client, error) {
 		mrt.Abort()
 		return asd, err
 	}
-	k, err := aerospike.NewKey(c.Aerospike.Namespace, "meta", "lastInode")
+	k, err := aerospike.NewKey(c.Aerospike.Namespace, c.setName("meta"), "lastInode")
 	if err != nil {
 		mrt.Abort()
 		return asd, err
@@ -208,6 +319,27 @@ func Connect(c *Cfg) (*aerospike.Client, error) {
 		mrt.Abort()
 		return asd, err
 	}
+	// the root directory is the first counted inode
+	k, err = usageKey(c, 1)
+	if err != nil {
+		mrt.Abort()
+		return asd, err
+	}
+	_, err = asd.Operate(mrt.Write(), k, AddOp("Inodes", 1))
+	if err != nil {
+		mrt.Abort()
+		return asd, err
+	}
+	k, err = formatKey(c)
+	if err != nil {
+		mrt.Abort()
+		return asd, err
+	}
+	err = asd.PutBins(wp, k, aerospike.NewBin("Version", formatVersion), aerospike.NewBin("Features", usedFeatures(c, keys)))
+	if err != nil {
+		mrt.Abort()
+		return asd, err
+	}
 	xerr := mrt.Commit()
 	if xerr != nil {
 		mrt.Abort()
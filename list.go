@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aerospike/aerospike-client-go/v8"
+	"github.com/aerospike/aerospike-client-go/v8/types"
+)
+
+// filesystems of a namespace are listed in the "Names" map bin of the asdfs/filesystems record, name -> time of
+// registration; a filesystem registers itself on its first read-write mount by a client knowing filesystem names
+// (the default, unnamed filesystem is listed as "")
+
+func registryKey(c *Cfg) (*aerospike.Key, aerospike.Error) {
+	return aerospike.NewKey(c.Aerospike.Namespace, "asdfs", "filesystems")
+}
+
+// registerFS adds the configured filesystem to the registry, if it is not listed yet
+func registerFS(asd Backend, c *Cfg) error {
+	k, err := registryKey(c)
+	if err != nil {
+		return err
+	}
+	_, err = asd.Operate(GetWritePolicyNoMRT(asd, &c.Aerospike.Timeouts), k, MapPutOp("Names", c.FS.Name, TimeToDB(time.Now()), true))
+	if err != nil && !err.Matches(types.FAIL_ELEMENT_EXISTS) {
+		return err
+	}
+	return nil
+}
+
+// listCmd prints the filesystems present in the namespace of the configuration file
+func listCmd(args []string) {
+	if len(args) < 1 {
+		fmt.Printf("Usage: %s list /path/to/config.yaml\n", os.Args[0])
+		os.Exit(1)
+	}
+	c, err := NewConfigFromFile(args[0])
+	if err != nil {
+		log.Critical("%s", err)
+	}
+	log.SetLogLevel(c.Log.Level)
+	log.SetPrefix("asd-fs: ")
+	asd, err := openBackend(c)
+	if err != nil {
+		log.Critical("%s", err)
+	}
+	defer asd.Close()
+	k, err := registryKey(c)
+	if err != nil {
+		log.Critical("%s", err)
+	}
+	names := []aerospike.MapPair{}
+	r, xerr := asd.Get(GetReadPolicyNoMRT(asd, &c.Aerospike.Timeouts), k, "Names")
+	if xerr != nil && !xerr.Matches(aerospike.ErrKeyNotFound.ResultCode) {
+		log.Critical("%s", xerr)
+	}
+	if r != nil {
+		names = lsPairs(r.Bins["Names"])
+	}
+	// the default filesystem may predate the registry
+	if len(names) == 0 || names[0].Key != "" {
+		c.FS.Name = ""
+		rk, err := aerospike.NewKey(c.Aerospike.Namespace, c.setName("fs"), 1)
+		if err != nil {
+			log.Critical("%s", err)
+		}
+		exists, xerr := asd.Exists(GetReadPolicyNoMRT(asd, &c.Aerospike.Timeouts), rk)
+		if xerr != nil {
+			log.Critical("%s", xerr)
+		}
+		if exists {
+			names = append([]aerospike.MapPair{{Key: "", Value: nil}}, names...)
+		}
+	}
+	fmt.Printf("%-32s %-7s %s\n", "NAME", "FORMAT", "REGISTERED")
+	for _, e := range names {
+		c.FS.Name = e.Key.(string)
+		fk, err := formatKey(c)
+		if err != nil {
+			log.Critical("%s", err)
+		}
+		version := "1"
+		fr, xerr := asd.Get(GetReadPolicyNoMRT(asd, &c.Aerospike.Timeouts), fk, "Version")
+		if xerr == nil {
+			version = fmt.Sprint(fr.Bins["Version"])
+		} else if !xerr.Matches(aerospike.ErrKeyNotFound.ResultCode) {
+			log.Critical("%s", xerr)
+		}
+		name := c.FS.Name
+		if name == "" {
+			name = "(default)"
+		}
+		registered := "-"
+		if e.Value != nil {
+			registered = DBToTime(e.Value).Format(time.RFC3339)
+		}
+		fmt.Printf("%-32s %-7s %s\n", name, version, registered)
+	}
+}
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/aerospike/aerospike-client-go/v8"
+	"github.com/aerospike/aerospike-client-go/v8/types"
+)
+
+// file locks (flock and POSIX byte range locks) are held cluster wide: the locks of an inode are listed in the "Locks"
+// bin of its record in the "locks" set, and inodes having locks in the "Inodes" map of the meta/locks record
+// every lock records the mount holding it, and is considered released once that mount is no longer alive (see
+// mounts.go), so locks of crashed mounts expire with their heartbeat and are dropped by the next change of the inode locks
+// with mountParams.localLocks the kernel keeps locks local to each client instead
+
+// polling interval of blocking lock requests, doubling up to the maximum
+const (
+	lockWaitMin = 50 * time.Millisecond
+	lockWaitMax = time.Second
+)
+
+type fileLock struct {
+	Mount string
+	Owner fuse.LockOwner // kernel id of the holder, per process for POSIX locks and per open file for flock
+	Pid   int32
+	Start uint64
+	End   uint64
+	Type  fuse.LockType
+	Flock bool
+	Since time.Time
+}
+
+func (l *fileLock) toBin() map[string]interface{} {
+	flock := 0
+	if l.Flock {
+		flock = 1
+	}
+	return map[string]interface{}{
+		"Mount": l.Mount,
+		"Owner": int(l.Owner),
+		"Pid":   int(l.Pid),
+		"Start": int(l.Start),
+		"End":   int(l.End),
+		"Type":  int(l.Type),
+		"Flock": flock,
+		"Since": TimeToDB(l.Since),
+	}
+}
+
+func fileLockFromBin(v interface{}) fileLock {
+	m := v.(map[interface{}]interface{})
+	return fileLock{
+		Mount: m["Mount"].(string),
+		Owner: fuse.LockOwner(m["Owner"].(int)),
+		Pid:   int32(m["Pid"].(int)),
+		Start: uint64(m["Start"].(int)),
+		End:   uint64(m["End"].(int)),
+		Type:  fuse.LockType(m["Type"].(int)),
+		Flock: m["Flock"].(int) == 1,
+		Since: DBToTime(m["Since"]),
+	}
+}
+
+// sameHolder returns whether two locks belong to the same holder, whose locks replace each other instead of conflicting
+func (l *fileLock) sameHolder(o *fileLock) bool {
+	return l.Mount == o.Mount && l.Owner == o.Owner && l.Flock == o.Flock
+}
+
+// conflicts returns whether the lock cannot be held together with another; flock and POSIX locks are independent
+func (l *fileLock) conflicts(o *fileLock) bool {
+	if l.sameHolder(o) || l.Flock != o.Flock {
+		return false
+	}
+	if l.Type != fuse.LockWrite && o.Type != fuse.LockWrite {
+		return false
+	}
+	return l.Start <= o.End && o.Start <= l.End
+}
+
+// applyLock returns the locks after the holder of lk takes it (or releases its range, for LockUnlock); the holder's
+// own locks overlapping the range are cut back, as the new lock replaces them
+func applyLock(locks []fileLock, lk fileLock) []fileLock {
+	ret := []fileLock{}
+	for _, l := range locks {
+		if !l.sameHolder(&lk) || l.End < lk.Start || lk.End < l.Start {
+			ret = append(ret, l)
+			continue
+		}
+		if l.Start < lk.Start {
+			head := l
+			head.End = lk.Start - 1
+			ret = append(ret, head)
+		}
+		if l.End > lk.End {
+			tail := l
+			tail.Start = lk.End + 1
+			ret = append(ret, tail)
+		}
+	}
+	if lk.Type != fuse.LockUnlock {
+		ret = append(ret, lk)
+	}
+	return ret
+}
+
+func (f *FS) locksKey(inode uint64) (*aerospike.Key, aerospike.Error) {
+	return aerospike.NewKey(f.cfg.Aerospike.Namespace, f.cfg.setName("locks"), int(inode))
+}
+
+func (f *FS) locksIndexKey() (*aerospike.Key, aerospike.Error) {
+	return aerospike.NewKey(f.cfg.Aerospike.Namespace, f.cfg.setName("meta"), "locks")
+}
+
+// liveLocks returns the locks of a "Locks" bin value held by mounts still alive
+func (f *FS) liveLocks(v interface{}) ([]fileLock, error) {
+	list, _ := v.([]interface{})
+	alive := make(map[string]bool)
+	locks := []fileLock{}
+	for _, e := range list {
+		l := fileLockFromBin(e)
+		live, ok := alive[l.Mount]
+		if !ok {
+			var err error
+			live, err = f.mountAlive(l.Mount)
+			if err != nil {
+				return nil, err
+			}
+			alive[l.Mount] = live
+		}
+		if live {
+			locks = append(locks, l)
+		} else {
+			log.Detail("Dropping lock %v of dead mount %s", e, l.Mount)
+		}
+	}
+	return locks, nil
+}
+
+// getLocks returns the live locks of an inode
+func (f *FS) getLocks(inode uint64) ([]fileLock, error) {
+	k, err := f.locksKey(inode)
+	if err != nil {
+		return nil, err
+	}
+	r, err := f.asd.Get(GetReadPolicyNoMRT(f.asd, &f.cfg.Aerospike.Timeouts), k, "Locks")
+	if err != nil {
+		if err.Matches(aerospike.ErrKeyNotFound.ResultCode) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return f.liveLocks(r.Bins["Locks"])
+}
+
+// updateLocks changes the locks of an inode in a transaction, retrying when it conflicts with a concurrent change
+// update gets the live locks and returns the new ones, or an error to leave them unchanged
+func (f *FS) updateLocks(inode uint64, update func([]fileLock) ([]fileLock, error)) error {
+	var err error
+	for i := 0; i < blockedRetries; i++ {
+		err = f.tryUpdateLocks(inode, update)
+		if aerr, ok := err.(aerospike.Error); !ok || !aerr.Matches(types.MRT_BLOCKED, types.MRT_VERSION_MISMATCH) {
+			return err
+		}
+		time.Sleep(blockedBackoff)
+	}
+	return err
+}
+
+func (f *FS) tryUpdateLocks(inode uint64, update func([]fileLock) ([]fileLock, error)) error {
+	k, err := f.locksKey(inode)
+	if err != nil {
+		return err
+	}
+	ik, err := f.locksIndexKey()
+	if err != nil {
+		return err
+	}
+	mrt := GetPolicies(f.asd, &f.cfg.Aerospike.Timeouts)
+	log.Detail("ASD: updateLocks: Get(%v) %v", mrt.Id(), k)
+	r, err := f.asd.Get(mrt.Read(), k, "Locks")
+	if err != nil && !err.Matches(aerospike.ErrKeyNotFound.ResultCode) {
+		mrt.Abort()
+		return err
+	}
+	existed := err == nil
+	var locks []fileLock
+	if existed {
+		live, xerr := f.liveLocks(r.Bins["Locks"])
+		if xerr != nil {
+			mrt.Abort()
+			return xerr
+		}
+		locks = live
+	}
+	locks, xerr := update(locks)
+	if xerr != nil {
+		mrt.Abort()
+		return xerr
+	}
+	if len(locks) == 0 {
+		if existed {
+			log.Detail("ASD: updateLocks: Delete(%v) %v", mrt.Id(), k)
+			_, err = f.asd.Delete(mrt.Write(), k)
+			if err == nil {
+				log.Detail("ASD: updateLocks: MapRemoveOp(%v) %v %d", mrt.Id(), ik, inode)
+				_, err = f.asd.Operate(mrt.Write(), ik, MapRemoveOp("Inodes", int(inode)))
+				if err != nil && err.Matches(aerospike.ErrKeyNotFound.ResultCode) {
+					err = nil
+				}
+			}
+		}
+	} else {
+		list := []interface{}{}
+		for _, l := range locks {
+			list = append(list, l.toBin())
+		}
+		log.Detail("ASD: updateLocks: PutBins(%v) %v", mrt.Id(), k)
+		err = f.asd.PutBins(mrt.Write(), k, aerospike.NewBin("Locks", list))
+		if err == nil && !existed {
+			log.Detail("ASD: updateLocks: MapPutOp(%v) %v %d", mrt.Id(), ik, inode)
+			_, err = f.asd.Operate(mrt.Write(), ik, MapPutOp("Inodes", int(inode), 1, false))
+		}
+	}
+	if err != nil {
+		mrt.Abort()
+		return err
+	}
+	xerr = mrt.Commit()
+	if xerr != nil {
+		mrt.Abort()
+		return xerr
+	}
+	// remember the inodes this mount holds locks on, to release them on close and unmount
+	held := false
+	for _, l := range locks {
+		held = held || l.Mount == f.mountId
+	}
+	if held {
+		f.locked.Store(inode, true)
+	} else {
+		f.locked.Delete(inode)
+	}
+	return nil
+}
+
+// setLock takes (or with type LockUnlock releases) a lock, failing with EAGAIN if another holder has a conflicting lock
+func (f *FS) setLock(inode uint64, lk fileLock) error {
+	return f.updateLocks(inode, func(locks []fileLock) ([]fileLock, error) {
+		if lk.Type != fuse.LockUnlock {
+			for i := range locks {
+				if lk.conflicts(&locks[i]) {
+					return nil, syscall.EAGAIN
+				}
+			}
+		}
+		return applyLock(locks, lk), nil
+	})
+}
+
+// releaseLocks releases the locks of one holder of this mount on an inode, if this mount holds any there
+func (f *FS) releaseLocks(inode uint64, owner fuse.LockOwner, flock bool) error {
+	if _, ok := f.locked.Load(inode); !ok {
+		return nil
+	}
+	return f.setLock(inode, fileLock{
+		Mount: f.mountId,
+		Owner: owner,
+		Start: 0,
+		End:   math.MaxUint64,
+		Type:  fuse.LockUnlock,
+		Flock: flock,
+	})
+}
+
+// dropMountLocks releases all locks held by this mount, on unmount
+func (f *FS) dropMountLocks() {
+	f.locked.Range(func(key, value any) bool {
+		inode := key.(uint64)
+		err := f.updateLocks(inode, func(locks []fileLock) ([]fileLock, error) {
+			ret := []fileLock{}
+			for _, l := range locks {
+				if l.Mount != f.mountId {
+					ret = append(ret, l)
+				}
+			}
+			return ret, nil
+		})
+		if err != nil {
+			log.Warn("Releasing locks on inode %d: %s", inode, err)
+		}
+		return true
+	})
+}
+
+// lockErrno converts the error of a lock operation on inode
+func lockErrno(op string, inode uint64, err error) error {
+	if err == syscall.EAGAIN {
+		return err
+	}
+	log.Error("%s %d: %s", op, inode, err)
+	return syscall.EFAULT
+}
+
+func (f *File) requestedLock(req *fuse.LockRequest) fileLock {
+	return fileLock{
+		Mount: f.fs.mountId,
+		Owner: req.LockOwner,
+		Pid:   req.Lock.PID,
+		Start: req.Lock.Start,
+		End:   req.Lock.End,
+		Type:  req.Lock.Type,
+		Flock: req.LockFlags&fuse.LockFlock != 0,
+		Since: time.Now(),
+	}
+}
+
+func (f *File) Lock(ctx context.Context, req *fuse.LockRequest) error {
+	log.Debug("Executing Lock %d owner %v range %d-%d type %v", f.inode, req.LockOwner, req.Lock.Start, req.Lock.End, req.Lock.Type)
+	err := f.fs.setLock(f.inode, f.requestedLock(req))
+	if err != nil {
+		return lockErrno("Lock", f.inode, err)
+	}
+	return nil
+}
+
+// LockWait polls for the lock until it is granted or the request is interrupted
+func (f *File) LockWait(ctx context.Context, req *fuse.LockWaitRequest) error {
+	log.Debug("Executing LockWait %d owner %v range %d-%d type %v", f.inode, req.LockOwner, req.Lock.Start, req.Lock.End, req.Lock.Type)
+	lk := f.requestedLock((*fuse.LockRequest)(req))
+	wait := lockWaitMin
+	for {
+		err := f.fs.setLock(f.inode, lk)
+		if err != syscall.EAGAIN {
+			if err != nil {
+				return lockErrno("LockWait", f.inode, err)
+			}
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return syscall.EINTR
+		case <-time.After(wait):
+		}
+		wait = min(2*wait, lockWaitMax)
+	}
+}
+
+func (f *File) Unlock(ctx context.Context, req *fuse.UnlockRequest) error {
+	log.Debug("Executing Unlock %d owner %v range %d-%d", f.inode, req.LockOwner, req.Lock.Start, req.Lock.End)
+	err := f.fs.setLock(f.inode, f.requestedLock((*fuse.LockRequest)(req)))
+	if err != nil {
+		return lockErrno("Unlock", f.inode, err)
+	}
+	return nil
+}
+
+// QueryLock reports a lock of another holder conflicting with the requested one, if any
+func (f *File) QueryLock(ctx context.Context, req *fuse.QueryLockRequest, resp *fuse.QueryLockResponse) error {
+	log.Debug("Executing QueryLock %d owner %v range %d-%d type %v", f.inode, req.LockOwner, req.Lock.Start, req.Lock.End, req.Lock.Type)
+	locks, err := f.fs.getLocks(f.inode)
+	if err != nil {
+		return lockErrno("QueryLock", f.inode, err)
+	}
+	lk := fileLock{
+		Mount: f.fs.mountId,
+		Owner: req.LockOwner,
+		Start: req.Lock.Start,
+		End:   req.Lock.End,
+		Type:  req.Lock.Type,
+		Flock: req.LockFlags&fuse.LockFlock != 0,
+	}
+	for _, l := range locks {
+		if lk.conflicts(&l) {
+			resp.Lock = fuse.FileLock{Start: l.Start, End: l.End, Type: l.Type, PID: l.Pid}
+			// the pid is meaningless to processes on other clients
+			if l.Mount != f.fs.mountId {
+				resp.Lock.PID = 0
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// Flush releases the POSIX locks of the closing process, as any close does
+func (f *File) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	log.Debug("Executing Flush %d owner %v", f.inode, req.LockOwner)
+	err := f.fs.releaseLocks(f.inode, req.LockOwner, false)
+	if err != nil {
+		log.Error("Flush %d: releasing locks: %s", f.inode, err)
+		return syscall.EFAULT
+	}
+	return nil
+}
+
+// locksCmd lists the file locks held in the filesystem, or breaks the locks of an inode
+func locksCmd(args []string) {
+	if len(args) != 1 && !(len(args) >= 3 && len(args) <= 4 && args[1] == "break") {
+		fmt.Printf("Usage: %s locks /path/to/config.yaml [break inode [mount]]\n", os.Args[0])
+		os.Exit(1)
+	}
+	c, err := NewConfigFromFile(args[0])
+	if err != nil {
+		log.Critical("%s", err)
+	}
+	log.SetLogLevel(c.Log.Level)
+	log.SetPrefix("asd-fs: ")
+	var keys *keyring
+	if c.FS.Encryption.KeyFile != "" {
+		keys, err = loadKeyring(c.FS.Encryption.KeyFile)
+		if err != nil {
+			log.Critical("%s", err)
+		}
+	}
+	asd, err := openBackend(c)
+	if err != nil {
+		log.Critical("%s", err)
+	}
+	defer asd.Close()
+	f := &FS{
+		asd:  asd,
+		cfg:  c,
+		keys: keys,
+	}
+	if len(args) > 1 {
+		inode, err := strconv.ParseUint(args[2], 10, 64)
+		if err != nil || inode == 0 {
+			log.Critical("Invalid inode number %s", args[2])
+		}
+		err = f.updateLocks(inode, func(locks []fileLock) ([]fileLock, error) {
+			ret := []fileLock{}
+			for _, l := range locks {
+				if len(args) == 4 && l.Mount != args[3] {
+					ret = append(ret, l)
+				}
+			}
+			return ret, nil
+		})
+		if err != nil {
+			log.Critical("%s", err)
+		}
+		return
+	}
+	ik, err := f.locksIndexKey()
+	if err != nil {
+		log.Critical("%s", err)
+	}
+	r, xerr := asd.Get(GetReadPolicyNoMRT(asd, &c.Aerospike.Timeouts), ik, "Inodes")
+	if xerr != nil {
+		if xerr.Matches(aerospike.ErrKeyNotFound.ResultCode) {
+			return
+		}
+		log.Critical("%s", xerr)
+	}
+	fmt.Printf("%-10s %-5s %-5s %-21s %-8s %-16s %-20s %-25s %s\n", "INODE", "KIND", "TYPE", "RANGE", "PID", "MOUNT", "HOST", "SINCE", "PATH")
+	for _, e := range lsPairs(r.Bins["Inodes"]) {
+		inode := uint64(e.Key.(int))
+		locks, err := f.getLocks(inode)
+		if err != nil {
+			log.Critical("%s", err)
+		}
+		path := "-"
+		if paths, err := f.inodePaths(inode); err == nil {
+			path = paths[0]
+		}
+		for _, l := range locks {
+			kind := "posix"
+			if l.Flock {
+				kind = "flock"
+			}
+			typ := "read"
+			if l.Type == fuse.LockWrite {
+				typ = "write"
+			}
+			// the kernel locks up to EOF with OFFSET_MAX (MaxInt64)
+			end := "EOF"
+			if l.End < math.MaxInt64 {
+				end = strconv.FormatUint(l.End, 10)
+			}
+			host := "-"
+			if mk, err := f.mountKey(l.Mount); err == nil {
+				if mr, err := asd.Get(GetReadPolicyNoMRT(asd, &c.Aerospike.Timeouts), mk, "Host"); err == nil {
+					host = fmt.Sprint(mr.Bins["Host"])
+				}
+			}
+			fmt.Printf("%-10d %-5s %-5s %-21s %-8d %-16s %-20s %-25s %s\n", inode, kind, typ, fmt.Sprintf("%d-%s", l.Start, end), l.Pid, l.Mount, host, l.Since.Format(time.RFC3339), path)
+		}
+	}
+}
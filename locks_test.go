@@ -0,0 +1,47 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"bazil.org/fuse"
+)
+
+func TestApplyLock(t *testing.T) {
+	lock := func(owner fuse.LockOwner, start, end uint64, typ fuse.LockType) fileLock {
+		return fileLock{Mount: "m", Owner: owner, Start: start, End: end, Type: typ}
+	}
+	rd, wr, un := fuse.LockRead, fuse.LockWrite, fuse.LockUnlock
+	tests := []struct {
+		name  string
+		locks []fileLock
+		lk    fileLock
+		want  []fileLock
+	}{
+		{"take", nil, lock(1, 0, 9, wr), []fileLock{lock(1, 0, 9, wr)}},
+		{"disjoint", []fileLock{lock(1, 0, 9, rd)}, lock(1, 10, 19, wr),
+			[]fileLock{lock(1, 0, 9, rd), lock(1, 10, 19, wr)}},
+		{"replace", []fileLock{lock(1, 0, 9, rd)}, lock(1, 0, 9, wr), []fileLock{lock(1, 0, 9, wr)}},
+		{"split", []fileLock{lock(1, 0, 99, rd)}, lock(1, 10, 19, wr),
+			[]fileLock{lock(1, 0, 9, rd), lock(1, 20, 99, rd), lock(1, 10, 19, wr)}},
+		{"cut head", []fileLock{lock(1, 0, 19, rd)}, lock(1, 10, 29, wr),
+			[]fileLock{lock(1, 0, 9, rd), lock(1, 10, 29, wr)}},
+		{"cut tail", []fileLock{lock(1, 10, 29, rd)}, lock(1, 0, 19, wr),
+			[]fileLock{lock(1, 20, 29, rd), lock(1, 0, 19, wr)}},
+		{"to end of file", []fileLock{lock(1, 0, 1<<63-1, rd)}, lock(1, 10, 19, wr),
+			[]fileLock{lock(1, 0, 9, rd), lock(1, 20, 1<<63-1, rd), lock(1, 10, 19, wr)}},
+		{"unlock middle", []fileLock{lock(1, 0, 99, wr)}, lock(1, 10, 19, un),
+			[]fileLock{lock(1, 0, 9, wr), lock(1, 20, 99, wr)}},
+		{"unlock all", []fileLock{lock(1, 0, 9, wr), lock(1, 20, 29, rd)}, lock(1, 0, 1<<63-1, un), []fileLock{}},
+		{"other owner", []fileLock{lock(2, 0, 99, rd)}, lock(1, 10, 19, rd),
+			[]fileLock{lock(2, 0, 99, rd), lock(1, 10, 19, rd)}},
+		{"other owner unlock", []fileLock{lock(2, 0, 99, rd)}, lock(1, 0, 99, un), []fileLock{lock(2, 0, 99, rd)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := applyLock(tt.locks, tt.lk); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -8,10 +8,10 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
-	"github.com/aerospike/aerospike-client-go/v8"
 	"github.com/rglonek/logger"
 	"gopkg.in/yaml.v3"
 )
@@ -20,8 +20,28 @@ var log = logger.NewLogger()
 
 func main() {
 	os.Setenv("PATH", "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin")
+	if len(os.Args) >= 2 {
+		switch os.Args[1] {
+		case "migrate":
+			migrateCmd(os.Args[2:])
+			return
+		case "list":
+			listCmd(os.Args[2:])
+			return
+		case "path":
+			pathCmd(os.Args[2:])
+			return
+		case "locks":
+			locksCmd(os.Args[2:])
+			return
+		}
+	}
 	if len(os.Args) < 3 {
 		fmt.Printf("Usage: %s /path/to/config.yaml dest/\n", os.Args[0])
+		fmt.Printf("       %s migrate /path/to/config.yaml\n", os.Args[0])
+		fmt.Printf("       %s list /path/to/config.yaml\n", os.Args[0])
+		fmt.Printf("       %s path /path/to/config.yaml inode\n", os.Args[0])
+		fmt.Printf("       %s locks /path/to/config.yaml [break inode [mount]]\n", os.Args[0])
 		os.Exit(1)
 	}
 
@@ -39,8 +59,9 @@ func main() {
 		if os.Args[3] != "-o" {
 			log.Critical("Invalid argument (%v)", os.Args)
 		}
-		for _, param := range strings.Split(strings.ToLower(os.Args[4]), ",") {
-			switch param {
+		for _, option := range strings.Split(os.Args[4], ",") {
+			param, value, _ := strings.Cut(option, "=")
+			switch strings.ToLower(param) {
 			case "rw":
 				c.MountParams.RW = true
 				c.MountParams.RO = false
@@ -50,6 +71,29 @@ func main() {
 			case "debug":
 				c.MountParams.Debug = true
 				c.Log.Stderr = true
+			case "default_permissions":
+				c.MountParams.Permissions = permsKernel
+			case "allow_other":
+				c.MountParams.AllowOther = true
+			case "dev":
+				c.MountParams.AllowDev = true
+			case atimeNo, atimeRel, atimeStrict:
+				c.MountParams.Atime = strings.ToLower(param)
+			case "lazytime":
+				c.MountParams.Lazytime = true
+			case "nolazytime":
+				c.MountParams.Lazytime = false
+			case "ttl":
+				ttl, err := parseTTL(value)
+				if err != nil {
+					log.Critical("%s", err)
+				}
+				c.FS.TTL = time.Duration(ttl) * time.Second
+			case "fsname":
+				if err := checkFSName(value); err != nil {
+					log.Critical("%s", err)
+				}
+				c.FS.Name = value
 			}
 		}
 	}
@@ -104,15 +148,43 @@ func main() {
 		}
 	}
 	log.Info("Mounting from %s to %s", os.Args[1], os.Args[2])
+	var keys *keyring
+	if c.FS.Encryption.KeyFile != "" {
+		log.Info("Loading encryption keys")
+		keys, err = loadKeyring(c.FS.Encryption.KeyFile)
+		if err != nil {
+			log.Critical("%s", err)
+		}
+	}
 	log.Info("Connecting to aerospike")
-	asd, err := Connect(c)
+	asd, err := Connect(c, keys)
+	if err != nil {
+		log.Critical("%s", err)
+	}
+	_, err = checkFormat(asd, c, keys)
 	if err != nil {
 		log.Critical("%s", err)
 	}
-	log.Info("Adding signal handlers")
-	sigHandler(asd)
 	log.Info("Init mount system")
-	conn, err := fuse.Mount(c.MountDir, fuse.FSName("asd"), fuse.Subtype("asdfs"))
+	fsName := "asd"
+	if c.FS.Name != "" {
+		fsName += ":" + c.FS.Name
+	}
+	// the umask is applied by inheritedACL, so that it can be ignored for directories with a default ACL
+	options := []fuse.MountOption{fuse.FSName(fsName), fuse.Subtype("asdfs"), fuse.DontMask()}
+	if c.MountParams.Permissions == permsKernel {
+		options = append(options, fuse.DefaultPermissions())
+	}
+	if c.MountParams.AllowOther {
+		options = append(options, fuse.AllowOther())
+	}
+	if c.MountParams.AllowDev {
+		options = append(options, fuse.AllowDev())
+	}
+	if !c.MountParams.LocalLocks {
+		options = append(options, fuse.LockingFlock(), fuse.LockingPOSIX())
+	}
+	conn, err := fuse.Mount(c.MountDir, options...)
 	if err != nil {
 		log.Critical("%s", err)
 	}
@@ -132,8 +204,26 @@ func main() {
 		fuse: server,
 		asd:  asd,
 		cfg:  c,
+		keys: keys,
+		open: make(map[uint64]*openCount),
+	}
+	err = filesys.registerMount()
+	if err != nil {
+		log.Critical("Register mount: %s", err)
+	}
+	log.Info("Adding signal handlers")
+	sigHandler(asd, filesys)
+	if !c.MountParams.RO {
+		err = filesys.cleanupOrphans()
+		if err != nil {
+			log.Warn("Cleanup of orphaned inodes: %s", err)
+		}
+	}
+	if c.MountParams.Lazytime {
+		filesys.startAtimeFlush()
 	}
 	err = server.Serve(filesys)
+	filesys.unmounted()
 
 	log.Info("Waiting for all writes to complete")
 	cleanup()
@@ -162,14 +252,21 @@ func cleanup() {
 	ops.Lock()    // wait for existing operations to complete - if we can lock this one, that means all ops have completed and released their RLocks
 }
 
-// add a sigint/sigterm handler which will call cleanup() and then exit the process
-func sigHandler(asd *aerospike.Client) {
+// add a sigint/sigterm handler which unmounts the filesystem, so that Serve returns and the mount is torn down as on
+// a regular unmount; if the filesystem is busy, it waits for all writes to complete, tears the mount down and exits
+func sigHandler(asd Backend, f *FS) {
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		sig := <-sigs
-		log.Info("Received signal: %v, waiting for all writes to complete before exit", sig)
+		log.Info("Received signal: %v, unmounting", sig)
+		err := fuse.Unmount(f.cfg.MountDir)
+		if err == nil {
+			return
+		}
+		log.Warn("Unmount: %s, waiting for all writes to complete before exit", err)
 		cleanup()
+		f.unmounted()
 		log.Info("Exiting")
 		asd.Close()
 		os.Exit(0)
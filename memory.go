@@ -0,0 +1,664 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aerospike/aerospike-client-go/v8"
+	"github.com/aerospike/aerospike-client-go/v8/types"
+)
+
+// memBackend keeps the filesystem in process memory, for tests and scratch filesystems; all is lost when it closes
+// records written in a transaction are locked by it until commit or abort: writes to them from elsewhere fail with
+// MRT_BLOCKED and reads see the last committed version; commit fails with MRT_VERSION_MISMATCH if a record read by
+// the transaction was changed by someone else meanwhile, like with Aerospike
+type memBackend struct {
+	lock    sync.Mutex
+	records map[string]*memRecord
+	txns    map[int64]*memTxn
+	version uint64
+}
+
+type memRecord struct {
+	bins    map[string]interface{} // nil while deleted by a transaction in progress
+	version uint64
+	txn     int64     // transaction holding the record, 0 if none
+	expires time.Time // zero if the record does not expire
+}
+
+type memTxn struct {
+	undo  map[string]memRecord // committed state of the records written by the transaction
+	reads map[string]uint64    // versions of the records read by the transaction, 0 for missing
+}
+
+// memMap is a map bin; maps created by map ops are key-ordered, maps written as a whole bin value unordered
+type memMap struct {
+	ordered bool
+	items   map[interface{}]interface{}
+}
+
+func newMemBackend() *memBackend {
+	return &memBackend{
+		records: make(map[string]*memRecord),
+		txns:    make(map[int64]*memTxn),
+	}
+}
+
+func memErr(code types.ResultCode) aerospike.Error {
+	return &aerospike.AerospikeError{ResultCode: code}
+}
+
+func memKey(key *aerospike.Key) string {
+	return key.Namespace() + "/" + key.SetName() + "/" + string(key.Digest())
+}
+
+func (b *memBackend) txn(txn *aerospike.Txn) *memTxn {
+	if txn == nil {
+		return nil
+	}
+	t, ok := b.txns[txn.Id()]
+	if !ok {
+		t = &memTxn{
+			undo:  make(map[string]memRecord),
+			reads: make(map[string]uint64),
+		}
+		b.txns[txn.Id()] = t
+	}
+	return t
+}
+
+// read returns the bins of a record as seen by the transaction (nil for none), nil if the record does not exist
+func (b *memBackend) read(txn *aerospike.Txn, key *aerospike.Key) map[string]interface{} {
+	k := memKey(key)
+	r, ok := b.records[k]
+	var id int64
+	if txn != nil {
+		id = txn.Id()
+	}
+	if ok && r.txn != 0 && r.txn != id {
+		// locked by another transaction
+		committed := b.txns[r.txn].undo[k]
+		r = &committed
+	}
+	if ok && !r.expires.IsZero() && time.Now().After(r.expires) {
+		ok = false
+	}
+	if t := b.txn(txn); t != nil && (!ok || r.txn != id) {
+		if _, read := t.reads[k]; !read {
+			t.reads[k] = 0
+			if ok {
+				t.reads[k] = r.version
+			}
+		}
+	}
+	if !ok {
+		return nil
+	}
+	return r.bins
+}
+
+// write replaces the bins of a record within the transaction (deleting it for nil bins), applying the expiration
+func (b *memBackend) write(txn *aerospike.Txn, key *aerospike.Key, bins map[string]interface{}, expiration uint32) aerospike.Error {
+	k := memKey(key)
+	r, ok := b.records[k]
+	var id int64
+	if txn != nil {
+		id = txn.Id()
+	}
+	if ok && r.txn != 0 && r.txn != id {
+		return memErr(types.MRT_BLOCKED)
+	}
+	if len(bins) == 0 {
+		bins = nil
+	}
+	b.version++
+	if t := b.txn(txn); t != nil {
+		if !ok {
+			r = &memRecord{}
+			b.records[k] = r
+		}
+		if r.txn == 0 {
+			t.undo[k] = *r
+			r.txn = id
+		}
+		r.bins = bins
+		r.version = b.version
+		r.expires = memExpires(expiration, r.expires)
+		return nil
+	}
+	if bins == nil {
+		delete(b.records, k)
+		return nil
+	}
+	if !ok {
+		r = &memRecord{}
+		b.records[k] = r
+	}
+	r.bins = bins
+	r.version = b.version
+	r.expires = memExpires(expiration, r.expires)
+	return nil
+}
+
+// memExpires returns the expiry time of a record written with the given policy expiration
+func memExpires(expiration uint32, current time.Time) time.Time {
+	switch expiration {
+	case aerospike.TTLServerDefault, aerospike.TTLDontExpire:
+		return time.Time{}
+	case aerospike.TTLDontUpdate:
+		if !current.IsZero() && time.Now().After(current) {
+			// the record expired and is created anew
+			return time.Time{}
+		}
+		return current
+	}
+	return time.Now().Add(time.Duration(expiration) * time.Second)
+}
+
+// checkExists applies the RecordExistsAction of a write policy to the current bins of a record
+func checkExists(policy *aerospike.WritePolicy, bins map[string]interface{}) aerospike.Error {
+	switch policy.RecordExistsAction {
+	case aerospike.CREATE_ONLY:
+		if bins != nil {
+			return memErr(types.KEY_EXISTS_ERROR)
+		}
+	case aerospike.UPDATE_ONLY, aerospike.REPLACE_ONLY:
+		if bins == nil {
+			return memErr(types.KEY_NOT_FOUND_ERROR)
+		}
+	}
+	return nil
+}
+
+func (b *memBackend) Get(policy *aerospike.BasePolicy, key *aerospike.Key, binNames ...string) (*aerospike.Record, aerospike.Error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	bins := b.read(policy.Txn, key)
+	if bins == nil {
+		return nil, memErr(types.KEY_NOT_FOUND_ERROR)
+	}
+	return memRecordOf(key, bins, binNames), nil
+}
+
+func (b *memBackend) Exists(policy *aerospike.BasePolicy, key *aerospike.Key) (bool, aerospike.Error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.read(policy.Txn, key) != nil, nil
+}
+
+func (b *memBackend) Put(policy *aerospike.WritePolicy, key *aerospike.Key, bins aerospike.BinMap) aerospike.Error {
+	list := make([]*aerospike.Bin, 0, len(bins))
+	for name, value := range bins {
+		list = append(list, aerospike.NewBin(name, value))
+	}
+	return b.PutBins(policy, key, list...)
+}
+
+func (b *memBackend) PutBins(policy *aerospike.WritePolicy, key *aerospike.Key, bins ...*aerospike.Bin) aerospike.Error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	old := b.read(policy.Txn, key)
+	if err := checkExists(policy, old); err != nil {
+		return err
+	}
+	updated := make(map[string]interface{})
+	if policy.RecordExistsAction != aerospike.REPLACE && policy.RecordExistsAction != aerospike.REPLACE_ONLY {
+		for name, value := range old {
+			updated[name] = value
+		}
+	}
+	for _, bin := range bins {
+		setBin(updated, bin.Name, memValue(bin.Value.GetObject()))
+	}
+	return b.write(policy.Txn, key, updated, policy.Expiration)
+}
+
+func (b *memBackend) Delete(policy *aerospike.WritePolicy, key *aerospike.Key) (bool, aerospike.Error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.read(policy.Txn, key) == nil {
+		return false, nil
+	}
+	return true, b.write(policy.Txn, key, nil, policy.Expiration)
+}
+
+func (b *memBackend) Operate(policy *aerospike.WritePolicy, key *aerospike.Key, ops ...*Op) (*aerospike.Record, aerospike.Error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	old := b.read(policy.Txn, key)
+	if err := checkExists(policy, old); err != nil {
+		return nil, err
+	}
+	bins := make(map[string]interface{})
+	for name, value := range old {
+		bins[name] = value
+	}
+	results := make(map[string]interface{})
+	result := func(name string, value interface{}) {
+		if prev, ok := results[name]; ok {
+			// multiple results of a bin are returned as a list
+			if list, ok := prev.([]interface{}); ok {
+				results[name] = append(list, value)
+			} else {
+				results[name] = []interface{}{prev, value}
+			}
+			return
+		}
+		results[name] = value
+	}
+	written := false
+	for _, op := range ops {
+		if op.Kind == opUnless {
+			if old != nil && anyExists(bins, op.Unless) {
+				return nil, memErr(types.FILTERED_OUT)
+			}
+			continue
+		}
+		if old == nil && op.Kind == opBlobRead {
+			// reading a record that does not exist fails with KEY_NOT_FOUND, not on the missing blob
+			continue
+		}
+		value, write, err := applyOp(bins, op)
+		if err != nil {
+			return nil, err
+		}
+		written = written || write
+		switch {
+		case op.Name != "":
+			result(op.Name, value)
+		case op.Kind == opBlobRead || !write || op.Kind == opMapPut || op.Kind == opMapPutItems:
+			result(op.Bin, value)
+		}
+	}
+	if old == nil && len(bins) == 0 {
+		return nil, memErr(types.KEY_NOT_FOUND_ERROR)
+	}
+	if written {
+		if err := b.write(policy.Txn, key, bins, policy.Expiration); err != nil {
+			return nil, err
+		}
+	}
+	return &aerospike.Record{Key: key, Bins: memOut(results).(map[string]interface{})}, nil
+}
+
+func (b *memBackend) BatchGet(policy *aerospike.BatchPolicy, keys []*aerospike.Key, binNames ...string) ([]*aerospike.Record, aerospike.Error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	records := make([]*aerospike.Record, len(keys))
+	for i, key := range keys {
+		if bins := b.read(policy.Txn, key); bins != nil {
+			records[i] = memRecordOf(key, bins, binNames)
+		}
+	}
+	return records, nil
+}
+
+func (b *memBackend) BatchOperate(policy *aerospike.BatchPolicy, keys []*aerospike.Key, ops [][]*Op) ([]*aerospike.Record, aerospike.Error) {
+	wp := aerospike.NewWritePolicy(0, aerospike.TTLDontUpdate)
+	wp.Txn = policy.Txn
+	records := make([]*aerospike.Record, len(keys))
+	for i, key := range keys {
+		r, err := b.Operate(wp, key, ops[i]...)
+		if err != nil && !err.Matches(types.KEY_NOT_FOUND_ERROR) {
+			return nil, err
+		}
+		records[i] = r
+	}
+	return records, nil
+}
+
+func (b *memBackend) Commit(txn *aerospike.Txn) aerospike.Error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	t, ok := b.txns[txn.Id()]
+	if !ok {
+		return nil
+	}
+	for k, version := range t.reads {
+		current := uint64(0)
+		if r, ok := b.records[k]; ok {
+			if r.txn != 0 {
+				committed := b.txns[r.txn].undo[k]
+				r = &committed
+			}
+			if r.expires.IsZero() || time.Now().Before(r.expires) {
+				current = r.version
+			}
+		}
+		if current != version {
+			b.abort(txn.Id(), t)
+			return memErr(types.MRT_VERSION_MISMATCH)
+		}
+	}
+	for k := range t.undo {
+		r := b.records[k]
+		r.txn = 0
+		if r.bins == nil {
+			delete(b.records, k)
+		}
+	}
+	delete(b.txns, txn.Id())
+	return nil
+}
+
+func (b *memBackend) Abort(txn *aerospike.Txn) aerospike.Error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if t, ok := b.txns[txn.Id()]; ok {
+		b.abort(txn.Id(), t)
+	}
+	return nil
+}
+
+func (b *memBackend) abort(id int64, t *memTxn) {
+	for k, committed := range t.undo {
+		if committed.bins == nil {
+			delete(b.records, k)
+			continue
+		}
+		r := committed
+		b.records[k] = &r
+	}
+	delete(b.txns, id)
+}
+
+func (b *memBackend) Close() {}
+
+// Space reports the memory of the host
+func (b *memBackend) Space(namespace string) (uint64, uint64, aerospike.Error) {
+	var info syscall.Sysinfo_t
+	if err := syscall.Sysinfo(&info); err != nil {
+		return 0, 0, memErr(types.SERVER_ERROR)
+	}
+	return info.Totalram * uint64(info.Unit), info.Freeram * uint64(info.Unit), nil
+}
+
+func memRecordOf(key *aerospike.Key, bins map[string]interface{}, binNames []string) *aerospike.Record {
+	ret := make(map[string]interface{})
+	if len(binNames) == 0 {
+		for name, value := range bins {
+			ret[name] = memOut(value)
+		}
+	}
+	for _, name := range binNames {
+		if value, ok := bins[name]; ok {
+			ret[name] = memOut(value)
+		}
+	}
+	return &aerospike.Record{Key: key, Bins: ret}
+}
+
+func setBin(bins map[string]interface{}, name string, value interface{}) {
+	if value == nil {
+		delete(bins, name)
+		return
+	}
+	bins[name] = value
+}
+
+func anyExists(bins map[string]interface{}, names []string) bool {
+	for _, name := range names {
+		if _, ok := bins[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// applyOp applies op to bins, returning its result and whether it wrote
+// bin values are never modified in place, as they are shared with the undo state of transactions
+func applyOp(bins map[string]interface{}, op *Op) (interface{}, bool, aerospike.Error) {
+	switch op.Kind {
+	case opGet:
+		return bins[op.Bin], false, nil
+	case opPut:
+		setBin(bins, op.Bin, memValue(op.Value))
+		return nil, true, nil
+	case opAdd:
+		v, ok := bins[op.Bin].(int)
+		if _, exists := bins[op.Bin]; exists && !ok {
+			return nil, false, memErr(types.BIN_TYPE_ERROR)
+		}
+		bins[op.Bin] = v + op.Value.(int)
+		return nil, true, nil
+	case opMapGet:
+		m, err := mapBin(bins, op.Bin)
+		if err != nil || m == nil {
+			return nil, false, err
+		}
+		return m.items[memValue(op.Key)], false, nil
+	case opMapPut, opMapPutItems:
+		m, err := mapBin(bins, op.Bin)
+		if err != nil {
+			return nil, false, err
+		}
+		items := map[interface{}]interface{}{op.Key: op.Value}
+		if op.Kind == opMapPutItems {
+			items = op.Value.(map[interface{}]interface{})
+		}
+		updated := m.clone()
+		for k, v := range items {
+			k = memValue(k)
+			if _, exists := updated.items[k]; exists && op.CreateOnly {
+				return nil, false, memErr(types.FAIL_ELEMENT_EXISTS)
+			}
+			updated.items[k] = memValue(v)
+		}
+		bins[op.Bin] = updated
+		return len(updated.items), true, nil
+	case opMapRemove:
+		m, err := mapBin(bins, op.Bin)
+		if err != nil || m == nil {
+			return nil, true, err
+		}
+		updated := m.clone()
+		delete(updated.items, memValue(op.Key))
+		bins[op.Bin] = updated
+		return nil, true, nil
+	case opMapPage:
+		m, err := mapBin(bins, op.Bin)
+		if err != nil || m == nil {
+			return nil, false, err
+		}
+		pairs := m.pairs()
+		start := 0
+		if op.After != nil {
+			after := memValue(op.After)
+			start, _ = slices.BinarySearchFunc(pairs, after, func(p aerospike.MapPair, k interface{}) int {
+				return compareKeys(p.Key, k)
+			})
+			if start < len(pairs) && compareKeys(pairs[start].Key, after) == 0 {
+				start++
+			}
+		}
+		end := min(start+op.Count, len(pairs))
+		if start >= end {
+			return []aerospike.MapPair{}, false, nil
+		}
+		return pairs[start:end], false, nil
+	case opMapSize:
+		m, err := mapBin(bins, op.Bin)
+		if err != nil || m == nil {
+			return 0, false, err
+		}
+		return len(m.items), false, nil
+	case opMapKeyOrder:
+		m, err := mapBin(bins, op.Bin)
+		if err != nil || m == nil {
+			return nil, true, err
+		}
+		updated := m.clone()
+		updated.ordered = true
+		bins[op.Bin] = updated
+		return nil, true, nil
+	case opBinExists:
+		_, ok := bins[op.Bin]
+		return ok, false, nil
+	case opTouch:
+		return nil, true, nil
+	case opBlobResize:
+		blob, ok := bins[op.Bin].([]byte)
+		if _, exists := bins[op.Bin]; exists && !ok {
+			return nil, false, memErr(types.BIN_TYPE_ERROR)
+		}
+		if (op.Resize&aerospike.BitResizeFlagsGrowOnly != 0 && op.Size < len(blob)) || (op.Resize&aerospike.BitResizeFlagsShrinkOnly != 0 && op.Size > len(blob)) {
+			return nil, false, memErr(types.OP_NOT_APPLICABLE)
+		}
+		resized := make([]byte, op.Size)
+		copy(resized, blob)
+		bins[op.Bin] = resized
+		return nil, true, nil
+	case opBlobWrite:
+		blob, ok := bins[op.Bin].([]byte)
+		data := op.Value.([]byte)
+		if !ok {
+			return nil, false, memErr(types.BIN_NOT_FOUND)
+		}
+		if op.Offset+len(data) > len(blob) {
+			return nil, false, memErr(types.OP_NOT_APPLICABLE)
+		}
+		updated := slices.Clone(blob)
+		copy(updated[op.Offset:], data)
+		bins[op.Bin] = updated
+		return nil, true, nil
+	case opBlobRead:
+		blob, _ := bins[op.Bin].([]byte)
+		if anyExists(bins, op.Unless) {
+			return blob, false, nil
+		}
+		if op.Offset+op.Size > len(blob) {
+			return nil, false, memErr(types.OP_NOT_APPLICABLE)
+		}
+		return blob[op.Offset : op.Offset+op.Size], false, nil
+	}
+	return nil, false, memErr(types.PARAMETER_ERROR)
+}
+
+// mapBin returns the map stored in a bin, nil if the bin does not exist
+func mapBin(bins map[string]interface{}, name string) (*memMap, aerospike.Error) {
+	v, ok := bins[name]
+	if !ok {
+		return nil, nil
+	}
+	m, ok := v.(*memMap)
+	if !ok {
+		return nil, memErr(types.BIN_TYPE_ERROR)
+	}
+	return m, nil
+}
+
+// clone returns a copy of the map, a new key-ordered map for nil
+func (m *memMap) clone() *memMap {
+	if m == nil {
+		return &memMap{ordered: true, items: make(map[interface{}]interface{})}
+	}
+	c := &memMap{ordered: m.ordered, items: make(map[interface{}]interface{}, len(m.items))}
+	for k, v := range m.items {
+		c.items[k] = v
+	}
+	return c
+}
+
+// pairs returns the map items in key order
+func (m *memMap) pairs() []aerospike.MapPair {
+	pairs := make([]aerospike.MapPair, 0, len(m.items))
+	for k, v := range m.items {
+		pairs = append(pairs, aerospike.MapPair{Key: k, Value: v})
+	}
+	slices.SortFunc(pairs, func(a, b aerospike.MapPair) int {
+		return compareKeys(a.Key, b.Key)
+	})
+	return pairs
+}
+
+// compareKeys orders map keys like Aerospike: integers before strings
+func compareKeys(a, b interface{}) int {
+	ai, aInt := a.(int)
+	bi, bInt := b.(int)
+	switch {
+	case aInt && bInt:
+		return cmp.Compare(ai, bi)
+	case aInt:
+		return -1
+	case bInt:
+		return 1
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+// memValue converts a value written by the filesystem to the form it is stored in, as the client would send it
+func memValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil, int, string, bool, float64, *memMap:
+		return v
+	case []byte:
+		return slices.Clone(v)
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Map:
+		m := &memMap{items: make(map[interface{}]interface{}, rv.Len())}
+		iter := rv.MapRange()
+		for iter.Next() {
+			m.items[memValue(iter.Key().Interface())] = memValue(iter.Value().Interface())
+		}
+		return m
+	case reflect.Slice:
+		list := make([]interface{}, rv.Len())
+		for i := range list {
+			list[i] = memValue(rv.Index(i).Interface())
+		}
+		return list
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return int(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int(rv.Uint())
+	}
+	return v
+}
+
+// memOut converts a stored value to the form the client returns it in
+func memOut(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []byte:
+		return slices.Clone(v)
+	case *memMap:
+		if v.ordered {
+			pairs := v.pairs()
+			for i := range pairs {
+				pairs[i].Value = memOut(pairs[i].Value)
+			}
+			return pairs
+		}
+		m := make(map[interface{}]interface{}, len(v.items))
+		for k, item := range v.items {
+			m[k] = memOut(item)
+		}
+		return m
+	case []aerospike.MapPair:
+		pairs := make([]aerospike.MapPair, len(v))
+		for i, p := range v {
+			pairs[i] = aerospike.MapPair{Key: p.Key, Value: memOut(p.Value)}
+		}
+		return pairs
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = memOut(item)
+		}
+		return list
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			m[k] = memOut(item)
+		}
+		return m
+	}
+	return v
+}
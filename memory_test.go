@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/aerospike/aerospike-client-go/v8"
+	"github.com/aerospike/aerospike-client-go/v8/types"
+)
+
+// newTestFS returns a filesystem on the memory backend, using blocks of blockSize bytes, and its root directory
+func newTestFS(t *testing.T, blockSize int) (*FS, *Dir) {
+	t.Helper()
+	return newTestFSConfig(t, fmt.Sprintf("fs:\n  blockSize: %d\n", blockSize))
+}
+
+// newTestFSConfig returns a filesystem on the memory backend, configured with the given yaml, and its root directory
+func newTestFSConfig(t *testing.T, config string) (*FS, *Dir) {
+	t.Helper()
+	c, err := NewConfig(strings.NewReader("backend: memory\naerospike:\n  namespace: test\nlog:\n  level: 2\n" + config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	asd, err := Connect(c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &FS{
+		fuse: fs.New(nil, nil),
+		asd:  asd,
+		cfg:  c,
+		open: make(map[uint64]*openCount),
+	}
+	if err := f.registerMount(); err != nil {
+		t.Fatal(err)
+	}
+	root, err := f.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, root.(*Dir)
+}
+
+func testCreate(t *testing.T, d *Dir, name string, data string) *File {
+	t.Helper()
+	_, h, err := d.Create(context.Background(), &fuse.CreateRequest{Name: name, Mode: 0o644, Flags: fuse.OpenReadWrite}, &fuse.CreateResponse{})
+	if err != nil {
+		t.Fatalf("Create %s: %s", name, err)
+	}
+	if data != "" {
+		testWrite(t, h.(*File), 0, data)
+	}
+	return h.(*File)
+}
+
+func testMkdir(t *testing.T, d *Dir, name string) *Dir {
+	t.Helper()
+	n, err := d.Mkdir(context.Background(), &fuse.MkdirRequest{Name: name, Mode: os.ModeDir | 0o755})
+	if err != nil {
+		t.Fatalf("Mkdir %s: %s", name, err)
+	}
+	return n.(*Dir)
+}
+
+func testWrite(t *testing.T, h *File, offset int, data string) {
+	t.Helper()
+	resp := &fuse.WriteResponse{}
+	err := h.Write(context.Background(), &fuse.WriteRequest{Offset: int64(offset), Data: []byte(data)}, resp)
+	if err != nil {
+		t.Fatalf("Write %d@%d: %s", len(data), offset, err)
+	}
+	if resp.Size != len(data) {
+		t.Fatalf("Write %d@%d: wrote %d", len(data), offset, resp.Size)
+	}
+}
+
+func testRead(t *testing.T, h *File, offset int, size int) string {
+	t.Helper()
+	resp := &fuse.ReadResponse{Data: make([]byte, 0, size)}
+	err := h.Read(context.Background(), &fuse.ReadRequest{Offset: int64(offset), Size: size}, resp)
+	if err != nil {
+		t.Fatalf("Read %d@%d: %s", size, offset, err)
+	}
+	return string(resp.Data)
+}
+
+func testSize(t *testing.T, h *File) int {
+	t.Helper()
+	a := &fuse.Attr{}
+	if err := h.Attr(context.Background(), a); err != nil {
+		t.Fatalf("Attr: %s", err)
+	}
+	return int(a.Size)
+}
+
+func TestBlockReadWrite(t *testing.T) {
+	type write struct {
+		offset int
+		data   string
+	}
+	tests := []struct {
+		name   string
+		writes []write
+		want   string
+	}{
+		{"within a block", []write{{0, "abc"}}, "abc"},
+		{"filling a block", []write{{0, "01234567"}}, "01234567"},
+		{"across a boundary", []write{{6, "abcd"}}, "\x00\x00\x00\x00\x00\x00abcd"},
+		{"spanning blocks", []write{{3, "0123456789abcdefghij"}}, "\x00\x00\x000123456789abcdefghij"},
+		{"overwriting across a boundary", []write{{0, "aaaaaaaaaaaaaaaa"}, {7, "bb"}}, "aaaaaaabbaaaaaaa"},
+		{"appending", []write{{0, "0123456"}, {7, "789"}, {10, "abcdefgh"}}, "0123456789abcdefgh"},
+		{"hole", []write{{0, "a"}, {20, "b"}}, "a" + strings.Repeat("\x00", 19) + "b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, root := newTestFS(t, 8)
+			h := testCreate(t, root, "f", "")
+			for _, w := range tt.writes {
+				testWrite(t, h, w.offset, w.data)
+			}
+			if size := testSize(t, h); size != len(tt.want) {
+				t.Fatalf("size %d, want %d", size, len(tt.want))
+			}
+			if got := testRead(t, h, 0, 100); got != tt.want {
+				t.Fatalf("read %q, want %q", got, tt.want)
+			}
+			// every read of 5 bytes, crossing the boundaries at all positions
+			for offset := 0; offset < len(tt.want); offset++ {
+				want := tt.want[offset:min(offset+5, len(tt.want))]
+				if got := testRead(t, h, offset, 5); got != want {
+					t.Fatalf("read 5@%d %q, want %q", offset, got, want)
+				}
+			}
+			if got := testRead(t, h, len(tt.want), 5); got != "" {
+				t.Fatalf("read at EOF %q", got)
+			}
+		})
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	const content = "0123456789abcdefghij"
+	tests := []struct {
+		name  string
+		sizes []int
+		want  string
+	}{
+		{"to zero", []int{0}, ""},
+		{"within a block", []int{5}, "01234"},
+		{"to a boundary", []int{8}, "01234567"},
+		{"unchanged", []int{20}, content},
+		{"growing", []int{25}, content + "\x00\x00\x00\x00\x00"},
+		{"shrinking and growing", []int{5, 20}, "01234" + strings.Repeat("\x00", 15)},
+		{"to a boundary and growing", []int{16, 18}, "0123456789abcdef\x00\x00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, root := newTestFS(t, 8)
+			h := testCreate(t, root, "f", content)
+			for _, size := range tt.sizes {
+				err := h.Setattr(context.Background(), &fuse.SetattrRequest{Valid: fuse.SetattrSize, Size: uint64(size)}, &fuse.SetattrResponse{})
+				if err != nil {
+					t.Fatalf("truncate to %d: %s", size, err)
+				}
+			}
+			if size := testSize(t, h); size != len(tt.want) {
+				t.Fatalf("size %d, want %d", size, len(tt.want))
+			}
+			if got := testRead(t, h, 0, 100); got != tt.want {
+				t.Fatalf("read %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRename(t *testing.T) {
+	// /a/f, /a/sub/, /g, /e/, /n/x
+	tests := []struct {
+		name    string
+		from    string
+		oldName string
+		to      string
+		newName string
+		want    error
+	}{
+		{"in place", "/", "g", "/", "h", nil},
+		{"to another directory", "/", "g", "/a", "g", nil},
+		{"replacing a file", "/a", "f", "/", "g", nil},
+		{"directory to another directory", "/", "e", "/a", "e", nil},
+		{"replacing an empty directory", "/", "n", "/", "e", nil},
+		{"file over a directory", "/", "g", "/", "e", syscall.EISDIR},
+		{"directory over a file", "/", "e", "/", "g", syscall.ENOTDIR},
+		{"over a non-empty directory", "/", "e", "/", "n", syscall.ENOTEMPTY},
+		{"into its own subtree", "/", "a", "/a/sub", "a", syscall.EINVAL},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, root := newTestFS(t, 8)
+			a := testMkdir(t, root, "a")
+			testCreate(t, a, "f", "f")
+			dirs := map[string]*Dir{
+				"/":      root,
+				"/a":     a,
+				"/a/sub": testMkdir(t, a, "sub"),
+			}
+			testCreate(t, root, "g", "g")
+			testMkdir(t, root, "e")
+			testCreate(t, testMkdir(t, root, "n"), "x", "x")
+			from, to := dirs[tt.from], dirs[tt.to]
+			old := lookupInode(t, from, tt.oldName)
+			err := from.Rename(context.Background(), &fuse.RenameRequest{NewDir: fuse.NodeID(to.inode), OldName: tt.oldName, NewName: tt.newName}, to)
+			if err != tt.want {
+				t.Fatalf("Rename: %v, want %v", err, tt.want)
+			}
+			if err != nil {
+				if got := lookupInode(t, from, tt.oldName); got != old {
+					t.Fatalf("failed rename moved %s: inode %d, want %d", tt.oldName, got, old)
+				}
+				return
+			}
+			if got := lookupInode(t, from, tt.oldName); got != 0 && (from != to || tt.oldName != tt.newName) {
+				t.Fatalf("%s still linked to %d", tt.oldName, got)
+			}
+			if got := lookupInode(t, to, tt.newName); got != old {
+				t.Fatalf("%s linked to %d, want %d", tt.newName, got, old)
+			}
+			parents, err := root.fs.inodeParents(old)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(parents) != 1 || parents[0].dir != to.inode {
+				t.Fatalf("parents %v, want %d", parents, to.inode)
+			}
+		})
+	}
+}
+
+// lookupInode returns the inode linked as name in directory d, 0 for none
+func lookupInode(t *testing.T, d *Dir, name string) uint64 {
+	t.Helper()
+	n, err := d.Lookup(context.Background(), &fuse.LookupRequest{Name: name}, &fuse.LookupResponse{})
+	if err == syscall.ENOENT {
+		return 0
+	}
+	if err != nil {
+		t.Fatalf("Lookup %s: %s", name, err)
+	}
+	a := &fuse.Attr{}
+	if err := n.Attr(context.Background(), a); err != nil {
+		t.Fatalf("Attr %s: %s", name, err)
+	}
+	return a.Inode
+}
+
+func TestMRT(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing bool // the record exists before the transaction, with v=1
+		txn      func(asd Backend, mrt *MRT, k *aerospike.Key) aerospike.Error
+		commit   bool
+		want     interface{} // v after the transaction, nil for no record
+		wantErr  types.ResultCode
+	}{
+		{"create, commit", false, putV(2), true, 2, 0},
+		{"create, abort", false, putV(2), false, nil, 0},
+		{"update, commit", true, putV(2), true, 2, 0},
+		{"update, abort", true, putV(2), false, 1, 0},
+		{"delete, commit", true, deleteV, true, nil, 0},
+		{"delete, abort", true, deleteV, false, 1, 0},
+		{"add, commit", true, func(asd Backend, mrt *MRT, k *aerospike.Key) aerospike.Error {
+			_, err := asd.Operate(mrt.Write(), k, AddOp("v", 2), AddOp("v", 3))
+			return err
+		}, true, 6, 0},
+		{"read changed by another writer", true, func(asd Backend, mrt *MRT, k *aerospike.Key) aerospike.Error {
+			if _, err := asd.Get(mrt.Read(), k); err != nil {
+				return err
+			}
+			return asd.PutBins(GetWritePolicyNoMRT(asd, &cfgTimeout{}), k, aerospike.NewBin("v", 3))
+		}, true, 3, types.MRT_VERSION_MISMATCH},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, _ := newTestFS(t, 8)
+			k, err := aerospike.NewKey(f.cfg.Aerospike.Namespace, f.cfg.setName("test"), tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.existing {
+				if err := f.asd.PutBins(GetWritePolicyNoMRT(f.asd, &f.cfg.Aerospike.Timeouts), k, aerospike.NewBin("v", 1)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			before := getV(t, f.asd, k)
+			mrt := GetPolicies(f.asd, &f.cfg.Aerospike.Timeouts)
+			if err := tt.txn(f.asd, mrt, k); err != nil {
+				t.Fatal(err)
+			}
+			// uncommitted writes are not seen outside of the transaction
+			if tt.wantErr == 0 {
+				if got := getV(t, f.asd, k); got != before {
+					t.Fatalf("uncommitted v=%v seen, want %v", got, before)
+				}
+			}
+			var xerr error
+			if tt.commit {
+				xerr = mrt.Commit()
+			} else {
+				xerr = mrt.Abort()
+			}
+			if tt.wantErr != 0 {
+				if ae, ok := xerr.(aerospike.Error); !ok || !ae.Matches(tt.wantErr) {
+					t.Fatalf("Commit: %v, want %v", xerr, tt.wantErr)
+				}
+			} else if xerr != nil {
+				t.Fatal(xerr)
+			}
+			if got := getV(t, f.asd, k); got != tt.want {
+				t.Fatalf("v=%v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func putV(v int) func(asd Backend, mrt *MRT, k *aerospike.Key) aerospike.Error {
+	return func(asd Backend, mrt *MRT, k *aerospike.Key) aerospike.Error {
+		return asd.PutBins(mrt.Write(), k, aerospike.NewBin("v", v))
+	}
+}
+
+func deleteV(asd Backend, mrt *MRT, k *aerospike.Key) aerospike.Error {
+	_, err := asd.Delete(mrt.Write(), k)
+	return err
+}
+
+// getV returns the v bin of record k outside of any transaction, nil if there is no record
+func getV(t *testing.T, asd Backend, k *aerospike.Key) interface{} {
+	t.Helper()
+	r, err := asd.Get(GetReadPolicyNoMRT(asd, &cfgTimeout{}), k, "v")
+	if err != nil {
+		if err.Matches(aerospike.ErrKeyNotFound.ResultCode) {
+			return nil
+		}
+		t.Fatal(err)
+	}
+	return r.Bins["v"]
+}
+
+func TestMRTBlocked(t *testing.T) {
+	f, _ := newTestFS(t, 8)
+	k, err := aerospike.NewKey(f.cfg.Aerospike.Namespace, f.cfg.setName("test"), "blocked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mrt := GetPolicies(f.asd, &f.cfg.Aerospike.Timeouts)
+	if err := f.asd.PutBins(mrt.Write(), k, aerospike.NewBin("v", 1)); err != nil {
+		t.Fatal(err)
+	}
+	// records written by a transaction cannot be written by others until it ends
+	err = f.asd.PutBins(GetWritePolicyNoMRT(f.asd, &f.cfg.Aerospike.Timeouts), k, aerospike.NewBin("v", 2))
+	if err == nil || !err.Matches(types.MRT_BLOCKED) {
+		t.Fatalf("write of a record in a transaction: %v, want MRT_BLOCKED", err)
+	}
+	if err := mrt.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.asd.PutBins(GetWritePolicyNoMRT(f.asd, &f.cfg.Aerospike.Timeouts), k, aerospike.NewBin("v", 2)); err != nil {
+		t.Fatal(err)
+	}
+	if got := getV(t, f.asd, k); got != 2 {
+		t.Fatalf("v=%v, want 2", got)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	iofs "io/fs"
+	"os"
+
+	"bazil.org/fuse"
+	"github.com/aerospike/aerospike-client-go/v8"
+)
+
+// number of inodes migrated between progress updates of the migration cursor
+const migrateProgress = 1000
+
+// migrateCmd upgrades the on-disk format of a filesystem to the current version, inode by inode
+// the filesystem can stay mounted by clients of this version, which read both layouts; the migration cursor is kept
+// in the format record, so an interrupted migration resumes where it stopped
+func migrateCmd(args []string) {
+	if len(args) < 1 {
+		fmt.Printf("Usage: %s migrate /path/to/config.yaml\n", os.Args[0])
+		os.Exit(1)
+	}
+	c, err := NewConfigFromFile(args[0])
+	if err != nil {
+		log.Critical("%s", err)
+	}
+	log.SetLogLevel(c.Log.Level)
+	log.SetPrefix("asd-fs: ")
+	var keys *keyring
+	if c.FS.Encryption.KeyFile != "" {
+		keys, err = loadKeyring(c.FS.Encryption.KeyFile)
+		if err != nil {
+			log.Critical("%s", err)
+		}
+	}
+	asd, err := Connect(c, keys)
+	if err != nil {
+		log.Critical("%s", err)
+	}
+	defer asd.Close()
+	version, err := checkFormat(asd, c, keys)
+	if err != nil {
+		log.Critical("%s", err)
+	}
+	if c.MountParams.RO {
+		log.Critical("Filesystem uses features not supported by this version of asdfs, cannot migrate")
+	}
+	if version >= formatVersion {
+		fmt.Printf("Filesystem format is at version %d, nothing to migrate\n", version)
+		return
+	}
+	f := &FS{
+		asd:  asd,
+		cfg:  c,
+		keys: keys,
+	}
+	wp := GetWritePolicyNoMRT(asd, &c.Aerospike.Timeouts)
+	fk, err := formatKey(c)
+	if err != nil {
+		log.Critical("%s", err)
+	}
+	r, err := asd.Get(GetReadPolicyNoMRT(asd, &c.Aerospike.Timeouts), fk, "MigrateFrom")
+	if err != nil {
+		log.Critical("%s", err)
+	}
+	from, ok := r.Bins["MigrateFrom"].(int)
+	if !ok {
+		from = 1
+	}
+	lk, err := aerospike.NewKey(c.Aerospike.Namespace, c.setName("meta"), "lastInode")
+	if err != nil {
+		log.Critical("%s", err)
+	}
+	r, err = asd.Get(GetReadPolicyNoMRT(asd, &c.Aerospike.Timeouts), lk, "lastInode")
+	if err != nil {
+		log.Critical("%s", err)
+	}
+	// inodes created from now on are written in the current format already
+	last := r.Bins["lastInode"].(int)
+	fmt.Printf("Migrating inodes %d-%d from format version %d to %d\n", from, last, version, formatVersion)
+	for inode := from; inode <= last; inode++ {
+		err = f.migrateInode(uint64(inode), version)
+		if err != nil {
+			log.Critical("Inode %d: %s (rerun to resume)", inode, err)
+		}
+		if inode%migrateProgress == 0 || inode == last {
+			err = asd.PutBins(wp, fk, aerospike.NewBin("MigrateFrom", inode+1))
+			if err != nil {
+				log.Critical("%s", err)
+			}
+			fmt.Printf("Migrated %d/%d inodes\n", inode, last)
+		}
+	}
+	err = asd.PutBins(wp, fk, aerospike.NewBin("Version", formatVersion), aerospike.NewBin("MigrateFrom", nil))
+	if err != nil {
+		log.Critical("%s", err)
+	}
+	fmt.Printf("Filesystem format upgraded to version %d\n", formatVersion)
+}
+
+// migrateInode rewrites a single inode record (and its content) from format version to the current format
+// every step is idempotent, so inodes migrated again by a resumed migration stay intact
+func (f *FS) migrateInode(inode uint64, version int) error {
+	k, err := aerospike.NewKey(f.cfg.Aerospike.Namespace, f.cfg.setName("fs"), int(inode))
+	if err != nil {
+		return err
+	}
+	mrt := GetPolicies(f.asd, &f.cfg.Aerospike.Timeouts)
+	r, err := f.asd.Get(mrt.Read(), k, "Atime", "Ctime", "Mtime", "Ls", "data", "Mode", "Blocks")
+	if err != nil {
+		mrt.Abort()
+		if err.Matches(aerospike.ErrKeyNotFound.ResultCode) {
+			// deleted inode
+			return nil
+		}
+		return err
+	}
+	dir := iofs.FileMode(r.Bins["Mode"].(int)).IsDir()
+	ops := []*Op{}
+	if version < 2 {
+		// version 1 stored RFC3339 strings
+		for _, name := range []string{"Atime", "Ctime", "Mtime"} {
+			if s, ok := r.Bins[name].(string); ok {
+				ops = append(ops, PutOp(name, TimeToDB(DBToTime(s))))
+			}
+		}
+		// version 1 created `Ls` maps unordered
+		if r.Bins["Ls"] != nil {
+			ops = append(ops, MapKeyOrderOp("Ls"))
+		}
+	}
+	// version 3 stored directories with a phantom 8MiB block
+	if blocks, _ := r.Bins["Blocks"].(int); version < 4 && blocks > 0 && dir {
+		ops = append(ops, PutOp("Blocks", 0), PutOp("Size", 0))
+	}
+	if len(ops) > 0 {
+		log.Detail("ASD: migrateInode: Operate(%v) %v", mrt.Id(), k)
+		_, err = f.asd.Operate(mrt.Write(), k, ops...)
+		if err != nil {
+			mrt.Abort()
+			return err
+		}
+	}
+	// version 1 stored file content inline
+	if _, ok := r.Bins["data"].([]byte); ok && version < 2 {
+		xerr := f.upgradeInline(mrt, inode)
+		if xerr != nil {
+			mrt.Abort()
+			return xerr
+		}
+	}
+	// version 3 did not count usage, expiring inodes are never counted; neither did it mark the directories holding
+	// entries of expiring inodes
+	if version < 4 {
+		r, err = f.asd.Get(mrt.Read(), k, "Mode", "Blocks", "BlockSize", "Counted", "Expires", "Parents")
+		if err != nil {
+			mrt.Abort()
+			return err
+		}
+		if r.Bins["Expires"] == nil {
+			err = f.setCounted(mrt, mrt.Write(), inode, k, r.Bins, true)
+		} else {
+			err = f.markParentsExpiring(mrt, r.Bins["Parents"])
+		}
+		if err != nil {
+			mrt.Abort()
+			return err
+		}
+	}
+	xerr := mrt.Commit()
+	if xerr != nil {
+		return xerr
+	}
+	// version 2 did not record parents, nor count subdirectories
+	if dir && version < 3 {
+		return f.linkChildren(inode, k)
+	}
+	return nil
+}
+
+// number of directory entries linked to their parent per transaction, keeping transactions on huge (sharded)
+// directories within the limits
+const migrateLinkBatch = 100
+
+// linkChildren records directory dir as the parent of its entries, a page of entries per transaction, marks it if
+// any of them expires, and then sets its link count; recording a parent again is harmless, so an interrupted run is completed by running it again
+// subdirectories created or removed by mounted clients while the entries are paged may leave the link count off
+func (f *FS) linkChildren(dir uint64, dirKey *aerospike.Key) error {
+	wp := GetWritePolicyNoMRT(f.asd, &f.cfg.Aerospike.Timeouts)
+	shards, err := f.dirShards(wp, -1, dir, dirKey)
+	if err != nil {
+		return err
+	}
+	nlink := 2
+	for shard := 0; shard == 0 || shard < shards; shard++ {
+		after := ""
+		for {
+			entries, err := f.pageEntries(wp, -1, dir, dirKey, shards, shard, after, migrateLinkBatch)
+			if err != nil {
+				return err
+			}
+			mrt := GetPolicies(f.asd, &f.cfg.Aerospike.Timeouts)
+			for _, e := range entries {
+				v := e.Value.(map[interface{}]interface{})
+				if fuse.DirentType(v["Type"].(int)) == fuse.DT_Dir {
+					nlink++
+				}
+				ck, err := aerospike.NewKey(f.cfg.Aerospike.Namespace, f.cfg.setName("fs"), v["Inode"].(int))
+				if err != nil {
+					mrt.Abort()
+					return err
+				}
+				log.Detail("ASD: linkChildren: MapPutOp(%v) %v", mrt.Id(), ck)
+				wp := *mrt.Write()
+				wp.RecordExistsAction = aerospike.UPDATE_ONLY
+				cr, err := f.asd.Operate(&wp, ck, addParentOp(dir, e.Key.(string)), GetOp("Expires"))
+				if err != nil {
+					if err.Matches(aerospike.ErrKeyNotFound.ResultCode) {
+						continue
+					}
+					mrt.Abort()
+					return err
+				}
+				if cr.Bins["Expires"] != nil {
+					err = f.markExpiring(mrt, dirKey)
+					if err != nil {
+						mrt.Abort()
+						return err
+					}
+				}
+			}
+			xerr := mrt.Commit()
+			if xerr != nil {
+				return xerr
+			}
+			if len(entries) < migrateLinkBatch {
+				break
+			}
+			after = entries[len(entries)-1].Key.(string)
+		}
+	}
+	log.Detail("ASD: linkChildren: PutOp %v", dirKey)
+	_, err = f.asd.Operate(wp, dirKey, PutOp("Nlink", nlink))
+	return err
+}
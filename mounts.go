@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"time"
+
+	"github.com/aerospike/aerospike-client-go/v8"
+)
+
+// every mount registers itself in the "mounts" set under a random id and keeps updating its Heartbeat bin while mounted
+// state held on behalf of a mount (e.g. open file handles) is considered stale once its heartbeat is older than
+// mountStaleAfter, or its record is gone
+const (
+	mountHeartbeat  = 10 * time.Second
+	mountStaleAfter = 6 * mountHeartbeat
+)
+
+func (f *FS) mountKey(id string) (*aerospike.Key, aerospike.Error) {
+	return aerospike.NewKey(f.cfg.Aerospike.Namespace, f.cfg.setName("mounts"), id)
+}
+
+// registerMount creates the mount record of this mount and starts its heartbeat
+func (f *FS) registerMount() error {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	f.mountId = hex.EncodeToString(id)
+	k, err := f.mountKey(f.mountId)
+	if err != nil {
+		return err
+	}
+	host, _ := os.Hostname()
+	bins := make(aerospike.BinMap)
+	bins["Host"] = host
+	bins["Pid"] = os.Getpid()
+	bins["MountDir"] = f.cfg.MountDir
+	bins["Started"] = TimeToDB(time.Now())
+	bins["Heartbeat"] = bins["Started"]
+	log.Detail("ASD: registerMount: Put %v", k)
+	err = f.asd.Put(GetWritePolicyNoMRT(f.asd, &f.cfg.Aerospike.Timeouts), k, bins)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for {
+			time.Sleep(mountHeartbeat)
+			err := f.asd.PutBins(GetWritePolicyNoMRT(f.asd, &f.cfg.Aerospike.Timeouts), k, aerospike.NewBin("Heartbeat", TimeToDB(time.Now())))
+			if err != nil {
+				log.Warn("Mount heartbeat: %s", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// unmounted writes the pending access times and releases the locks and the record of this mount, once, whether the
+// filesystem was unmounted or the process stopped by a signal
+func (f *FS) unmounted() {
+	f.teardown.Do(func() {
+		f.flushAtimes()
+		f.dropMountLocks()
+		f.deregisterMount()
+	})
+}
+
+// deregisterMount removes the mount record on clean unmount
+func (f *FS) deregisterMount() {
+	k, err := f.mountKey(f.mountId)
+	if err != nil {
+		log.Warn("Deregister mount: %s", err)
+		return
+	}
+	_, err = f.asd.Delete(GetWritePolicyNoMRT(f.asd, &f.cfg.Aerospike.Timeouts), k)
+	if err != nil {
+		log.Warn("Deregister mount: %s", err)
+	}
+}
+
+// mountAlive returns whether the mount with the given id is still heartbeating
+func (f *FS) mountAlive(id string) (bool, error) {
+	if id == f.mountId {
+		return true, nil
+	}
+	k, err := f.mountKey(id)
+	if err != nil {
+		return false, err
+	}
+	r, err := f.asd.Get(GetReadPolicyNoMRT(f.asd, &f.cfg.Aerospike.Timeouts), k, "Heartbeat")
+	if err != nil {
+		if err.Matches(aerospike.ErrKeyNotFound.ResultCode) {
+			return false, nil
+		}
+		return false, err
+	}
+	return time.Since(DBToTime(r.Bins["Heartbeat"])) < mountStaleAfter, nil
+}
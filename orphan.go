@@ -0,0 +1,269 @@
+package main
+
+import (
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aerospike/aerospike-client-go/v8"
+	"github.com/aerospike/aerospike-client-go/v8/types"
+)
+
+// open files are recorded in the "Open" map bin of their inode record as {mountId: 1}, while any handle of that mount is open
+// files unlinked while open somewhere are not deleted, but listed in the meta/orphans record; the last mount
+// releasing the file deletes it, and orphans held open by crashed mounts are deleted by the next mount
+
+// retries of single record operations blocked by a transaction in progress on the same record
+const (
+	blockedRetries = 50
+	blockedBackoff = 10 * time.Millisecond
+)
+
+func retryBlocked(op func() aerospike.Error) aerospike.Error {
+	var err aerospike.Error
+	for i := 0; i < blockedRetries; i++ {
+		err = op()
+		if err == nil || !err.Matches(types.MRT_BLOCKED) {
+			return err
+		}
+		time.Sleep(blockedBackoff)
+	}
+	return err
+}
+
+// read op returning the number of mounts having the inode open
+func openCountOp() *Op {
+	return MapSizeOp("OpenCount", "Open")
+}
+
+func (f *FS) orphansKey() (*aerospike.Key, aerospike.Error) {
+	return aerospike.NewKey(f.cfg.Aerospike.Namespace, f.cfg.setName("meta"), "orphans")
+}
+
+// openCount tracks the open handles of this mount on an inode; lock serializes the updates of the "Open" bin of the
+// inode, so opens and releases of other inodes do not wait for them, and refs counts the goroutines using the entry,
+// which is dropped once unused with no handle open
+// handles is changed holding both lock and FS.openLock, refs holding FS.openLock
+type openCount struct {
+	lock    sync.Mutex
+	handles int
+	refs    int
+}
+
+// openEntry returns the open handle count of an inode, to be returned with putOpenEntry
+func (f *FS) openEntry(inode uint64) *openCount {
+	f.openLock.Lock()
+	defer f.openLock.Unlock()
+	c := f.open[inode]
+	if c == nil {
+		c = &openCount{}
+		f.open[inode] = c
+	}
+	c.refs++
+	return c
+}
+
+func (f *FS) putOpenEntry(inode uint64, c *openCount) {
+	f.openLock.Lock()
+	defer f.openLock.Unlock()
+	c.refs--
+	if c.refs == 0 && c.handles == 0 {
+		delete(f.open, inode)
+	}
+}
+
+func (f *FS) addHandles(c *openCount, delta int) {
+	f.openLock.Lock()
+	c.handles += delta
+	f.openLock.Unlock()
+}
+
+// openInode records a new open handle of this mount for the inode, ENOENT if the inode is gone
+func (f *FS) openInode(inode uint64) error {
+	c := f.openEntry(inode)
+	defer f.putOpenEntry(inode, c)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.handles > 0 {
+		f.addHandles(c, 1)
+		return nil
+	}
+	k, err := aerospike.NewKey(f.cfg.Aerospike.Namespace, f.cfg.setName("fs"), int(inode))
+	if err != nil {
+		return err
+	}
+	// never recreate an inode deleted by another mount meanwhile
+	wp := GetWritePolicyNoMRT(f.asd, &f.cfg.Aerospike.Timeouts)
+	wp.RecordExistsAction = aerospike.UPDATE_ONLY
+	err = retryBlocked(func() aerospike.Error {
+		log.Detail("ASD: openInode: MapPutOp %v", k)
+		_, err := f.asd.Operate(wp, k, MapPutOp("Open", f.mountId, 1, false))
+		return err
+	})
+	if err != nil {
+		if err.Matches(aerospike.ErrKeyNotFound.ResultCode) {
+			return syscall.ENOENT
+		}
+		return err
+	}
+	f.addHandles(c, 1)
+	return nil
+}
+
+// releaseInode drops an open handle of this mount, deleting the inode if it was the last open handle of an unlinked file
+func (f *FS) releaseInode(inode uint64) error {
+	c := f.openEntry(inode)
+	defer f.putOpenEntry(inode, c)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.handles == 0 {
+		return nil
+	}
+	f.addHandles(c, -1)
+	if c.handles > 0 {
+		return nil
+	}
+	k, err := aerospike.NewKey(f.cfg.Aerospike.Namespace, f.cfg.setName("fs"), int(inode))
+	if err != nil {
+		return err
+	}
+	var r *aerospike.Record
+	err = retryBlocked(func() aerospike.Error {
+		log.Detail("ASD: releaseInode: MapRemoveByKeyOp %v", k)
+		var err aerospike.Error
+		r, err = f.asd.Operate(GetWritePolicyNoMRT(f.asd, &f.cfg.Aerospike.Timeouts), k, MapRemoveOp("Open", f.mountId), GetOp("Nlink"), openCountOp())
+		return err
+	})
+	if err != nil {
+		if err.Matches(aerospike.ErrKeyNotFound.ResultCode) {
+			return nil
+		}
+		return err
+	}
+	nlink, _ := r.Bins["Nlink"].(int)
+	openCount, _ := r.Bins["OpenCount"].(int)
+	if nlink == 0 && openCount == 0 {
+		return f.reapOrphan(inode)
+	}
+	return nil
+}
+
+// addOrphan lists an unlinked inode that is still open
+func (f *FS) addOrphan(mrt *MRT, inode uint64) error {
+	k, err := f.orphansKey()
+	if err != nil {
+		return err
+	}
+	log.Detail("ASD: addOrphan: MapPutOp(%v) %v %d", mrt.Id(), k, inode)
+	_, err = f.asd.Operate(mrt.Write(), k, MapPutOp("Inodes", int(inode), TimeToDB(time.Now()), false))
+	return err
+}
+
+// reapOrphan deletes an orphaned inode, its content and its orphan list entry, unless it got opened again meanwhile
+func (f *FS) reapOrphan(inode uint64) error {
+	k, err := aerospike.NewKey(f.cfg.Aerospike.Namespace, f.cfg.setName("fs"), int(inode))
+	if err != nil {
+		return err
+	}
+	orphans, err := f.orphansKey()
+	if err != nil {
+		return err
+	}
+	mrt := GetPolicies(f.asd, &f.cfg.Aerospike.Timeouts)
+	r, err := f.asd.Get(mrt.Read(), k, "Nlink", "Open", "Size", "BlockSize", "XattrRecord", "Mode", "Blocks", "Counted")
+	if err != nil && !err.Matches(aerospike.ErrKeyNotFound.ResultCode) {
+		mrt.Abort()
+		return err
+	}
+	if r != nil {
+		if nlink, _ := r.Bins["Nlink"].(int); nlink > 0 || len(lsPairs(r.Bins["Open"])) > 0 {
+			mrt.Abort()
+			return nil
+		}
+		log.Debug("Deleting orphaned inode %d", inode)
+		// records without a BlockSize are no complete inode, and have no content
+		if blockSize, ok := r.Bins["BlockSize"].(int); ok {
+			size, _ := r.Bins["Size"].(int)
+			_, xerr := f.truncateBlocks(mrt, inode, blockSize, size, 0)
+			if xerr != nil {
+				mrt.Abort()
+				return xerr
+			}
+		}
+		_, err = f.asd.Delete(mrt.Write(), k)
+		if err != nil {
+			mrt.Abort()
+			return err
+		}
+		err = f.addUsage(mrt, inode, r.Bins["Counted"], -contentBytes(r.Bins), -1)
+		if err != nil {
+			mrt.Abort()
+			return err
+		}
+		if r.Bins["XattrRecord"] != nil {
+			err = f.deleteXattrs(mrt, inode)
+			if err != nil {
+				mrt.Abort()
+				return err
+			}
+		}
+	}
+	log.Detail("ASD: reapOrphan: MapRemoveByKeyOp(%v) %v %d", mrt.Id(), orphans, inode)
+	_, err = f.asd.Operate(mrt.Write(), orphans, MapRemoveOp("Inodes", int(inode)))
+	if err != nil && !err.Matches(aerospike.ErrKeyNotFound.ResultCode) {
+		mrt.Abort()
+		return err
+	}
+	return mrt.Commit()
+}
+
+// cleanupOrphans drops open handles of dead mounts from orphaned inodes, deleting those no longer open anywhere
+func (f *FS) cleanupOrphans() error {
+	orphans, err := f.orphansKey()
+	if err != nil {
+		return err
+	}
+	r, err := f.asd.Get(GetReadPolicyNoMRT(f.asd, &f.cfg.Aerospike.Timeouts), orphans, "Inodes")
+	if err != nil {
+		if err.Matches(aerospike.ErrKeyNotFound.ResultCode) {
+			return nil
+		}
+		return err
+	}
+	for _, e := range lsPairs(r.Bins["Inodes"]) {
+		inode := uint64(e.Key.(int))
+		k, err := aerospike.NewKey(f.cfg.Aerospike.Namespace, f.cfg.setName("fs"), int(inode))
+		if err != nil {
+			return err
+		}
+		ir, err := f.asd.Get(GetReadPolicyNoMRT(f.asd, &f.cfg.Aerospike.Timeouts), k, "Open")
+		if err != nil && !err.Matches(aerospike.ErrKeyNotFound.ResultCode) {
+			return err
+		}
+		if ir != nil {
+			for _, e := range lsPairs(ir.Bins["Open"]) {
+				id := e.Key
+				alive, xerr := f.mountAlive(id.(string))
+				if xerr != nil {
+					return xerr
+				}
+				if alive {
+					continue
+				}
+				log.Debug("Orphan %d: dropping open handles of dead mount %s", inode, id)
+				err = retryBlocked(func() aerospike.Error {
+					_, err := f.asd.Operate(GetWritePolicyNoMRT(f.asd, &f.cfg.Aerospike.Timeouts), k, MapRemoveOp("Open", id))
+					return err
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+		xerr := f.reapOrphan(inode)
+		if xerr != nil {
+			return xerr
+		}
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/aerospike/aerospike-client-go/v8"
+)
+
+// every inode lists the directory entries linking to it in its "Parents" map bin, "dir/storedName" -> dir inode, so
+// hard linked files have several; they are kept in the same transaction as the entries themselves
+// directories count their subdirectories in Nlink (2 + subdirectories), directories of filesystems not migrated to
+// format version 3 yet have no parents and an Nlink of 1 until `asdfs migrate` is run
+
+// maximum directory depth followed when resolving paths
+const maxPathDepth = 4096
+
+type parentLink struct {
+	dir  uint64
+	name string // stored name
+}
+
+func parentItem(dir uint64, name string) string {
+	return fmt.Sprintf("%d/%s", dir, name)
+}
+
+// newParents returns the "Parents" bin of an inode created as entry name of directory dir
+func newParents(dir uint64, name string) map[interface{}]interface{} {
+	return map[interface{}]interface{}{parentItem(dir, name): int(dir)}
+}
+
+func addParentOp(dir uint64, name string) *Op {
+	return MapPutOp("Parents", parentItem(dir, name), int(dir), false)
+}
+
+func removeParentOp(dir uint64, name string) *Op {
+	return MapRemoveOp("Parents", parentItem(dir, name))
+}
+
+// parentLinks returns the links of a "Parents" bin value
+func parentLinks(v interface{}) []parentLink {
+	links := []parentLink{}
+	for _, e := range lsPairs(v) {
+		_, name, _ := strings.Cut(e.Key.(string), "/")
+		links = append(links, parentLink{dir: uint64(e.Value.(int)), name: name})
+	}
+	return links
+}
+
+// addSubdirs changes the link count of a directory by the number of subdirectories added (or removed, if negative)
+// the count never drops below 2, as directories of older filesystems did not count their subdirectories
+func (f *FS) addSubdirs(mrt *MRT, dirKey *aerospike.Key, delta int) aerospike.Error {
+	log.Detail("ASD: addSubdirs: GetOp(%v) %v", mrt.Id(), dirKey)
+	r, err := f.asd.Operate(mrt.Write(), dirKey, GetOp("Nlink"))
+	if err != nil {
+		return err
+	}
+	nlink := r.Bins["Nlink"].(int)
+	if nlink+delta < 2 {
+		delta = 2 - nlink
+	}
+	if delta == 0 {
+		return nil
+	}
+	log.Detail("ASD: addSubdirs: AddOp(%v) %v %d", mrt.Id(), dirKey, delta)
+	_, err = f.asd.Operate(mrt.Write(), dirKey, AddOp("Nlink", delta))
+	return err
+}
+
+// inodeParents returns the links to an inode
+func (f *FS) inodeParents(inode uint64) ([]parentLink, error) {
+	k, err := aerospike.NewKey(f.cfg.Aerospike.Namespace, f.cfg.setName("fs"), int(inode))
+	if err != nil {
+		return nil, err
+	}
+	r, err := f.asd.Get(GetReadPolicyNoMRT(f.asd, &f.cfg.Aerospike.Timeouts), k, "Parents")
+	if err != nil {
+		return nil, err
+	}
+	links := parentLinks(r.Bins["Parents"])
+	if len(links) == 0 {
+		return nil, fmt.Errorf("inode %d has no parent recorded", inode)
+	}
+	return links, nil
+}
+
+// isAncestor returns whether directory anc is dir itself or one of its ancestors; the parent chain of dir is read in
+// the transaction, so that a concurrent rename of any directory on it fails the commit; the walk stops at directories
+// of filesystems not migrated to format version 3, which have no parents recorded
+func (f *FS) isAncestor(mrt *MRT, anc uint64, dir uint64) (bool, error) {
+	for depth := 0; dir != anc; depth++ {
+		if dir == 1 {
+			return false, nil
+		}
+		if depth == maxPathDepth {
+			return false, fmt.Errorf("inode %d: path deeper than %d directories", dir, maxPathDepth)
+		}
+		k, err := aerospike.NewKey(f.cfg.Aerospike.Namespace, f.cfg.setName("fs"), int(dir))
+		if err != nil {
+			return false, err
+		}
+		log.Detail("ASD: isAncestor: Get(%v) %v", mrt.Id(), k)
+		r, err := f.asd.Get(mrt.Read(), k, "Parents")
+		if err != nil {
+			return false, err
+		}
+		links := parentLinks(r.Bins["Parents"])
+		if len(links) == 0 {
+			return false, nil
+		}
+		dir = links[0].dir
+	}
+	return true, nil
+}
+
+// parentOf returns the parent directory of a directory, the root being its own parent
+func (f *FS) parentOf(dir uint64) (uint64, error) {
+	if dir == 1 {
+		return 1, nil
+	}
+	links, err := f.inodeParents(dir)
+	if err != nil {
+		return 0, err
+	}
+	return links[0].dir, nil
+}
+
+// inodePaths returns the paths of an inode relative to the filesystem root, one per hard link
+func (f *FS) inodePaths(inode uint64) ([]string, error) {
+	if inode == 1 {
+		return []string{"/"}, nil
+	}
+	links, err := f.inodeParents(inode)
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{}
+	for _, l := range links {
+		p := ""
+		// directories have a single parent, so the rest of the path is unique
+		for depth := 0; ; depth++ {
+			if depth == maxPathDepth {
+				return nil, fmt.Errorf("inode %d: path deeper than %d directories", inode, maxPathDepth)
+			}
+			name, err := f.plainName(l.dir, l.name)
+			if err != nil {
+				return nil, err
+			}
+			p = path.Join(name, p)
+			if l.dir == 1 {
+				break
+			}
+			dlinks, err := f.inodeParents(l.dir)
+			if err != nil {
+				return nil, err
+			}
+			l = dlinks[0]
+		}
+		paths = append(paths, "/"+p)
+	}
+	return paths, nil
+}
+
+// pathCmd prints the paths of an inode, e.g. one seen in the logs
+func pathCmd(args []string) {
+	if len(args) < 2 {
+		fmt.Printf("Usage: %s path /path/to/config.yaml inode\n", os.Args[0])
+		os.Exit(1)
+	}
+	c, err := NewConfigFromFile(args[0])
+	if err != nil {
+		log.Critical("%s", err)
+	}
+	log.SetLogLevel(c.Log.Level)
+	log.SetPrefix("asd-fs: ")
+	inode, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil || inode == 0 {
+		log.Critical("Invalid inode number %s", args[1])
+	}
+	var keys *keyring
+	if c.FS.Encryption.KeyFile != "" {
+		keys, err = loadKeyring(c.FS.Encryption.KeyFile)
+		if err != nil {
+			log.Critical("%s", err)
+		}
+	}
+	asd, err := openBackend(c)
+	if err != nil {
+		log.Critical("%s", err)
+	}
+	defer asd.Close()
+	f := &FS{
+		asd:  asd,
+		cfg:  c,
+		keys: keys,
+	}
+	paths, err := f.inodePaths(inode)
+	if err != nil {
+		if aerr, ok := err.(aerospike.Error); ok && aerr.Matches(aerospike.ErrKeyNotFound.ResultCode) {
+			log.Critical("Inode %d does not exist", inode)
+		}
+		log.Critical("%s", err)
+	}
+	for _, p := range paths {
+		fmt.Println(p)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"bazil.org/fuse"
+)
+
+func testNlink(t *testing.T, d *Dir) uint32 {
+	t.Helper()
+	a := &fuse.Attr{}
+	if err := d.Attr(context.Background(), a); err != nil {
+		t.Fatalf("Attr: %s", err)
+	}
+	return a.Nlink
+}
+
+func testPaths(t *testing.T, f *FS, inode uint64) []string {
+	t.Helper()
+	paths, err := f.inodePaths(inode)
+	if err != nil {
+		t.Fatalf("inodePaths %d: %s", inode, err)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestDirNlink(t *testing.T) {
+	ctx := context.Background()
+	_, root := newTestFS(t, 8)
+	a := testMkdir(t, root, "a")
+	b := testMkdir(t, root, "b")
+	testMkdir(t, a, "sub1")
+	testMkdir(t, a, "sub2")
+	testCreate(t, a, "file", "")
+	if n := testNlink(t, a); n != 4 {
+		t.Fatalf("Nlink %d after mkdir, want 4", n)
+	}
+	if err := a.Remove(ctx, &fuse.RemoveRequest{Name: "sub1", Dir: true}); err != nil {
+		t.Fatalf("Rmdir: %s", err)
+	}
+	if err := a.Remove(ctx, &fuse.RemoveRequest{Name: "file"}); err != nil {
+		t.Fatalf("Unlink: %s", err)
+	}
+	if n := testNlink(t, a); n != 3 {
+		t.Fatalf("Nlink %d after rmdir, want 3", n)
+	}
+	// moving a subdirectory moves its link to .. to the new parent
+	if err := a.Rename(ctx, &fuse.RenameRequest{OldName: "sub2", NewName: "sub2"}, b); err != nil {
+		t.Fatalf("Rename: %s", err)
+	}
+	if n := testNlink(t, a); n != 2 {
+		t.Fatalf("Nlink %d of the old parent after rename, want 2", n)
+	}
+	if n := testNlink(t, b); n != 3 {
+		t.Fatalf("Nlink %d of the new parent after rename, want 3", n)
+	}
+	// replacing an existing directory drops its link
+	testMkdir(t, b, "sub3")
+	if err := b.Rename(ctx, &fuse.RenameRequest{OldName: "sub2", NewName: "sub3"}, b); err != nil {
+		t.Fatalf("Rename over directory: %s", err)
+	}
+	if n := testNlink(t, b); n != 3 {
+		t.Fatalf("Nlink %d after rename over a directory, want 3", n)
+	}
+	if err := root.Remove(ctx, &fuse.RemoveRequest{Name: "a", Dir: true}); err != nil {
+		t.Fatalf("Rmdir: %s", err)
+	}
+	if n := testNlink(t, root); n != 3 {
+		t.Fatalf("Nlink %d of the root, want 3", n)
+	}
+}
+
+func TestInodePaths(t *testing.T) {
+	ctx := context.Background()
+	f, root := newTestFS(t, 8)
+	a := testMkdir(t, root, "a")
+	b := testMkdir(t, a, "b")
+	file := testCreate(t, b, "file", "")
+	if got, want := testPaths(t, f, file.inode), []string{"/a/b/file"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("paths %v, want %v", got, want)
+	}
+	if _, err := root.Link(ctx, &fuse.LinkRequest{NewName: "link"}, file); err != nil {
+		t.Fatalf("Link: %s", err)
+	}
+	if got, want := testPaths(t, f, file.inode), []string{"/a/b/file", "/link"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("paths %v after link, want %v", got, want)
+	}
+	// renaming a directory changes the paths of everything below it
+	if err := a.Rename(ctx, &fuse.RenameRequest{OldName: "b", NewName: "c"}, root); err != nil {
+		t.Fatalf("Rename: %s", err)
+	}
+	if got, want := testPaths(t, f, file.inode), []string{"/c/file", "/link"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("paths %v after rename, want %v", got, want)
+	}
+	if err := root.Remove(ctx, &fuse.RemoveRequest{Name: "link"}); err != nil {
+		t.Fatalf("Unlink: %s", err)
+	}
+	if got, want := testPaths(t, f, file.inode), []string{"/c/file"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("paths %v after unlink, want %v", got, want)
+	}
+	if got, want := testPaths(t, f, b.inode), []string{"/c"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("paths %v of the directory, want %v", got, want)
+	}
+}
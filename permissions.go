@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	iofs "io/fs"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+	"github.com/aerospike/aerospike-client-go/v8"
+)
+
+// permission checking, selected with mountParams.permissions:
+// filesystem - asdfs checks the Mode, owner and ACLs of inodes against the uid and groups of the caller in each
+// operation, root bypassing all checks but execute
+// kernel - the default_permissions mount option, the kernel checks the Mode bits itself but ignores ACLs
+// none - no checks, any user may do anything (unless the mount is restricted to its owner, without allow_other)
+const (
+	permsFilesystem = "filesystem"
+	permsKernel     = "kernel"
+	permsNone       = "none"
+)
+
+// callerGroups returns the groups of the process making a request: its filesystem gid and supplementary groups
+// the supplementary groups are read from /proc, and missing if the process has exited or is in another pid namespace
+func callerGroups(hdr *fuse.Header) []uint32 {
+	groups := []uint32{hdr.Gid}
+	if hdr.Pid == 0 {
+		return groups
+	}
+	status, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", hdr.Pid))
+	if err != nil {
+		return groups
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		list, ok := strings.CutPrefix(line, "Groups:")
+		if !ok {
+			continue
+		}
+		for _, g := range strings.Fields(list) {
+			gid, err := strconv.ParseUint(g, 10, 32)
+			if err == nil {
+				groups = append(groups, uint32(gid))
+			}
+		}
+		break
+	}
+	return groups
+}
+
+// permitted checks the wanted permissions of the caller on an inode, given its Mode, Uid, Gid and AclAccess bins
+func permitted(bins aerospike.BinMap, hdr *fuse.Header, want uint16) error {
+	mode := uint32(bins["Mode"].(int))
+	if hdr.Uid == 0 {
+		// root may do anything, but only execute files someone may execute
+		if want&permExecute != 0 && !iofs.FileMode(mode).IsDir() && mode&0o111 == 0 {
+			return syscall.EACCES
+		}
+		return nil
+	}
+	entries := modeACL(mode)
+	if v, ok := bins["AclAccess"].([]byte); ok {
+		acl, err := parseACL(v)
+		if err != nil {
+			log.Warn("Invalid stored ACL: %s", err)
+		} else {
+			entries = acl
+		}
+	}
+	uid, _ := bins["Uid"].(int)
+	gid, _ := bins["Gid"].(int)
+	if !aclPermits(entries, hdr.Uid, callerGroups(hdr), uint32(uid), uint32(gid), want) {
+		return syscall.EACCES
+	}
+	return nil
+}
+
+// checkAccess checks the wanted permissions of the caller on an inode
+func (f *FS) checkAccess(inode uint64, hdr *fuse.Header, want uint16) error {
+	if f.cfg.MountParams.Permissions != permsFilesystem {
+		return nil
+	}
+	k, err := aerospike.NewKey(f.cfg.Aerospike.Namespace, f.cfg.setName("fs"), int(inode))
+	if err != nil {
+		log.Error("Access %d: %s", inode, err)
+		return syscall.EFAULT
+	}
+	r, err := f.asd.Get(GetReadPolicyNoMRT(f.asd, &f.cfg.Aerospike.Timeouts), k, "Mode", "Uid", "Gid", "AclAccess")
+	if err != nil {
+		if err.Matches(aerospike.ErrKeyNotFound.ResultCode) {
+			return syscall.ENOENT
+		}
+		log.Error("Access %d: %s", inode, err)
+		return syscall.EFAULT
+	}
+	return permitted(r.Bins, hdr, want)
+}
+
+// openPermissions returns the permissions needed to open a file with the given flags
+func openPermissions(flags fuse.OpenFlags) uint16 {
+	var want uint16
+	switch {
+	case flags.IsReadOnly():
+		want = permRead
+	case flags.IsWriteOnly():
+		want = permWrite
+	case flags.IsReadWrite():
+		want = permRead | permWrite
+	}
+	if flags&fuse.OpenTruncate != 0 {
+		want |= permWrite
+	}
+	return want
+}
+
+func (f *FS) access(inode uint64, req *fuse.AccessRequest) error {
+	log.Debug("Executing Access inode %d mask %d", inode, req.Mask)
+	if req.Mask&permWrite != 0 && f.cfg.MountParams.RO {
+		return syscall.EROFS
+	}
+	return f.checkAccess(inode, &req.Header, uint16(req.Mask&7))
+}
+
+func (d *Dir) Access(ctx context.Context, req *fuse.AccessRequest) error {
+	return d.fs.access(d.inode, req)
+}
+
+func (f *File) Access(ctx context.Context, req *fuse.AccessRequest) error {
+	return f.fs.access(f.inode, req)
+}
+
+func (s *Symlink) Access(ctx context.Context, req *fuse.AccessRequest) error {
+	return s.fs.access(s.inode, req)
+}
+
+func (s *Special) Access(ctx context.Context, req *fuse.AccessRequest) error {
+	return s.fs.access(s.inode, req)
+}
+
+// checkDirWrite checks that the caller may add or remove entries of a directory
+func (f *FS) checkDirWrite(dir uint64, hdr *fuse.Header) error {
+	return f.checkAccess(dir, hdr, permWrite|permExecute)
+}
+
+// setattrPermitted checks a setattr request of the caller against the Mode, Uid, Gid and AclAccess bins of the inode
+// the owner may chmod, chgrp to one of its groups and set times, others may only set times to now, given write permission
+// size changes not made through an open handle need write permission
+func setattrPermitted(bins aerospike.BinMap, req *fuse.SetattrRequest) error {
+	hdr := &req.Header
+	if hdr.Uid == 0 {
+		return nil
+	}
+	uid := uint32(bins["Uid"].(int))
+	gid := uint32(bins["Gid"].(int))
+	owner := hdr.Uid == uid
+	switch {
+	case req.Valid.Mode() && !owner:
+		return syscall.EPERM
+	case req.Valid.Uid() && (!owner || req.Uid != uid):
+		return syscall.EPERM
+	case req.Valid.Gid() && (!owner || req.Gid != gid && !slices.Contains(callerGroups(hdr), req.Gid)):
+		return syscall.EPERM
+	case (req.Valid.Atime() && !req.Valid.AtimeNow() || req.Valid.Mtime() && !req.Valid.MtimeNow()) && !owner:
+		return syscall.EPERM
+	}
+	if (req.Valid.AtimeNow() || req.Valid.MtimeNow()) && !owner {
+		if err := permitted(bins, hdr, permWrite); err != nil {
+			return err
+		}
+	}
+	if req.Valid.Size() && !req.Valid.Handle() {
+		if iofs.FileMode(bins["Mode"].(int)).IsDir() {
+			return syscall.EISDIR
+		}
+		return permitted(bins, hdr, permWrite)
+	}
+	return nil
+}
+
+// checkSticky checks that the caller may remove or rename entry inode of directory dir: in sticky directories, only
+// the owner of the entry or of the directory may
+func (f *FS) checkSticky(dir uint64, inode uint64, hdr *fuse.Header) error {
+	if f.cfg.MountParams.Permissions != permsFilesystem || hdr.Uid == 0 {
+		return nil
+	}
+	keys := make([]*aerospike.Key, 2)
+	for i, ino := range []uint64{dir, inode} {
+		k, err := aerospike.NewKey(f.cfg.Aerospike.Namespace, f.cfg.setName("fs"), int(ino))
+		if err != nil {
+			log.Error("Sticky %d/%d: %s", dir, inode, err)
+			return syscall.EFAULT
+		}
+		keys[i] = k
+	}
+	records, err := f.asd.BatchGet(GetBatchPolicyNoMRT(f.asd, &f.cfg.Aerospike.Timeouts), keys, "Mode", "Uid")
+	if err != nil {
+		log.Error("Sticky %d/%d: %s", dir, inode, err)
+		return syscall.EFAULT
+	}
+	if records[0] == nil || records[1] == nil {
+		return syscall.ENOENT
+	}
+	if iofs.FileMode(records[0].Bins["Mode"].(int))&iofs.ModeSticky == 0 {
+		return nil
+	}
+	if int(hdr.Uid) == records[0].Bins["Uid"].(int) || int(hdr.Uid) == records[1].Bins["Uid"].(int) {
+		return nil
+	}
+	return syscall.EPERM
+}
+
+// newInodeOwner sets the Gid and Mode bins of an inode created by the caller in directory parentKey: a setgid
+// directory passes on its group, and its setgid bit to subdirectories; other new inodes only keep a setgid bit if
+// the caller is a member of their group
+func (f *FS) newInodeOwner(mrt *MRT, parentKey *aerospike.Key, bins aerospike.BinMap, hdr *fuse.Header) aerospike.Error {
+	log.Detail("ASD: newInodeOwner: GetOp(%v) %v", mrt.Id(), parentKey)
+	r, err := f.asd.Operate(mrt.Write(), parentKey, GetOp("Mode"), GetOp("Gid"))
+	if err != nil {
+		return err
+	}
+	mode := iofs.FileMode(bins["Mode"].(int))
+	if iofs.FileMode(r.Bins["Mode"].(int))&iofs.ModeSetgid != 0 {
+		bins["Gid"] = r.Bins["Gid"].(int)
+		if mode.IsDir() {
+			mode |= iofs.ModeSetgid
+		}
+	}
+	if !mode.IsDir() && mode&iofs.ModeSetgid != 0 && hdr.Uid != 0 && !slices.Contains(callerGroups(hdr), uint32(bins["Gid"].(int))) {
+		mode &^= iofs.ModeSetgid
+	}
+	bins["Mode"] = int(mode)
+	return nil
+}
+
+// killPrivMode returns the Mode bin of a regular file losing its setuid bit, and its setgid bit if it is group
+// executable (without, the bit marks mandatory locking), as on writes by users other than root and on chown
+func killPrivMode(mode int) int {
+	m := iofs.FileMode(mode)
+	if !m.IsRegular() {
+		return mode
+	}
+	m &^= iofs.ModeSetuid
+	if m&0o010 != 0 {
+		m &^= iofs.ModeSetgid
+	}
+	return int(m)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	iofs "io/fs"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/aerospike/aerospike-client-go/v8"
+)
+
+// special files - named pipes, sockets and device nodes - are inodes without content, devices recording their device
+// number in the "Rdev" bin; the kernel opens them itself, so they only need attributes
+type Special struct {
+	fs    *FS
+	inode uint64
+}
+
+// direntType returns the directory entry type of an inode mode
+func direntType(mode iofs.FileMode) fuse.DirentType {
+	switch mode.Type() {
+	case iofs.ModeDir:
+		return fuse.DT_Dir
+	case iofs.ModeSymlink:
+		return fuse.DT_Link
+	case iofs.ModeNamedPipe:
+		return fuse.DT_FIFO
+	case iofs.ModeSocket:
+		return fuse.DT_Socket
+	case iofs.ModeDevice | iofs.ModeCharDevice:
+		return fuse.DT_Char
+	case iofs.ModeDevice:
+		return fuse.DT_Block
+	}
+	return fuse.DT_File
+}
+
+// node returns the node of an inode with the given directory entry type, nil for unknown types
+func (f *FS) node(nType fuse.DirentType, inode uint64) fs.Node {
+	switch nType {
+	case fuse.DT_Dir:
+		return &Dir{fs: f, inode: inode}
+	case fuse.DT_File:
+		return &File{fs: f, inode: inode}
+	case fuse.DT_Link:
+		return &Symlink{fs: f, inode: inode}
+	case fuse.DT_FIFO, fuse.DT_Socket, fuse.DT_Char, fuse.DT_Block:
+		return &Special{fs: f, inode: inode}
+	}
+	return nil
+}
+
+func (d *Dir) Mknod(ctx context.Context, req *fuse.MknodRequest) (fs.Node, error) {
+	OpStart()
+	defer OpEnd()
+	log.Debug("Executing Mknod '%s' in %d mode %v rdev %d", req.Name, d.inode, req.Mode, req.Rdev)
+	if d.fs.cfg.MountParams.RO {
+		return nil, syscall.EROFS
+	}
+	switch req.Mode.Type() {
+	case 0, iofs.ModeNamedPipe, iofs.ModeSocket, iofs.ModeDevice, iofs.ModeDevice | iofs.ModeCharDevice:
+	default:
+		return nil, syscall.EINVAL
+	}
+	if err := d.fs.checkDirWrite(d.inode, &req.Header); err != nil {
+		return nil, err
+	}
+	// clear cache
+	if err := d.fs.fuse.InvalidateNodeData(d); err != nil && err != fuse.ErrNotCached {
+		log.Warn("invalidate error: %v", err)
+	}
+	// check if the file already exists
+	parentKey, err := aerospike.NewKey(d.fs.cfg.Aerospike.Namespace, d.fs.cfg.setName("fs"), int(d.inode))
+	if err != nil {
+		log.Error("Parent %d Mknod '%s': %s", d.inode, req.Name, err)
+		return nil, syscall.EFAULT
+	}
+	name, xerr := d.fs.storedName(d.inode, req.Name)
+	if xerr != nil {
+		log.Error("Parent %d Mknod '%s': %s", d.inode, req.Name, xerr)
+		return nil, syscall.EFAULT
+	}
+	mrt := GetWritePolicy(d.fs.asd, &d.fs.cfg.Aerospike.Timeouts)
+	res, err := d.fs.getEntry(mrt.Write(), mrt.Id(), d.inode, parentKey, name)
+	if err != nil {
+		mrt.Abort()
+		log.Error("Parent %d Mknod '%s': %s", d.inode, req.Name, err)
+		return nil, syscall.EFAULT
+	}
+	if res != nil {
+		log.Detail("Parent %d Mknod '%s': exists", d.inode, req.Name)
+		mrt.Abort()
+		return nil, syscall.EEXIST
+	}
+	// obtain new inode, advancing lastInode metadata record
+	newNode, xerr := d.fs.newInode()
+	if xerr != nil {
+		mrt.Abort()
+		log.Error("Parent %d Mknod '%s': %s", d.inode, req.Name, xerr)
+		return nil, syscall.EFAULT
+	}
+	kk, err := aerospike.NewKey(d.fs.cfg.Aerospike.Namespace, d.fs.cfg.setName("fs"), int(newNode))
+	if err != nil {
+		mrt.Abort()
+		log.Error("Parent %d Mknod '%s': %s", d.inode, req.Name, err)
+		return nil, syscall.EFAULT
+	}
+	nType := direntType(req.Mode)
+	bins := make(aerospike.BinMap)
+	bins["Atime"] = TimeToDB(time.Now())
+	bins["Ctime"] = bins["Atime"]
+	bins["Mtime"] = bins["Ctime"]
+	bins["Crtime"] = bins["Ctime"]
+	bins["BlockSize"] = d.fs.cfg.FS.BlockSize
+	bins["Blocks"] = 0
+	bins["Gid"] = int(req.Gid)
+	bins["Uid"] = int(req.Uid)
+	bins["Size"] = 0
+	bins["Rdev"] = 0
+	if nType == fuse.DT_Char || nType == fuse.DT_Block {
+		bins["Rdev"] = int(req.Rdev)
+	}
+	bins["Nlink"] = 1
+	bins["Flags"] = 0
+	bins["Mode"] = int(req.Mode)
+	bins["Parents"] = newParents(d.inode, name)
+	err = d.fs.inheritedACL(mrt, parentKey, bins, false, req.Umask)
+	if err == nil {
+		err = d.fs.newInodeOwner(mrt, parentKey, bins, &req.Header)
+	}
+	if err == nil {
+		err = d.fs.newInodeTTL(mrt, parentKey, bins)
+	}
+	if err == nil {
+		err = d.fs.countNewInode(mrt, uint64(newNode), bins)
+	}
+	if err != nil {
+		mrt.Abort()
+		log.Error("Parent %d Mknod '%s': %s", d.inode, req.Name, err)
+		return nil, syscall.EFAULT
+	}
+	log.Detail("Parent %d Mknod '%s': %v", d.inode, req.Name, bins)
+	err = d.fs.asd.Put(expiringPolicy(mrt.Write(), bins["Expires"]), kk, bins)
+	if err != nil {
+		mrt.Abort()
+		log.Error("Parent %d Mknod '%s': %s", d.inode, req.Name, err)
+		return nil, syscall.EFAULT
+	}
+	// update `ls` of directory entry, indicating we have a new entry there
+	lsVal := &LsItem{
+		Inode: uint64(newNode),
+		Type:  nType,
+	}
+	err = d.fs.putEntry(mrt, d.inode, parentKey, name, lsVal)
+	if err != nil {
+		mrt.Abort()
+		log.Error("Parent %d Mknod '%s': %s", d.inode, req.Name, err)
+		return nil, syscall.EFAULT
+	}
+	xerr = mrt.Commit()
+	if xerr != nil {
+		mrt.Abort()
+		log.Error("Parent %d Mknod '%s': %s", d.inode, req.Name, xerr)
+		return nil, syscall.EFAULT
+	}
+	return d.fs.node(nType, uint64(newNode)), nil
+}
+
+func (s *Special) Attr(ctx context.Context, a *fuse.Attr) error {
+	err := s.fs.attr(ctx, a, s.inode)
+	if err != nil {
+		log.Error("Inode %d Attr: %s", s.inode, err)
+		return err
+	}
+	return nil
+}
+
+func (s *Special) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	OpStart()
+	defer OpEnd()
+	err := s.fs.setattr(ctx, req, resp, s.inode)
+	if err != nil {
+		log.Error("Inode %d SetAttr: %s", s.inode, err)
+		return err
+	}
+	return nil
+}
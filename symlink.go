@@ -19,24 +19,31 @@ func (d *Dir) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (fs.Node, e
 	if d.fs.cfg.MountParams.RO {
 		return nil, syscall.EROFS
 	}
+	if err := d.fs.checkDirWrite(d.inode, &req.Header); err != nil {
+		return nil, err
+	}
 	// clear cache
 	if err := d.fs.fuse.InvalidateNodeData(d); err != nil && err != fuse.ErrNotCached {
 		log.Warn("invalidate error: %v", err)
 	}
 	// check if the file already exists
-	parentKey, err := aerospike.NewKey(d.fs.cfg.Aerospike.Namespace, "fs", int(d.inode))
+	parentKey, err := aerospike.NewKey(d.fs.cfg.Aerospike.Namespace, d.fs.cfg.setName("fs"), int(d.inode))
 	if err != nil {
 		log.Error("Parent %d Symlink '%s': %s", d.inode, req.NewName, err)
 		return nil, syscall.EFAULT
 	}
+	name, xerr := d.fs.storedName(d.inode, req.NewName)
+	if xerr != nil {
+		log.Error("Parent %d Symlink '%s': %s", d.inode, req.NewName, xerr)
+		return nil, syscall.EFAULT
+	}
 	mrt := GetWritePolicy(d.fs.asd, &d.fs.cfg.Aerospike.Timeouts)
-	r, err := d.fs.asd.Operate(mrt.Write(), parentKey, aerospike.MapGetByKeyOp("Ls", req.NewName, aerospike.MapReturnType.VALUE))
+	res, err := d.fs.getEntry(mrt.Write(), mrt.Id(), d.inode, parentKey, name)
 	if err != nil {
 		mrt.Abort()
 		log.Error("Parent %d Symlink '%s': %s", d.inode, req.NewName, err)
 		return nil, syscall.EFAULT
 	}
-	res := r.Bins["Ls"]
 	if res != nil {
 		// already exists
 		log.Error("Parent %d Symlink '%s': exists, is dir", d.inode, req.NewName)
@@ -44,14 +51,14 @@ func (d *Dir) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (fs.Node, e
 		return nil, syscall.EEXIST
 	}
 	// obtain new inode, advancing lastInode metadata record
-	newNode, xerr := d.fs.newInode(mrt.txn)
+	newNode, xerr := d.fs.newInode()
 	if xerr != nil {
 		mrt.Abort()
 		log.Error("Parent %d Symlink '%s': %s", d.inode, req.NewName, xerr)
 		return nil, syscall.EFAULT
 	}
 	// create new fs entry with new inode - our new file
-	kk, err := aerospike.NewKey(d.fs.cfg.Aerospike.Namespace, "fs", int(newNode))
+	kk, err := aerospike.NewKey(d.fs.cfg.Aerospike.Namespace, d.fs.cfg.setName("fs"), int(newNode))
 	if err != nil {
 		mrt.Abort()
 		log.Error("Parent %d Symlink '%s': %s", d.inode, req.NewName, err)
@@ -59,6 +66,16 @@ func (d *Dir) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (fs.Node, e
 	}
 	bins := make(aerospike.BinMap)
 	bins["target"] = req.Target
+	if d.fs.keys != nil && d.fs.cfg.FS.Encryption.Names {
+		target, keyId, err := d.fs.keys.seal([]byte(req.Target), inodeAAD(uint64(newNode)))
+		if err != nil {
+			mrt.Abort()
+			log.Error("Parent %d Symlink '%s': %s", d.inode, req.NewName, err)
+			return nil, syscall.EFAULT
+		}
+		bins["target"] = target
+		bins["Key"] = keyId
+	}
 	bins["Gid"] = int(req.Gid)
 	bins["Uid"] = int(req.Uid)
 	bins["Size"] = len(req.Target)
@@ -67,21 +84,34 @@ func (d *Dir) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (fs.Node, e
 	bins["Atime"] = TimeToDB(time.Now())
 	bins["Ctime"] = bins["Atime"]
 	bins["Mtime"] = bins["Ctime"]
+	bins["Crtime"] = bins["Ctime"]
 	bins["Mode"] = int(os.ModeSymlink) | 0o777
+	bins["Parents"] = newParents(d.inode, name)
+	err = d.fs.newInodeOwner(mrt, parentKey, bins, &req.Header)
+	if err == nil {
+		err = d.fs.newInodeTTL(mrt, parentKey, bins)
+	}
+	if err == nil {
+		err = d.fs.countNewInode(mrt, uint64(newNode), bins)
+	}
+	if err != nil {
+		mrt.Abort()
+		log.Error("Parent %d Symlink '%s': %s", d.inode, req.NewName, err)
+		return nil, syscall.EFAULT
+	}
 	log.Detail("Parent %d Symlink '%s': %v", d.inode, req.NewName, bins)
-	err = d.fs.asd.Put(mrt.Write(), kk, bins)
+	err = d.fs.asd.Put(expiringPolicy(mrt.Write(), bins["Expires"]), kk, bins)
 	if err != nil {
 		mrt.Abort()
 		log.Error("Parent %d Symlink '%s': %s", d.inode, req.NewName, err)
 		return nil, syscall.EFAULT
 	}
 	// update `ls` of directory entry, indicating we have a new file there
-	mp := aerospike.NewMapPolicy(aerospike.MapOrder.KEY_ORDERED, aerospike.MapWriteMode.CREATE_ONLY)
 	lsVal := &LsItem{
 		Inode: uint64(newNode),
 		Type:  fuse.DT_Link,
 	}
-	_, err = d.fs.asd.Operate(mrt.Write(), parentKey, aerospike.MapPutOp(mp, "Ls", req.NewName, lsVal.ToAerospikeMap()), aerospike.PutOp(aerospike.NewBin("Mtime", TimeToDB(time.Now()))), aerospike.PutOp(aerospike.NewBin("Atime", TimeToDB(time.Now()))))
+	err = d.fs.putEntry(mrt, d.inode, parentKey, name, lsVal)
 	if err != nil {
 		mrt.Abort()
 		log.Error("Parent %d Symlink '%s': %s", d.inode, req.NewName, err)
@@ -105,40 +135,39 @@ func (d *Dir) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (fs.Node, e
 func (s *Symlink) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
 	// Return the target path of the symlink
 	log.Debug("Running Readlink %d", s.inode)
-	kk, err := aerospike.NewKey(s.fs.cfg.Aerospike.Namespace, "fs", int(s.inode))
+	kk, err := aerospike.NewKey(s.fs.cfg.Aerospike.Namespace, s.fs.cfg.setName("fs"), int(s.inode))
 	if err != nil {
 		log.Error("Readlink %d: %s", s.inode, err)
 		return "", syscall.EFAULT
 	}
-	r, err := s.fs.asd.Get(GetReadPolicyNoMRT(s.fs.asd, &s.fs.cfg.Aerospike.Timeouts), kk, "target")
+	r, err := s.fs.asd.Get(GetReadPolicyNoMRT(s.fs.asd, &s.fs.cfg.Aerospike.Timeouts), kk, "target", "Key", "Atime", "Mtime", "Ctime")
 	if err != nil {
 		log.Error("Readlink %d: %s", s.inode, err)
 		return "", syscall.EFAULT
 	}
-	return r.Bins["target"].(string), nil
+	s.fs.touchAtime(s.inode, r.Bins)
+	keyId, ok := r.Bins["Key"].(string)
+	if !ok {
+		return r.Bins["target"].(string), nil
+	}
+	if s.fs.keys == nil {
+		log.Error("Readlink %d: target is encrypted, but no key file is configured", s.inode)
+		return "", syscall.EACCES
+	}
+	target, xerr := s.fs.keys.open(r.Bins["target"].([]byte), keyId, inodeAAD(s.inode))
+	if xerr != nil {
+		log.Error("Readlink %d: %s", s.inode, xerr)
+		return "", syscall.EFAULT
+	}
+	return string(target), nil
 }
 
 func (s *Symlink) Attr(ctx context.Context, a *fuse.Attr) error {
 	log.Debug("Running LAttr %d", s.inode)
-
-	kk, err := aerospike.NewKey(s.fs.cfg.Aerospike.Namespace, "fs", int(s.inode))
+	err := s.fs.attr(ctx, a, s.inode)
 	if err != nil {
 		log.Error("LAttr %d: %s", s.inode, err)
-		return syscall.EFAULT
+		return err
 	}
-	r, err := s.fs.asd.Get(GetReadPolicyNoMRT(s.fs.asd, &s.fs.cfg.Aerospike.Timeouts), kk, "Mode", "Size", "Uid", "Gid", "Atime", "Mtime", "Ctime")
-	if err != nil {
-		log.Error("LAttr %d: %s", s.inode, err)
-		return syscall.EFAULT
-	}
-
-	a.Mode = os.FileMode(r.Bins["Mode"].(int))
-	a.Size = uint64(r.Bins["Size"].(int))
-	a.Inode = s.inode
-	a.Gid = uint32(r.Bins["Uid"].(int))
-	a.Uid = uint32(r.Bins["Gid"].(int))
-	a.Atime = DBToTime(r.Bins["Atime"].(string))
-	a.Mtime = DBToTime(r.Bins["Mtime"].(string))
-	a.Ctime = DBToTime(r.Bins["Ctime"].(string))
 	return nil
 }
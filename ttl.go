@@ -0,0 +1,361 @@
+package main
+
+import (
+	"fmt"
+	iofs "io/fs"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/aerospike/aerospike-client-go/v8"
+)
+
+// inodes may expire: their "Ttl" bin holds the time to live in seconds, set with the user.asdfs.ttl xattr, and their
+// "Expires" bin the expiry time (ns); all records of the inode (inode, blocks, directory shards, xattrs) are written
+// with the matching Aerospike record expiration, so they evaporate together without any cleanup job
+// new inodes inherit the Ttl of their parent directory, or the mount default fs.ttl, and expire Ttl after their
+// creation; setting the xattr restarts the countdown, removing it (or setting 0) makes the inode permanent again
+// the root directory never expires, its Ttl is only inherited
+// directory entries of expired inodes are dropped lazily, when met by Lookup or ReadDirAll; directories that ever
+// got an entry of an expiring inode are marked with the "Expiring" bin, and only their listings and lookups look for
+// expired entries (the mark is never removed), all others are served without reading the entries' inodes
+const (
+	ttlXattr     = "user.asdfs.ttl"
+	expiresXattr = "user.asdfs.expires" // read-only
+)
+
+// expiresAt returns the expiry time of an "Expires" bin value, zero for none
+func expiresAt(v interface{}) time.Time {
+	switch v := v.(type) {
+	case int:
+		return time.Unix(0, int64(v))
+	case int64:
+		return time.Unix(0, v)
+	}
+	return time.Time{}
+}
+
+// expiration returns the Aerospike record expiration of records expiring at expires, at least one second
+func expiration(expires time.Time) uint32 {
+	return uint32(max(1, (time.Until(expires)+time.Second-1)/time.Second))
+}
+
+// expiringPolicy returns the write policy for records expiring at expires (an "Expires" bin value, nil for none)
+func expiringPolicy(wp *aerospike.WritePolicy, expires interface{}) *aerospike.WritePolicy {
+	at := expiresAt(expires)
+	if at.IsZero() {
+		return wp
+	}
+	p := *wp
+	p.Expiration = expiration(at)
+	return &p
+}
+
+// parseTTL accepts seconds or a duration, such as 168h
+func parseTTL(value string) (int, error) {
+	value = strings.TrimSpace(value)
+	if secs, err := strconv.Atoi(value); err == nil && secs >= 0 {
+		return secs, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid ttl %q", value)
+	}
+	return int((d + time.Second - 1) / time.Second), nil
+}
+
+// newInodeTTL returns the bins to set on an inode created in directory parentKey, inheriting its time to live
+func (f *FS) newInodeTTL(mrt *MRT, parentKey *aerospike.Key, bins aerospike.BinMap) aerospike.Error {
+	log.Detail("ASD: newInodeTTL: GetOp(%v) %v", mrt.Id(), parentKey)
+	r, err := f.asd.Operate(mrt.Write(), parentKey, GetOp("Ttl"), GetOp("Expiring"))
+	if err != nil {
+		return err
+	}
+	ttl, _ := r.Bins["Ttl"].(int)
+	if ttl == 0 {
+		ttl = int(f.cfg.FS.TTL / time.Second)
+	}
+	if ttl > 0 {
+		bins["Ttl"] = ttl
+		bins["Expires"] = TimeToDB(time.Now().Add(time.Duration(ttl) * time.Second))
+		if r.Bins["Expiring"] == nil {
+			return f.markExpiring(mrt, parentKey)
+		}
+	}
+	return nil
+}
+
+// markExpiring marks directory dirKey as holding entries of expiring inodes
+func (f *FS) markExpiring(mrt *MRT, dirKey *aerospike.Key) aerospike.Error {
+	log.Detail("ASD: markExpiring: PutOp(%v) %v", mrt.Id(), dirKey)
+	wp := *mrt.Write()
+	wp.RecordExistsAction = aerospike.UPDATE_ONLY
+	_, err := f.asd.Operate(&wp, dirKey, PutOp("Expiring", 1))
+	return err
+}
+
+// markParentsExpiring marks the directories linking to an inode, given its "Parents" bin, as holding entries of
+// expiring inodes
+func (f *FS) markParentsExpiring(mrt *MRT, parents interface{}) aerospike.Error {
+	for _, l := range parentLinks(parents) {
+		dk, err := aerospike.NewKey(f.cfg.Aerospike.Namespace, f.cfg.setName("fs"), int(l.dir))
+		if err != nil {
+			return err
+		}
+		err = f.markExpiring(mrt, dk)
+		if err != nil && !err.Matches(aerospike.ErrKeyNotFound.ResultCode) {
+			return err
+		}
+	}
+	return nil
+}
+
+// inodeExpires returns whether the inode of record k expires
+func (f *FS) inodeExpires(policy *aerospike.BasePolicy, k *aerospike.Key) (bool, aerospike.Error) {
+	r, err := f.asd.Get(policy, k, "Expires")
+	if err != nil {
+		return false, err
+	}
+	return r.Bins["Expires"] != nil, nil
+}
+
+// parentExpires returns whether any of the directories linking to an inode, given its "Parents" bin, expires
+func (f *FS) parentExpires(policy *aerospike.BasePolicy, parents interface{}) (bool, aerospike.Error) {
+	for _, l := range parentLinks(parents) {
+		dk, err := aerospike.NewKey(f.cfg.Aerospike.Namespace, f.cfg.setName("fs"), int(l.dir))
+		if err != nil {
+			return false, err
+		}
+		expiring, err := f.inodeExpires(policy, dk)
+		if err != nil && !err.Matches(aerospike.ErrKeyNotFound.ResultCode) {
+			return false, err
+		}
+		if expiring {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// mayExpire returns whether directory dirKey may hold entries of expired inodes
+func (f *FS) mayExpire(policy *aerospike.BasePolicy, dirKey *aerospike.Key) (bool, aerospike.Error) {
+	r, err := f.asd.Get(policy, dirKey, "Expiring")
+	if err != nil {
+		return false, err
+	}
+	return r.Bins["Expiring"] != nil, nil
+}
+
+// setTTL sets (or with 0 removes) the time to live of an inode, applying the new expiry to all its records
+func (f *FS) setTTL(inode uint64, ttl int) error {
+	k, err := aerospike.NewKey(f.cfg.Aerospike.Namespace, f.cfg.setName("fs"), int(inode))
+	if err != nil {
+		return err
+	}
+	mrt := GetPolicies(f.asd, &f.cfg.Aerospike.Timeouts)
+	r, err := f.asd.Get(mrt.Read(), k, "Size", "BlockSize", "Shards", "XattrRecord", "Mode", "Blocks", "Counted", "Parents", "Expires")
+	if err != nil {
+		mrt.Abort()
+		return err
+	}
+	// entries of expiring directories expire too, so that none outlives its directory unreachable and counted
+	mode, _ := r.Bins["Mode"].(int)
+	if ttl > 0 && inode != 1 && r.Bins["Expires"] == nil && iofs.FileMode(mode).IsDir() {
+		empty, xerr := f.dirEmpty(mrt.Write(), mrt.Id(), inode, k)
+		if xerr != nil || !empty {
+			mrt.Abort()
+			if xerr != nil {
+				return xerr
+			}
+			return syscall.ENOTEMPTY
+		}
+	}
+	if ttl == 0 {
+		expiring, err := f.parentExpires(mrt.Read(), r.Bins["Parents"])
+		if err != nil || expiring {
+			mrt.Abort()
+			if err != nil {
+				return err
+			}
+			return syscall.EPERM
+		}
+	}
+	wp := *mrt.Write()
+	wp.Expiration = aerospike.TTLDontExpire
+	var expires interface{}
+	if ttl > 0 && inode != 1 {
+		at := time.Now().Add(time.Duration(ttl) * time.Second)
+		expires = TimeToDB(at)
+		wp.Expiration = expiration(at)
+	}
+	ttlBin := aerospike.NewBin("Ttl", nil)
+	if ttl > 0 {
+		ttlBin = aerospike.NewBin("Ttl", ttl)
+	}
+	log.Detail("ASD: setTTL: PutBins(%v) %v ttl=%d", mrt.Id(), k, ttl)
+	err = f.asd.PutBins(&wp, k, ttlBin, aerospike.NewBin("Expires", expires), aerospike.NewBin("Ctime", TimeToDB(time.Now())))
+	if err != nil {
+		mrt.Abort()
+		return err
+	}
+	if expires != nil {
+		err = f.markParentsExpiring(mrt, r.Bins["Parents"])
+		if err != nil {
+			mrt.Abort()
+			return err
+		}
+	}
+	// expiring inodes leave the usage counters, as they disappear without a transaction
+	err = f.setCounted(mrt, &wp, inode, k, r.Bins, expires == nil)
+	if err != nil {
+		mrt.Abort()
+		return err
+	}
+	// content records, missing ones are holes or empty shards
+	keys := []*aerospike.Key{}
+	if blockSize, ok := r.Bins["BlockSize"].(int); ok {
+		size, _ := r.Bins["Size"].(int)
+		for blockNo := 0; blockNo < blockCount(size, blockSize); blockNo++ {
+			bk, err := f.blockKey(inode, blockNo)
+			if err != nil {
+				mrt.Abort()
+				return err
+			}
+			keys = append(keys, bk)
+		}
+	}
+	shards, _ := r.Bins["Shards"].(int)
+	for shard := 0; shard < shards; shard++ {
+		sk, err := f.shardKey(inode, shard)
+		if err != nil {
+			mrt.Abort()
+			return err
+		}
+		keys = append(keys, sk)
+	}
+	if r.Bins["XattrRecord"] != nil {
+		xk, err := f.xattrKey(inode)
+		if err != nil {
+			mrt.Abort()
+			return err
+		}
+		keys = append(keys, xk)
+	}
+	wp.RecordExistsAction = aerospike.UPDATE_ONLY
+	for _, ck := range keys {
+		log.Detail("ASD: setTTL: TouchOp(%v) %v", mrt.Id(), ck)
+		_, err = f.asd.Operate(&wp, ck, TouchOp())
+		if err != nil && !err.Matches(aerospike.ErrKeyNotFound.ResultCode) {
+			mrt.Abort()
+			return err
+		}
+	}
+	return mrt.Commit()
+}
+
+// getTTLXattr returns the value of one of the asdfs ttl xattrs of an inode
+func (f *FS) getTTLXattr(inode uint64, name string) ([]byte, error) {
+	k, err := aerospike.NewKey(f.cfg.Aerospike.Namespace, f.cfg.setName("fs"), int(inode))
+	if err != nil {
+		return nil, err
+	}
+	r, err := f.asd.Get(GetReadPolicyNoMRT(f.asd, &f.cfg.Aerospike.Timeouts), k, "Ttl", "Expires")
+	if err != nil {
+		return nil, err
+	}
+	switch name {
+	case ttlXattr:
+		if ttl, ok := r.Bins["Ttl"].(int); ok {
+			return []byte(strconv.Itoa(ttl)), nil
+		}
+	case expiresXattr:
+		if at := expiresAt(r.Bins["Expires"]); !at.IsZero() {
+			return []byte(at.UTC().Format(time.RFC3339)), nil
+		}
+	}
+	return nil, fuse.ErrNoXattr
+}
+
+// entryAlive returns whether the inode an entry points to still exists, that is did not expire
+func (f *FS) entryAlive(inode uint64) (bool, error) {
+	k, err := aerospike.NewKey(f.cfg.Aerospike.Namespace, f.cfg.setName("fs"), int(inode))
+	if err != nil {
+		return false, err
+	}
+	exists, err := f.asd.Exists(GetReadPolicyNoMRT(f.asd, &f.cfg.Aerospike.Timeouts), k)
+	if err != nil {
+		return false, err
+	}
+	return exists, nil
+}
+
+// liveEntries drops the entries of expired inodes from a page of directory entries, returning the dropped ones too
+func (f *FS) liveEntries(policy *aerospike.BatchPolicy, entries []aerospike.MapPair) (live []aerospike.MapPair, expired []aerospike.MapPair, err error) {
+	if len(entries) == 0 {
+		return entries, nil, nil
+	}
+	keys := make([]*aerospike.Key, len(entries))
+	for i, e := range entries {
+		keys[i], err = aerospike.NewKey(f.cfg.Aerospike.Namespace, f.cfg.setName("fs"), e.Value.(map[interface{}]interface{})["Inode"].(int))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	records, xerr := f.asd.BatchGet(policy, keys, "Nlink")
+	if xerr != nil {
+		return nil, nil, xerr
+	}
+	live = make([]aerospike.MapPair, 0, len(entries))
+	for i, r := range records {
+		if r == nil {
+			expired = append(expired, entries[i])
+			continue
+		}
+		live = append(live, entries[i])
+	}
+	return live, expired, nil
+}
+
+// dropExpired removes the entry (stored) name of a directory, if it still points to inode and inode expired
+func (f *FS) dropExpired(dir uint64, dirKey *aerospike.Key, name string, inode uint64) error {
+	if f.cfg.MountParams.RO {
+		return nil
+	}
+	k, err := aerospike.NewKey(f.cfg.Aerospike.Namespace, f.cfg.setName("fs"), int(inode))
+	if err != nil {
+		return err
+	}
+	mrt := GetPolicies(f.asd, &f.cfg.Aerospike.Timeouts)
+	v, err := f.getEntry(mrt.Write(), mrt.Id(), dir, dirKey, name)
+	if err != nil {
+		mrt.Abort()
+		return err
+	}
+	entry, _ := v.(map[interface{}]interface{})
+	if entry == nil || uint64(entry["Inode"].(int)) != inode {
+		mrt.Abort()
+		return nil
+	}
+	exists, err := f.asd.Exists(mrt.Read(), k)
+	if err != nil || exists {
+		mrt.Abort()
+		return err
+	}
+	log.Debug("Directory %d: dropping entry of expired inode %d", dir, inode)
+	err = f.removeEntry(mrt, dir, dirKey, name)
+	if err != nil {
+		mrt.Abort()
+		return err
+	}
+	// the directory no longer links to the expired subdirectory's ".."
+	if fuse.DirentType(entry["Type"].(int)) == fuse.DT_Dir {
+		err = f.addSubdirs(mrt, dirKey, -1)
+		if err != nil {
+			mrt.Abort()
+			return err
+		}
+	}
+	return mrt.Commit()
+}
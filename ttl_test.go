@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+func TestExpiredSubdirNlink(t *testing.T) {
+	tests := []struct {
+		name string
+		drop func(t *testing.T, p *Dir) // meets the expired entry
+	}{
+		{"lookup", func(t *testing.T, p *Dir) {
+			_, err := p.Lookup(context.Background(), &fuse.LookupRequest{Name: "s"}, &fuse.LookupResponse{})
+			if err != syscall.ENOENT {
+				t.Fatalf("Lookup: %v, want ENOENT", err)
+			}
+		}},
+		{"listing", func(t *testing.T, p *Dir) {
+			ents, err := p.ReadDirAll(context.Background())
+			if err != nil || len(ents) != 1 {
+				t.Fatalf("ReadDirAll: %v %v, want the permanent entry", ents, err)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, root := newTestFS(t, 8)
+			p := testMkdir(t, root, "p")
+			s := testMkdir(t, p, "s")
+			testMkdir(t, p, "keep")
+			if err := f.setTTL(s.inode, 1); err != nil {
+				t.Fatal(err)
+			}
+			if n := testNlink(t, p); n != 4 {
+				t.Fatalf("Nlink %d before expiry, want 4", n)
+			}
+			time.Sleep(2100 * time.Millisecond)
+			tt.drop(t, p)
+			if n := testNlink(t, p); n != 3 {
+				t.Fatalf("Nlink %d after expiry, want 3", n)
+			}
+		})
+	}
+}
+
+func TestExpiringDirEntries(t *testing.T) {
+	ctx := context.Background()
+	setTTL := func(n interface {
+		Setxattr(context.Context, *fuse.SetxattrRequest) error
+	}, ttl string) error {
+		return n.Setxattr(ctx, &fuse.SetxattrRequest{Name: ttlXattr, Xattr: []byte(ttl)})
+	}
+	// /perm/f, /perm/sub/, /tmp/ expiring with /tmp/e, /empty/
+	tests := []struct {
+		name string
+		op   func(perm, tmp, empty *Dir, f *File, e fs.Node) error
+		want error
+	}{
+		{"ttl on an empty directory", func(perm, tmp, empty *Dir, f *File, e fs.Node) error {
+			return setTTL(empty, "100")
+		}, nil},
+		{"ttl on a directory with permanent entries", func(perm, tmp, empty *Dir, f *File, e fs.Node) error {
+			return setTTL(perm, "100")
+		}, syscall.ENOTEMPTY},
+		{"new ttl of an expiring directory", func(perm, tmp, empty *Dir, f *File, e fs.Node) error {
+			return setTTL(tmp, "200")
+		}, nil},
+		{"ttl 0 in an expiring directory", func(perm, tmp, empty *Dir, f *File, e fs.Node) error {
+			return setTTL(e.(*File), "0")
+		}, syscall.EPERM},
+		{"ttl removed in an expiring directory", func(perm, tmp, empty *Dir, f *File, e fs.Node) error {
+			return e.(*File).Removexattr(ctx, &fuse.RemovexattrRequest{Name: ttlXattr})
+		}, syscall.EPERM},
+		{"ttl removed from an expiring directory", func(perm, tmp, empty *Dir, f *File, e fs.Node) error {
+			return tmp.Removexattr(ctx, &fuse.RemovexattrRequest{Name: ttlXattr})
+		}, nil},
+		{"link of a permanent file into an expiring directory", func(perm, tmp, empty *Dir, f *File, e fs.Node) error {
+			_, err := tmp.Link(ctx, &fuse.LinkRequest{NewName: "l"}, f)
+			return err
+		}, syscall.EXDEV},
+		{"link of an expiring file into a permanent directory", func(perm, tmp, empty *Dir, f *File, e fs.Node) error {
+			_, err := perm.Link(ctx, &fuse.LinkRequest{NewName: "l"}, e)
+			return err
+		}, nil},
+		{"move of a permanent directory into an expiring directory", func(perm, tmp, empty *Dir, f *File, e fs.Node) error {
+			return perm.Rename(ctx, &fuse.RenameRequest{NewDir: fuse.NodeID(tmp.inode), OldName: "sub", NewName: "sub"}, tmp)
+		}, syscall.EXDEV},
+		{"move of an expiring file into a permanent directory", func(perm, tmp, empty *Dir, f *File, e fs.Node) error {
+			return tmp.Rename(ctx, &fuse.RenameRequest{NewDir: fuse.NodeID(perm.inode), OldName: "e", NewName: "e"}, perm)
+		}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, root := newTestFS(t, 8)
+			perm := testMkdir(t, root, "perm")
+			f := testCreate(t, perm, "f", "f")
+			testMkdir(t, perm, "sub")
+			tmp := testMkdir(t, root, "tmp")
+			if err := setTTL(tmp, "100"); err != nil {
+				t.Fatalf("ttl of tmp: %s", err)
+			}
+			testCreate(t, tmp, "e", "e")
+			e, err := tmp.Lookup(ctx, &fuse.LookupRequest{Name: "e"}, &fuse.LookupResponse{})
+			if err != nil {
+				t.Fatalf("Lookup e: %s", err)
+			}
+			empty := testMkdir(t, root, "empty")
+			if err := tt.op(perm, tmp, empty, f, e); err != tt.want {
+				t.Fatalf("%v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	iofs "io/fs"
+	"syscall"
+
+	"bazil.org/fuse"
+	"github.com/aerospike/aerospike-client-go/v8"
+)
+
+// the usage of a filesystem is counted in the "Bytes" (content blocks allocated to regular files) and "Inodes" bins
+// of usageShards meta records "usage-<inode % usageShards>", updated in the transactions changing the usage, so that
+// concurrent writers of different files mostly update different records
+// counted inodes are marked with the "Counted" bin: expiring inodes are left out, as they disappear without a
+// transaction, and inodes of filesystems created before format version 4 are counted by `asdfs migrate`
+const usageShards = 64
+
+// FUSE_NAME_MAX, the kernel refuses longer names; the database has no name limit of its own
+const nameMax = 1024
+
+// rough size of an inode record, to estimate the number of inodes the free space can hold
+const inodeRecordSize = 1024
+
+func usageKey(c *Cfg, inode uint64) (*aerospike.Key, aerospike.Error) {
+	return aerospike.NewKey(c.Aerospike.Namespace, c.setName("meta"), fmt.Sprintf("usage-%d", inode%usageShards))
+}
+
+// contentBytes returns the bytes allocated to the content of an inode, given its Mode, Blocks and BlockSize bins
+func contentBytes(bins aerospike.BinMap) int {
+	mode, _ := bins["Mode"].(int)
+	if !iofs.FileMode(mode).IsRegular() {
+		return 0
+	}
+	blocks, _ := bins["Blocks"].(int)
+	blockSize, _ := bins["BlockSize"].(int)
+	return blocks * blockSize
+}
+
+// addUsage adds to the usage counters, if counted (the "Counted" bin of the inode) is set
+func (f *FS) addUsage(mrt *MRT, inode uint64, counted interface{}, bytes int, inodes int) aerospike.Error {
+	if counted == nil || bytes == 0 && inodes == 0 {
+		return nil
+	}
+	k, err := usageKey(f.cfg, inode)
+	if err != nil {
+		return err
+	}
+	log.Detail("ASD: addUsage: AddOp(%v) %v bytes=%d inodes=%d", mrt.Id(), k, bytes, inodes)
+	_, err = f.asd.Operate(mrt.Write(), k, AddOp("Bytes", bytes), AddOp("Inodes", inodes))
+	return err
+}
+
+// countNewInode counts an inode about to be created with the given bins, unless it expires
+func (f *FS) countNewInode(mrt *MRT, inode uint64, bins aerospike.BinMap) aerospike.Error {
+	if bins["Expires"] != nil {
+		return nil
+	}
+	bins["Counted"] = 1
+	return f.addUsage(mrt, inode, bins["Counted"], contentBytes(bins), 1)
+}
+
+// setCounted starts (or stops) counting an existing inode, given its Counted, Mode, Blocks and BlockSize bins; wp
+// must keep the expiration of the inode record
+func (f *FS) setCounted(mrt *MRT, wp *aerospike.WritePolicy, inode uint64, k *aerospike.Key, bins aerospike.BinMap, counted bool) aerospike.Error {
+	if (bins["Counted"] != nil) == counted {
+		return nil
+	}
+	sign := 1
+	var mark interface{} = 1
+	if !counted {
+		sign = -1
+		mark = nil
+	}
+	log.Detail("ASD: setCounted: PutOp(%v) %v %v", mrt.Id(), k, counted)
+	_, err := f.asd.Operate(wp, k, PutOp("Counted", mark))
+	if err != nil {
+		return err
+	}
+	return f.addUsage(mrt, inode, 1, sign*contentBytes(bins), sign)
+}
+
+// usage returns the content bytes and inodes counted
+func (f *FS) usage() (bytes int, inodes int, err aerospike.Error) {
+	keys := make([]*aerospike.Key, usageShards)
+	for shard := range keys {
+		keys[shard], err = usageKey(f.cfg, uint64(shard))
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	records, err := f.asd.BatchGet(GetBatchPolicyNoMRT(f.asd, &f.cfg.Aerospike.Timeouts), keys, "Bytes", "Inodes")
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, r := range records {
+		if r == nil {
+			continue
+		}
+		b, _ := r.Bins["Bytes"].(int)
+		i, _ := r.Bins["Inodes"].(int)
+		bytes += b
+		inodes += i
+	}
+	return bytes, inodes, nil
+}
+
+// Statfs reports the space of the namespace left to the filesystem, in blocks of the configured block size: the
+// filesystem size is its usage plus the free space of the namespace, which may be shared with other data
+func (f *FS) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *fuse.StatfsResponse) error {
+	log.Debug("Executing Statfs")
+	total, free, err := f.asd.Space(f.cfg.Aerospike.Namespace)
+	if err != nil {
+		log.Error("Statfs: %s", err)
+		return syscall.EFAULT
+	}
+	bytes, inodes, err := f.usage()
+	if err != nil {
+		log.Error("Statfs: %s", err)
+		return syscall.EFAULT
+	}
+	size := min(total, uint64(max(bytes, 0))+free)
+	blockSize := uint64(f.cfg.FS.BlockSize)
+	resp.Bsize = uint32(blockSize)
+	resp.Frsize = uint32(blockSize)
+	resp.Blocks = size / blockSize
+	resp.Bfree = free / blockSize
+	resp.Bavail = resp.Bfree
+	resp.Ffree = free / inodeRecordSize
+	resp.Files = uint64(max(inodes, 0)) + resp.Ffree
+	resp.Namelen = nameMax
+	return nil
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"context"
+	iofs "io/fs"
+	"strings"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/aerospike/aerospike-client-go/v8"
+	"github.com/aerospike/aerospike-client-go/v8/types"
+)
+
+// extended attributes are stored in the "Xattrs" map bin of the inode record, name -> value; once they grow past
+// xattrInlineMax bytes they are moved to a side record in the "xattr" set, keyed by inode, and the inode record gets
+// an "XattrRecord" bin; like directory shards, they are never moved back
+// the user.asdfs.ttl and user.asdfs.expires xattrs are not stored, they reflect the expiry of the inode (see ttl.go)
+const (
+	xattrInlineMax = 16 * 1024 // total size of names and values kept in the inode record
+	xattrNameMax   = 255       // XATTR_NAME_MAX
+	xattrSizeMax   = 64 * 1024 // XATTR_SIZE_MAX
+)
+
+// setxattr(2) flags
+const (
+	xattrCreate  = 0x1 // XATTR_CREATE
+	xattrReplace = 0x2 // XATTR_REPLACE
+)
+
+func (f *FS) xattrKey(inode uint64) (*aerospike.Key, aerospike.Error) {
+	return aerospike.NewKey(f.cfg.Aerospike.Namespace, f.cfg.setName("xattr"), int(inode))
+}
+
+// xattrVisible returns whether the caller may see the xattr; trusted xattrs are reserved to root
+func xattrVisible(name string, uid uint32) bool {
+	return !strings.HasPrefix(name, "trusted.") || uid == 0
+}
+
+// xattrWritable checks whether the caller may set or remove the xattr on an inode with the given mode
+func xattrWritable(name string, uid uint32, mode iofs.FileMode) error {
+	switch {
+	case strings.HasPrefix(name, "user."):
+		// as on local filesystems, user xattrs are for regular files and directories only
+		if !mode.IsRegular() && !mode.IsDir() {
+			return syscall.EPERM
+		}
+	case strings.HasPrefix(name, "trusted."):
+		if uid != 0 {
+			return syscall.EPERM
+		}
+	case strings.HasPrefix(name, "security."):
+	default:
+		// system xattrs other than ACLs are not supported
+		return syscall.ENOTSUP
+	}
+	return nil
+}
+
+// xattrErrno converts a database error of an xattr operation on inode
+func xattrErrno(op string, inode uint64, err aerospike.Error) error {
+	switch {
+	case err.Matches(aerospike.ErrKeyNotFound.ResultCode):
+		return syscall.ENOENT
+	case err.Matches(types.RECORD_TOO_BIG):
+		return syscall.ENOSPC
+	}
+	log.Error("%s %d: %s", op, inode, err)
+	return syscall.EFAULT
+}
+
+// fitsReply checks the length of a reply against the buffer size of the caller, a size of 0 asking for the length
+// only; bazil.org/fuse sends replies whole, which the kernel rejects if they exceed the buffer
+func fitsReply(size uint32, n int) error {
+	if size != 0 && n > int(size) {
+		return syscall.ERANGE
+	}
+	return nil
+}
+
+func (f *FS) getxattr(inode uint64, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	log.Debug("Executing Getxattr inode %d name %s", inode, req.Name)
+	if strings.HasPrefix(req.Name, "user.") {
+		if err := f.checkAccess(inode, &req.Header, permRead); err != nil {
+			return err
+		}
+	}
+	if req.Name == ttlXattr || req.Name == expiresXattr {
+		v, err := f.getTTLXattr(inode, req.Name)
+		if err != nil {
+			if err == fuse.ErrNoXattr {
+				return err
+			}
+			if aerr, ok := err.(aerospike.Error); ok {
+				return xattrErrno("Getxattr", inode, aerr)
+			}
+			log.Error("Getxattr %d %s: %s", inode, req.Name, err)
+			return syscall.EFAULT
+		}
+		resp.Xattr = v
+		return fitsReply(req.Size, len(v))
+	}
+	if req.Name == aclAccessXattr || req.Name == aclDefaultXattr {
+		v, err := f.getACL(inode, req.Name)
+		if err != nil {
+			return err
+		}
+		resp.Xattr = v
+		return fitsReply(req.Size, len(v))
+	}
+	if !xattrVisible(req.Name, req.Uid) {
+		return fuse.ErrNoXattr
+	}
+	k, err := aerospike.NewKey(f.cfg.Aerospike.Namespace, f.cfg.setName("fs"), int(inode))
+	if err != nil {
+		log.Error("Getxattr %d: %s", inode, err)
+		return syscall.EFAULT
+	}
+	wp := GetWritePolicyNoMRT(f.asd, &f.cfg.Aerospike.Timeouts)
+	log.Detail("ASD: Getxattr: MapGetByKeyOp %v", k)
+	r, err := f.asd.Operate(wp, k, GetOp("XattrRecord"), MapGetOp("Xattrs", req.Name))
+	if err != nil {
+		return xattrErrno("Getxattr", inode, err)
+	}
+	if r.Bins["XattrRecord"] != nil {
+		xk, err := f.xattrKey(inode)
+		if err != nil {
+			log.Error("Getxattr %d: %s", inode, err)
+			return syscall.EFAULT
+		}
+		log.Detail("ASD: Getxattr: MapGetByKeyOp %v", xk)
+		r, err = f.asd.Operate(wp, xk, MapGetOp("Xattrs", req.Name))
+		if err != nil {
+			if err.Matches(aerospike.ErrKeyNotFound.ResultCode) {
+				return fuse.ErrNoXattr
+			}
+			return xattrErrno("Getxattr", inode, err)
+		}
+	}
+	v, ok := r.Bins["Xattrs"].([]byte)
+	if !ok {
+		return fuse.ErrNoXattr
+	}
+	resp.Xattr = v
+	return fitsReply(req.Size, len(v))
+}
+
+func (f *FS) listxattr(inode uint64, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	log.Debug("Executing Listxattr inode %d", inode)
+	k, err := aerospike.NewKey(f.cfg.Aerospike.Namespace, f.cfg.setName("fs"), int(inode))
+	if err != nil {
+		log.Error("Listxattr %d: %s", inode, err)
+		return syscall.EFAULT
+	}
+	policy := GetReadPolicyNoMRT(f.asd, &f.cfg.Aerospike.Timeouts)
+	r, err := f.asd.Get(policy, k, "XattrRecord", "Xattrs", "AclAccess", "AclDefault", "Ttl", "Expires")
+	if err != nil {
+		return xattrErrno("Listxattr", inode, err)
+	}
+	xattrs := r.Bins["Xattrs"]
+	if r.Bins["XattrRecord"] != nil {
+		xk, err := f.xattrKey(inode)
+		if err != nil {
+			log.Error("Listxattr %d: %s", inode, err)
+			return syscall.EFAULT
+		}
+		xr, err := f.asd.Get(policy, xk, "Xattrs")
+		if err != nil && !err.Matches(aerospike.ErrKeyNotFound.ResultCode) {
+			return xattrErrno("Listxattr", inode, err)
+		}
+		xattrs = nil
+		if xr != nil {
+			xattrs = xr.Bins["Xattrs"]
+		}
+	}
+	for _, e := range lsPairs(xattrs) {
+		if xattrVisible(e.Key.(string), req.Uid) {
+			resp.Append(e.Key.(string))
+		}
+	}
+	if r.Bins["AclAccess"] != nil {
+		resp.Append(aclAccessXattr)
+	}
+	if r.Bins["AclDefault"] != nil {
+		resp.Append(aclDefaultXattr)
+	}
+	if r.Bins["Ttl"] != nil {
+		resp.Append(ttlXattr)
+	}
+	if r.Bins["Expires"] != nil {
+		resp.Append(expiresXattr)
+	}
+	return fitsReply(req.Size, len(resp.Xattr))
+}
+
+func (f *FS) setxattr(inode uint64, req *fuse.SetxattrRequest) error {
+	OpStart()
+	defer OpEnd()
+	log.Debug("Executing Setxattr inode %d name %s", inode, req.Name)
+	if f.cfg.MountParams.RO {
+		return syscall.EROFS
+	}
+	if strings.HasPrefix(req.Name, "user.") {
+		if err := f.checkAccess(inode, &req.Header, permWrite); err != nil {
+			return err
+		}
+	}
+	switch req.Name {
+	case ttlXattr:
+		ttl, err := parseTTL(string(req.Xattr))
+		if err != nil {
+			return syscall.EINVAL
+		}
+		return f.changeTTL(inode, ttl)
+	case expiresXattr:
+		return syscall.EPERM
+	case aclAccessXattr, aclDefaultXattr:
+		if req.Xattr == nil {
+			req.Xattr = []byte{}
+		}
+		return f.setACL(inode, &req.Header, req.Name, req.Xattr, req.Flags, req.SetxattrFlags&fuse.SetxattrACLKillSGID != 0)
+	}
+	if len(req.Name) > xattrNameMax {
+		return syscall.ERANGE
+	}
+	if len(req.Xattr) > xattrSizeMax {
+		return syscall.E2BIG
+	}
+	k, err := aerospike.NewKey(f.cfg.Aerospike.Namespace, f.cfg.setName("fs"), int(inode))
+	if err != nil {
+		log.Error("Setxattr %d: %s", inode, err)
+		return syscall.EFAULT
+	}
+	xk, err := f.xattrKey(inode)
+	if err != nil {
+		log.Error("Setxattr %d: %s", inode, err)
+		return syscall.EFAULT
+	}
+	mrt := GetPolicies(f.asd, &f.cfg.Aerospike.Timeouts)
+	log.Detail("ASD: Setxattr: Operate(%v) %v", mrt.Id(), k)
+	r, err := f.asd.Operate(mrt.Write(), k, GetOp("Mode"), GetOp("XattrRecord"), GetOp("Xattrs"), GetOp("Expires"))
+	if err != nil {
+		mrt.Abort()
+		return xattrErrno("Setxattr", inode, err)
+	}
+	if xerr := xattrWritable(req.Name, req.Uid, iofs.FileMode(r.Bins["Mode"].(int))); xerr != nil {
+		mrt.Abort()
+		return xerr
+	}
+	spilled := r.Bins["XattrRecord"] != nil
+	exists := false
+	total := len(req.Name) + len(req.Xattr)
+	if spilled {
+		log.Detail("ASD: Setxattr: MapGetByKeyOp(%v) %v", mrt.Id(), xk)
+		xr, err := f.asd.Operate(mrt.Write(), xk, MapGetOp("Xattrs", req.Name))
+		if err != nil && !err.Matches(aerospike.ErrKeyNotFound.ResultCode) {
+			mrt.Abort()
+			return xattrErrno("Setxattr", inode, err)
+		}
+		exists = xr != nil && xr.Bins["Xattrs"] != nil
+	} else {
+		for _, e := range lsPairs(r.Bins["Xattrs"]) {
+			if e.Key == req.Name {
+				exists = true
+				continue
+			}
+			total += len(e.Key.(string)) + len(e.Value.([]byte))
+		}
+	}
+	if req.Flags&xattrCreate != 0 && exists {
+		mrt.Abort()
+		return syscall.EEXIST
+	}
+	if req.Flags&xattrReplace != 0 && !exists {
+		mrt.Abort()
+		return fuse.ErrNoXattr
+	}
+	ops := []*Op{PutOp("Ctime", TimeToDB(time.Now()))}
+	switch {
+	case spilled:
+		log.Detail("ASD: Setxattr: MapPutOp(%v) %v", mrt.Id(), xk)
+		_, err = f.asd.Operate(expiringPolicy(mrt.Write(), r.Bins["Expires"]), xk, MapPutOp("Xattrs", req.Name, req.Xattr, false))
+	case total > xattrInlineMax:
+		log.Debug("Moving xattrs of inode %d to their own record", inode)
+		items := map[interface{}]interface{}{req.Name: req.Xattr}
+		for _, e := range lsPairs(r.Bins["Xattrs"]) {
+			if e.Key != req.Name {
+				items[e.Key] = e.Value
+			}
+		}
+		log.Detail("ASD: Setxattr: MapPutItemsOp(%v) %v", mrt.Id(), xk)
+		_, err = f.asd.Operate(expiringPolicy(mrt.Write(), r.Bins["Expires"]), xk, MapPutItemsOp("Xattrs", items))
+		ops = append(ops, PutOp("Xattrs", nil), PutOp("XattrRecord", 1))
+	default:
+		ops = append(ops, MapPutOp("Xattrs", req.Name, req.Xattr, false))
+	}
+	if err != nil {
+		mrt.Abort()
+		return xattrErrno("Setxattr", inode, err)
+	}
+	log.Detail("ASD: Setxattr: Operate(%v) %v", mrt.Id(), k)
+	_, err = f.asd.Operate(mrt.Write(), k, ops...)
+	if err != nil {
+		mrt.Abort()
+		return xattrErrno("Setxattr", inode, err)
+	}
+	xerr := mrt.Commit()
+	if xerr != nil {
+		log.Error("Setxattr %d: %s", inode, xerr)
+		return syscall.EFAULT
+	}
+	return nil
+}
+
+func (f *FS) removexattr(inode uint64, req *fuse.RemovexattrRequest) error {
+	OpStart()
+	defer OpEnd()
+	log.Debug("Executing Removexattr inode %d name %s", inode, req.Name)
+	if f.cfg.MountParams.RO {
+		return syscall.EROFS
+	}
+	if strings.HasPrefix(req.Name, "user.") {
+		if err := f.checkAccess(inode, &req.Header, permWrite); err != nil {
+			return err
+		}
+	}
+	switch req.Name {
+	case ttlXattr:
+		if _, err := f.getTTLXattr(inode, ttlXattr); err == fuse.ErrNoXattr {
+			return err
+		}
+		return f.changeTTL(inode, 0)
+	case expiresXattr:
+		return syscall.EPERM
+	case aclAccessXattr, aclDefaultXattr:
+		return f.setACL(inode, &req.Header, req.Name, nil, 0, false)
+	}
+	k, err := aerospike.NewKey(f.cfg.Aerospike.Namespace, f.cfg.setName("fs"), int(inode))
+	if err != nil {
+		log.Error("Removexattr %d: %s", inode, err)
+		return syscall.EFAULT
+	}
+	mrt := GetPolicies(f.asd, &f.cfg.Aerospike.Timeouts)
+	log.Detail("ASD: Removexattr: Operate(%v) %v", mrt.Id(), k)
+	r, err := f.asd.Operate(mrt.Write(), k, GetOp("Mode"), GetOp("XattrRecord"), MapGetOp("Xattrs", req.Name))
+	if err != nil {
+		mrt.Abort()
+		return xattrErrno("Removexattr", inode, err)
+	}
+	if xerr := xattrWritable(req.Name, req.Uid, iofs.FileMode(r.Bins["Mode"].(int))); xerr != nil {
+		mrt.Abort()
+		return xerr
+	}
+	xk := k
+	if r.Bins["XattrRecord"] != nil {
+		xk, err = f.xattrKey(inode)
+		if err != nil {
+			mrt.Abort()
+			log.Error("Removexattr %d: %s", inode, err)
+			return syscall.EFAULT
+		}
+		log.Detail("ASD: Removexattr: MapGetByKeyOp(%v) %v", mrt.Id(), xk)
+		r, err = f.asd.Operate(mrt.Write(), xk, MapGetOp("Xattrs", req.Name))
+		if err != nil && !err.Matches(aerospike.ErrKeyNotFound.ResultCode) {
+			mrt.Abort()
+			return xattrErrno("Removexattr", inode, err)
+		}
+	}
+	if r == nil || r.Bins["Xattrs"] == nil {
+		mrt.Abort()
+		return fuse.ErrNoXattr
+	}
+	log.Detail("ASD: Removexattr: MapRemoveByKeyOp(%v) %v", mrt.Id(), xk)
+	_, err = f.asd.Operate(mrt.Write(), xk, MapRemoveOp("Xattrs", req.Name))
+	if err == nil {
+		_, err = f.asd.Operate(mrt.Write(), k, PutOp("Ctime", TimeToDB(time.Now())))
+	}
+	if err != nil {
+		mrt.Abort()
+		return xattrErrno("Removexattr", inode, err)
+	}
+	xerr := mrt.Commit()
+	if xerr != nil {
+		log.Error("Removexattr %d: %s", inode, xerr)
+		return syscall.EFAULT
+	}
+	return nil
+}
+
+// deleteXattrs deletes the xattr record of a deleted inode
+func (f *FS) deleteXattrs(mrt *MRT, inode uint64) aerospike.Error {
+	xk, err := f.xattrKey(inode)
+	if err != nil {
+		return err
+	}
+	log.Detail("ASD: deleteXattrs: Delete(%v) %v", mrt.Id(), xk)
+	_, err = f.asd.Delete(mrt.Write(), xk)
+	return err
+}
+
+func (f *FS) changeTTL(inode uint64, ttl int) error {
+	err := f.setTTL(inode, ttl)
+	if err != nil {
+		if errno, ok := err.(syscall.Errno); ok {
+			return errno
+		}
+		if aerr, ok := err.(aerospike.Error); ok {
+			return xattrErrno("Set ttl", inode, aerr)
+		}
+		log.Error("Set ttl %d: %s", inode, err)
+		return syscall.EFAULT
+	}
+	return nil
+}
+
+func (d *Dir) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	return d.fs.getxattr(d.inode, req, resp)
+}
+
+func (d *Dir) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	return d.fs.listxattr(d.inode, req, resp)
+}
+
+func (d *Dir) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	return d.fs.setxattr(d.inode, req)
+}
+
+func (d *Dir) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	return d.fs.removexattr(d.inode, req)
+}
+
+func (f *File) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	return f.fs.getxattr(f.inode, req, resp)
+}
+
+func (f *File) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	return f.fs.listxattr(f.inode, req, resp)
+}
+
+func (f *File) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	return f.fs.setxattr(f.inode, req)
+}
+
+func (f *File) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	return f.fs.removexattr(f.inode, req)
+}
+
+func (s *Symlink) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	return s.fs.getxattr(s.inode, req, resp)
+}
+
+func (s *Symlink) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	return s.fs.listxattr(s.inode, req, resp)
+}
+
+func (s *Symlink) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	return s.fs.setxattr(s.inode, req)
+}
+
+func (s *Symlink) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	return s.fs.removexattr(s.inode, req)
+}
+
+func (s *Special) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	return s.fs.getxattr(s.inode, req, resp)
+}
+
+func (s *Special) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	return s.fs.listxattr(s.inode, req, resp)
+}
+
+func (s *Special) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	return s.fs.setxattr(s.inode, req)
+}
+
+func (s *Special) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	return s.fs.removexattr(s.inode, req)
+}